@@ -2,7 +2,11 @@ package api
 
 import (
 	"encoding/json"
+	"net"
 	"net/http"
+	"path"
+	"strconv"
+	"time"
 	"torrent-client/internal/p2p"
 )
 
@@ -20,9 +24,52 @@ func (s *Server) Start() {
 
 	http.HandleFunc("/add", s.handleAdd)
 
+	http.HandleFunc("/bans", localOnly(s.handleBans))
+
+	http.HandleFunc("/ipfilter", localOnly(s.handleIPFilter))
+
+	http.HandleFunc("/recheck", s.handleRecheck)
+
+	http.HandleFunc("/priorities", s.handlePriorities)
+
+	http.HandleFunc("/sequential", s.handleSequential)
+
+	http.HandleFunc("/stream", localOnly(s.handleStream))
+
+	http.HandleFunc("/move", localOnly(s.handleMove))
+
 	go http.ListenAndServe(":8080", nil)
 }
 
+// localOnly guards the endpoints that reach the disk or the ban list. They
+// answer only requests from this machine, addressed to it by a loopback
+// name, that no web page made: browsers mark those with Origin or
+// Sec-Fetch-Site, and the Host check stops DNS rebinding.
+func localOnly(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		site := r.Header.Get("Sec-Fetch-Site")
+		if !isLoopback(r.RemoteAddr) || !isLoopback(r.Host) || r.Header.Get("Origin") != "" ||
+			(site != "" && site != "none" && site != "same-origin") {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		h(w, r)
+	}
+}
+
+// isLoopback reports whether host, with or without a port, names this
+// machine.
+func isLoopback(host string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
 func (s *Server) handleStats(w http.ResponseWriter, r *http.Request) {
 
 	w.Header().Set("Access-Control-Allow-Origin", "*")
@@ -48,8 +95,11 @@ func (s *Server) handleAdd(w http.ResponseWriter, r *http.Request) {
 	}
 
 	var req struct {
-		TorrentData []byte `json:"torrentData"`
-		URL         string `json:"url"`
+		TorrentData  []byte             `json:"torrentData"`
+		URL          string             `json:"url"`
+		SavePath     string             `json:"savePath"`
+		Priorities   []p2p.FilePriority `json:"priorities"`
+		CompletedDir string             `json:"completedDir"`
 	}
 
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
@@ -58,7 +108,11 @@ func (s *Server) handleAdd(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if len(req.TorrentData) > 0 {
-		err := s.Manager.AddTorrent(req.TorrentData)
+		err := s.Manager.AddTorrentWithOptions(req.TorrentData, p2p.AddOptions{
+			SavePath:       req.SavePath,
+			FilePriorities: req.Priorities,
+			CompletedDir:   req.CompletedDir,
+		})
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
@@ -68,3 +122,209 @@ func (s *Server) handleAdd(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusAccepted)
 	w.Write([]byte(`{"status":"added"}`))
 }
+
+func (s *Server) handleBans(w http.ResponseWriter, r *http.Request) {
+
+	w.Header().Set("Content-Type", "application/json")
+
+	switch r.Method {
+	case "GET":
+		json.NewEncoder(w).Encode(s.Manager.Bans.List())
+	case "DELETE":
+		ip := r.URL.Query().Get("ip")
+		if ip == "" {
+			http.Error(w, "Missing ip parameter", http.StatusBadRequest)
+			return
+		}
+		if !s.Manager.Bans.Unban(ip) {
+			http.Error(w, "IP is not banned", http.StatusNotFound)
+			return
+		}
+		w.Write([]byte(`{"status":"unbanned"}`))
+	default:
+		http.Error(w, "Only GET and DELETE are allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleIPFilter reports the loaded filter on GET, loads a file on POST
+// (reloading the current one when no path is given) and clears it on DELETE.
+func (s *Server) handleIPFilter(w http.ResponseWriter, r *http.Request) {
+
+	w.Header().Set("Content-Type", "application/json")
+
+	switch r.Method {
+	case "GET":
+	case "POST":
+		var req struct {
+			Path string `json:"path"`
+		}
+		if r.ContentLength != 0 {
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				http.Error(w, "Invalid request body", http.StatusBadRequest)
+				return
+			}
+		}
+		if req.Path == "" {
+			req.Path = s.Manager.Filter.Path()
+		}
+		if req.Path == "" {
+			http.Error(w, "No filter path given and none loaded", http.StatusBadRequest)
+			return
+		}
+		if err := s.Manager.LoadIPFilter(req.Path); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	case "DELETE":
+		s.Manager.Filter.Clear()
+	default:
+		http.Error(w, "Only GET, POST and DELETE are allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"path":   s.Manager.Filter.Path(),
+		"ranges": s.Manager.Filter.Len(),
+	})
+}
+
+// handleRecheck starts a forced hash check of one torrent; progress shows up
+// in /stats.
+func (s *Server) handleRecheck(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != "POST" {
+		http.Error(w, "Only POST is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		InfoHash string `json:"infoHash"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if err := s.Manager.Recheck(req.InfoHash); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+	w.Write([]byte(`{"status":"checking"}`))
+}
+
+// handlePriorities sets the priority of every file of a torrent: 0 skips a
+// file, 1 to 3 are low, normal and high.
+func (s *Server) handlePriorities(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != "POST" {
+		http.Error(w, "Only POST is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		InfoHash   string             `json:"infoHash"`
+		Priorities []p2p.FilePriority `json:"priorities"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if err := s.Manager.SetFilePriorities(req.InfoHash, req.Priorities); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Write([]byte(`{"status":"updated"}`))
+}
+
+func (s *Server) handleSequential(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != "POST" {
+		http.Error(w, "Only POST is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		InfoHash string `json:"infoHash"`
+		Enabled  bool   `json:"enabled"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if err := s.Manager.SetSequential(req.InfoHash, req.Enabled); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Write([]byte(`{"status":"updated"}`))
+}
+
+// handleStream serves one file of a torrent, /stream?infoHash=...&file=N,
+// with Range support so players can seek. Reads wait for the pieces they
+// need, which are fetched ahead of everything else.
+func (s *Server) handleStream(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != "GET" && r.Method != "HEAD" {
+		http.Error(w, "Only GET and HEAD are allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	t := s.Manager.Torrent(r.URL.Query().Get("infoHash"))
+	if t == nil {
+		http.Error(w, "Unknown torrent", http.StatusNotFound)
+		return
+	}
+	file := 0
+	if f := r.URL.Query().Get("file"); f != "" {
+		n, err := strconv.Atoi(f)
+		if err != nil {
+			http.Error(w, "Invalid file index", http.StatusBadRequest)
+			return
+		}
+		file = n
+	}
+
+	reader, err := t.NewReader(r.Context(), file)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	defer reader.Close()
+
+	http.ServeContent(w, r, path.Base(reader.Name()), time.Time{}, reader)
+}
+
+// handleMove moves a torrent's files to another directory and answers once
+// they are there. The torrent keeps seeding from the old place meanwhile.
+func (s *Server) handleMove(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != "POST" {
+		http.Error(w, "Only POST is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		InfoHash string `json:"infoHash"`
+		Path     string `json:"path"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.Path == "" {
+		http.Error(w, "Missing path", http.StatusBadRequest)
+		return
+	}
+
+	if err := s.Manager.MoveStorage(req.InfoHash, req.Path); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Write([]byte(`{"status":"moved"}`))
+}
@@ -0,0 +1,176 @@
+package api
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"torrent-client/internal/bencode"
+	"torrent-client/internal/p2p"
+)
+
+// seededServer serves a manager holding one complete single-file torrent
+// of data and returns it with the torrent's info hash.
+func seededServer(t *testing.T, data []byte) (*Server, string) {
+	t.Helper()
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "clip.mp4"), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	const pieceLength = 16
+	var pieces []byte
+	for off := 0; off < len(data); off += pieceLength {
+		sum := sha1.Sum(data[off:min(off+pieceLength, len(data))])
+		pieces = append(pieces, sum[:]...)
+	}
+	info := bencode.BDict{
+		"name":         bencode.BString("clip.mp4"),
+		"piece length": bencode.BInt(pieceLength),
+		"length":       bencode.BInt(len(data)),
+		"pieces":       bencode.BString(pieces),
+	}
+	// Nothing listens on either URL; the web seed lets the add go ahead
+	// without a tracker.
+	torrent, err := bencode.Encode(bencode.BDict{
+		"announce": bencode.BString("http://127.0.0.1:1/announce"),
+		"url-list": bencode.BString("http://127.0.0.1:1/"),
+		"info":     info,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	infoBytes, _ := bencode.Encode(info)
+	infoHash := fmt.Sprintf("%x", sha1.Sum(infoBytes))
+
+	m := p2p.NewManager([20]byte{})
+	cfg := m.Config
+	cfg.ResumeDir = ""
+	m.SetConfig(cfg)
+	if err := m.AddTorrentWithOptions(torrent, p2p.AddOptions{SavePath: dir}); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { m.Close() })
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		stats := m.GetStats()
+		if len(stats) == 1 && stats[0].Percent == 100 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("torrent never completed: %+v", stats)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return NewServer(m), infoHash
+}
+
+func TestStreamRanges(t *testing.T) {
+	data := []byte("0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ")
+	s, hash := seededServer(t, data)
+
+	tests := []struct {
+		rangeHeader  string
+		status       int
+		body         string
+		contentRange string
+	}{
+		{"", http.StatusOK, string(data), ""},
+		{"bytes=10-19", http.StatusPartialContent, "abcdefghij", fmt.Sprintf("bytes 10-19/%d", len(data))},
+		{"bytes=14-17", http.StatusPartialContent, "efgh", fmt.Sprintf("bytes 14-17/%d", len(data))},
+		{"bytes=-4", http.StatusPartialContent, "WXYZ", fmt.Sprintf("bytes %d-%d/%d", len(data)-4, len(data)-1, len(data))},
+		{"bytes=60-", http.StatusPartialContent, "YZ", fmt.Sprintf("bytes 60-61/%d", len(data))},
+		{"bytes=100-200", http.StatusRequestedRangeNotSatisfiable, "", ""},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", "/stream?infoHash="+hash, nil)
+		if tt.rangeHeader != "" {
+			req.Header.Set("Range", tt.rangeHeader)
+		}
+		rec := httptest.NewRecorder()
+		s.handleStream(rec, req)
+
+		res := rec.Result()
+		body, _ := io.ReadAll(res.Body)
+		if res.StatusCode != tt.status {
+			t.Errorf("%q: status %d, want %d", tt.rangeHeader, res.StatusCode, tt.status)
+			continue
+		}
+		if tt.status == http.StatusRequestedRangeNotSatisfiable {
+			continue
+		}
+		if string(body) != tt.body {
+			t.Errorf("%q: body %q, want %q", tt.rangeHeader, body, tt.body)
+		}
+		if got := res.Header.Get("Content-Range"); got != tt.contentRange {
+			t.Errorf("%q: Content-Range %q, want %q", tt.rangeHeader, got, tt.contentRange)
+		}
+		if got := res.Header.Get("Accept-Ranges"); got != "bytes" {
+			t.Errorf("%q: Accept-Ranges %q", tt.rangeHeader, got)
+		}
+	}
+}
+
+func TestStreamErrors(t *testing.T) {
+	s, hash := seededServer(t, []byte("just a little data"))
+
+	tests := []struct {
+		method, query string
+		status        int
+	}{
+		{"GET", "infoHash=" + hash + "&file=x", http.StatusBadRequest},
+		{"GET", "infoHash=" + hash + "&file=3", http.StatusNotFound},
+		{"GET", "infoHash=00", http.StatusNotFound},
+		{"POST", "infoHash=" + hash, http.StatusMethodNotAllowed},
+		{"HEAD", "infoHash=" + hash, http.StatusOK},
+	}
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		s.handleStream(rec, httptest.NewRequest(tt.method, "/stream?"+tt.query, nil))
+		if rec.Code != tt.status {
+			t.Errorf("%s %s: status %d, want %d", tt.method, tt.query, rec.Code, tt.status)
+		}
+	}
+}
+
+func TestLocalOnly(t *testing.T) {
+	h := localOnly(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	})
+
+	tests := []struct {
+		name   string
+		remote string
+		host   string
+		header map[string]string
+		status int
+	}{
+		{"loopback", "127.0.0.1:50000", "localhost:8080", nil, http.StatusOK},
+		{"ipv6 loopback", "[::1]:50000", "[::1]:8080", nil, http.StatusOK},
+		{"typed in the address bar", "127.0.0.1:50000", "127.0.0.1:8080", map[string]string{"Sec-Fetch-Site": "none"}, http.StatusOK},
+		{"other machine", "192.0.2.7:50000", "192.0.2.1:8080", nil, http.StatusForbidden},
+		{"rebound name", "127.0.0.1:50000", "attacker.example:8080", nil, http.StatusForbidden},
+		{"web page", "127.0.0.1:50000", "localhost:8080", map[string]string{"Origin": "https://attacker.example"}, http.StatusForbidden},
+		{"embedded by a page", "127.0.0.1:50000", "localhost:8080", map[string]string{"Sec-Fetch-Site": "cross-site"}, http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("POST", "/move", nil)
+		req.RemoteAddr = tt.remote
+		req.Host = tt.host
+		for k, v := range tt.header {
+			req.Header.Set(k, v)
+		}
+		rec := httptest.NewRecorder()
+		h(rec, req)
+		if rec.Code != tt.status {
+			t.Errorf("%s: status %d, want %d", tt.name, rec.Code, tt.status)
+		}
+	}
+}
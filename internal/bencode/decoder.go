@@ -64,11 +64,11 @@ func (d *Decoder) decodeInt() (Bvalue, error) {
 	d.pos++
 
 	start := d.pos
-	for d.data[d.pos] != 'e' {
-		d.pos++
+	for d.Peek() != 'e' {
 		if d.pos >= len(d.data) {
 			return nil, errors.New("unterminated integer")
 		}
+		d.pos++
 	}
 
 	numStr := string(d.data[start:d.pos])
@@ -85,8 +85,8 @@ func (d *Decoder) decodeInt() (Bvalue, error) {
 func (d *Decoder) decodeString() (Bvalue, error) {
 	start := d.pos
 
-	for d.data[d.pos] != ':' {
-		if !unicode.IsDigit(rune(d.data[d.pos])) {
+	for d.Peek() != ':' {
+		if !unicode.IsDigit(rune(d.Peek())) {
 			return nil, errors.New("invalid string length")
 		}
 		d.pos++
@@ -100,7 +100,7 @@ func (d *Decoder) decodeString() (Bvalue, error) {
 
 	d.pos++
 
-	if d.pos+length > len(d.data) {
+	if length > len(d.data)-d.pos {
 		return nil, errors.New("string exceeds data length")
 	}
 
@@ -115,7 +115,7 @@ func (d *Decoder) decodeList() (Bvalue, error) {
 
 	var list BList
 
-	for d.data[d.pos] != 'e' {
+	for d.Peek() != 'e' {
 		val, err := d.Decode()
 		if err != nil {
 			return nil, err
@@ -132,7 +132,7 @@ func (d *Decoder) decodeDict() (Bvalue, error) {
 
 	dict := make(BDict)
 
-	for d.data[d.pos] != 'e' {
+	for d.Peek() != 'e' {
 		keyVal, err := d.decodeString()
 		if err != nil {
 			return nil, err
@@ -154,8 +154,8 @@ func (d *Decoder) decodeDict() (Bvalue, error) {
 
 func (d *Decoder) DecodeDictWithSpan() (BDict, []byte, error) {
 	start := d.pos
-	if d.data[d.pos] != 'd' {
-		return nil, nil, fmt.Errorf("expected 'd' at pos %d, got %c", d.pos, d.data[d.pos])
+	if d.Peek() != 'd' {
+		return nil, nil, fmt.Errorf("expected 'd' at pos %d, got %c", d.pos, d.Peek())
 	}
 
 	val, err := d.decodeDict()
@@ -0,0 +1,82 @@
+package bencode
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+)
+
+// Encode serializes v, which may be built from the B* types or plain Go
+// strings, byte slices and integers. Dictionary keys are sorted as the
+// format requires.
+func Encode(v Bvalue) ([]byte, error) {
+	return appendValue(nil, v)
+}
+
+func appendValue(buf []byte, v Bvalue) ([]byte, error) {
+	switch val := v.(type) {
+	case BInt:
+		return appendInt(buf, int64(val)), nil
+	case int:
+		return appendInt(buf, int64(val)), nil
+	case int64:
+		return appendInt(buf, val), nil
+	case BString:
+		return appendString(buf, val), nil
+	case []byte:
+		return appendString(buf, val), nil
+	case string:
+		return appendString(buf, []byte(val)), nil
+	case BList:
+		return appendList(buf, val)
+	case []Bvalue:
+		return appendList(buf, val)
+	case BDict:
+		return appendDict(buf, val)
+	case map[string]Bvalue:
+		return appendDict(buf, val)
+	default:
+		return nil, fmt.Errorf("cannot bencode %T", v)
+	}
+}
+
+func appendInt(buf []byte, n int64) []byte {
+	buf = append(buf, 'i')
+	buf = strconv.AppendInt(buf, n, 10)
+	return append(buf, 'e')
+}
+
+func appendString(buf []byte, s []byte) []byte {
+	buf = strconv.AppendInt(buf, int64(len(s)), 10)
+	buf = append(buf, ':')
+	return append(buf, s...)
+}
+
+func appendList(buf []byte, list []Bvalue) ([]byte, error) {
+	buf = append(buf, 'l')
+	for _, item := range list {
+		var err error
+		if buf, err = appendValue(buf, item); err != nil {
+			return nil, err
+		}
+	}
+	return append(buf, 'e'), nil
+}
+
+func appendDict(buf []byte, dict map[string]Bvalue) ([]byte, error) {
+	keys := make([]string, 0, len(dict))
+	for k := range dict {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	buf = append(buf, 'd')
+	for _, k := range keys {
+		buf = appendString(buf, []byte(k))
+		var err error
+		if buf, err = appendValue(buf, dict[k]); err != nil {
+			return nil, err
+		}
+	}
+	return append(buf, 'e'), nil
+}
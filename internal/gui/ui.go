@@ -60,10 +60,34 @@ func StartUI(m *p2p.Manager) {
 
 			nameLbl.SetText(stats.Name)
 			pBar.SetValue(stats.Percent / 100)
+			if stats.Error != "" {
+				detailLbl.SetText("Error: " + stats.Error)
+				return
+			}
+			if stats.Moving {
+				detailLbl.SetText("Moving files...")
+				return
+			}
+			if stats.Checking {
+				detailLbl.SetText(fmt.Sprintf("Checking files (%.2f%%)", stats.CheckProgress))
+				return
+			}
 			detailLbl.SetText(fmt.Sprintf("%.2f MB / %.2f MB (%.2f%%)", downloadedMB, totalMB, stats.Percent))
 		},
 	)
 
+	var selected string
+	list.OnSelected = func(id widget.ListItemID) {
+		val, err := boundList.GetValue(id)
+		if err != nil || val == nil {
+			return
+		}
+		selected = val.(p2p.TorrentStats).InfoHash
+	}
+	list.OnUnselected = func(id widget.ListItemID) {
+		selected = ""
+	}
+
 	toolbar := widget.NewToolbar(
 		widget.NewToolbarAction(theme.ContentAddIcon(), func() {
 			fd := dialog.NewFileOpen(func(reader fyne.URIReadCloser, err error) {
@@ -77,6 +101,31 @@ func StartUI(m *p2p.Manager) {
 			fd.SetFilter(storage.NewExtensionFileFilter([]string{".torrent"}))
 			fd.Show()
 		}),
+		widget.NewToolbarAction(theme.ViewRefreshIcon(), func() {
+			if selected == "" {
+				return
+			}
+			if err := m.Recheck(selected); err != nil {
+				dialog.ShowError(err, w)
+			}
+		}),
+		widget.NewToolbarAction(theme.FolderOpenIcon(), func() {
+			if selected == "" {
+				return
+			}
+			infoHash := selected
+			dialog.ShowFolderOpen(func(dir fyne.ListableURI, err error) {
+				if err != nil || dir == nil {
+					return
+				}
+				// Copying to another disk can take a while.
+				go func() {
+					if err := m.MoveStorage(infoHash, dir.Path()); err != nil {
+						fyne.Do(func() { dialog.ShowError(err, w) })
+					}
+				}()
+			}, w)
+		}),
 	)
 
 	go func() {
@@ -0,0 +1,258 @@
+package ipfilter
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Filter blocks address ranges loaded from eMule ipfilter.dat, PeerGuardian
+// P2P or CIDR lists. Ranges are kept sorted and merged so a lookup is a
+// binary search. A Filter can be reloaded while in use.
+type Filter struct {
+	mu     sync.RWMutex
+	ranges []ipRange
+	path   string
+}
+
+// ipRange is an inclusive range of addresses in 16-byte form.
+type ipRange struct {
+	first, last [16]byte
+}
+
+func New() *Filter {
+	return &Filter{}
+}
+
+// Blocked reports whether ip falls in a blocked range. host may carry a
+// port, as peer addresses usually do.
+func (f *Filter) Blocked(host string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	key := to16(ip)
+
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	i := sort.Search(len(f.ranges), func(i int) bool {
+		return bytes.Compare(f.ranges[i].last[:], key[:]) >= 0
+	})
+	return i < len(f.ranges) && bytes.Compare(f.ranges[i].first[:], key[:]) <= 0
+}
+
+// Len returns the number of merged ranges.
+func (f *Filter) Len() int {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return len(f.ranges)
+}
+
+func (f *Filter) Path() string {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return f.path
+}
+
+// LoadFile replaces the filter with the ranges in path. On error the old
+// ranges stay in place.
+func (f *Filter) LoadFile(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	ranges, err := parse(file)
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+
+	f.mu.Lock()
+	f.ranges = ranges
+	f.path = path
+	f.mu.Unlock()
+	return nil
+}
+
+// Reload reads the last loaded file again.
+func (f *Filter) Reload() error {
+	path := f.Path()
+	if path == "" {
+		return fmt.Errorf("no ip filter loaded")
+	}
+	return f.LoadFile(path)
+}
+
+// Clear drops all ranges.
+func (f *Filter) Clear() {
+	f.mu.Lock()
+	f.ranges = nil
+	f.path = ""
+	f.mu.Unlock()
+}
+
+// parse reads one range per line, detecting the format of each line, and
+// returns the ranges sorted and merged.
+func parse(r io.Reader) ([]ipRange, error) {
+	var ranges []ipRange
+	sc := bufio.NewScanner(r)
+	lineNo := 0
+	for sc.Scan() {
+		lineNo++
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, "//") {
+			continue
+		}
+		rng, ok, err := parseLine(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineNo, err)
+		}
+		if ok {
+			ranges = append(ranges, rng)
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	return merge(ranges), nil
+}
+
+// parseLine returns ok == false for eMule entries whose access level
+// allows the range.
+func parseLine(line string) (ipRange, bool, error) {
+	// P2P: description:first-last, where the description may itself
+	// contain colons or commas and IPv6 addresses always do. The range
+	// starts after the first colon that leaves a valid one.
+	for i := 0; i < len(line); i++ {
+		if line[i] != ':' {
+			continue
+		}
+		if rng, err := parseRange(line[i+1:]); err == nil {
+			return rng, true, nil
+		}
+	}
+
+	switch {
+	case strings.Contains(line, ","):
+		// eMule: first - last , access , description
+		fields := strings.SplitN(line, ",", 3)
+		if len(fields) < 2 {
+			return ipRange{}, false, fmt.Errorf("bad ipfilter.dat entry")
+		}
+		level, err := strconv.Atoi(strings.TrimSpace(fields[1]))
+		if err != nil {
+			return ipRange{}, false, fmt.Errorf("bad access level: %w", err)
+		}
+		rng, err := parseRange(fields[0])
+		return rng, level < 128, err
+
+	case strings.Contains(line, "/"):
+		_, network, err := net.ParseCIDR(line)
+		if err != nil {
+			return ipRange{}, false, err
+		}
+		first := to16(network.IP)
+		last := first
+		mask := network.Mask
+		offset := 16 - len(mask)
+		for i := range mask {
+			last[offset+i] |= ^mask[i]
+		}
+		return ipRange{first, last}, true, nil
+
+	case strings.Contains(line, "-"):
+		rng, err := parseRange(line)
+		return rng, true, err
+
+	default:
+		ip := parseIP(line)
+		if ip == nil {
+			return ipRange{}, false, fmt.Errorf("bad address %q", line)
+		}
+		return ipRange{to16(ip), to16(ip)}, true, nil
+	}
+}
+
+func parseRange(s string) (ipRange, error) {
+	parts := strings.SplitN(s, "-", 2)
+	if len(parts) != 2 {
+		return ipRange{}, fmt.Errorf("bad range %q", s)
+	}
+	first, last := parseIP(parts[0]), parseIP(parts[1])
+	if first == nil || last == nil {
+		return ipRange{}, fmt.Errorf("bad range %q", s)
+	}
+	rng := ipRange{to16(first), to16(last)}
+	if bytes.Compare(rng.first[:], rng.last[:]) > 0 {
+		rng.first, rng.last = rng.last, rng.first
+	}
+	return rng, nil
+}
+
+// parseIP also accepts the zero-padded octets ipfilter.dat files use,
+// such as 001.002.003.004.
+func parseIP(s string) net.IP {
+	s = strings.TrimSpace(s)
+	if ip := net.ParseIP(s); ip != nil {
+		return ip
+	}
+	octets := strings.Split(s, ".")
+	if len(octets) != 4 {
+		return nil
+	}
+	ip := make(net.IP, 4)
+	for i, o := range octets {
+		n, err := strconv.Atoi(o)
+		if err != nil || n < 0 || n > 255 {
+			return nil
+		}
+		ip[i] = byte(n)
+	}
+	return ip
+}
+
+func to16(ip net.IP) [16]byte {
+	var b [16]byte
+	copy(b[:], ip.To16())
+	return b
+}
+
+func merge(ranges []ipRange) []ipRange {
+	sort.Slice(ranges, func(i, j int) bool {
+		return bytes.Compare(ranges[i].first[:], ranges[j].first[:]) < 0
+	})
+	var out []ipRange
+	for _, r := range ranges {
+		if n := len(out); n > 0 && !after(r.first, out[n-1].last) {
+			if bytes.Compare(r.last[:], out[n-1].last[:]) > 0 {
+				out[n-1].last = r.last
+			}
+			continue
+		}
+		out = append(out, r)
+	}
+	return out
+}
+
+// after reports whether a lies beyond b with a gap, so that ranges ending
+// at b and starting at a cannot be merged.
+func after(a, b [16]byte) bool {
+	for i := 15; i >= 0; i-- {
+		b[i]++
+		if b[i] != 0 {
+			return bytes.Compare(a[:], b[:]) > 0
+		}
+	}
+	return false
+}
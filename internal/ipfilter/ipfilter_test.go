@@ -0,0 +1,143 @@
+package ipfilter
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func load(t *testing.T, list string) *Filter {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "filter.txt")
+	if err := os.WriteFile(path, []byte(list), 0644); err != nil {
+		t.Fatal(err)
+	}
+	f := New()
+	if err := f.LoadFile(path); err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+func TestFormats(t *testing.T) {
+	tests := []struct {
+		name    string
+		list    string
+		blocked []string
+		allowed []string
+	}{
+		{
+			name:    "emule",
+			list:    "001.002.003.000 - 001.002.003.255 , 000 , Some Corp\n",
+			blocked: []string{"1.2.3.0", "1.2.3.128:6881", "1.2.3.255"},
+			allowed: []string{"1.2.2.255", "1.2.4.0"},
+		},
+		{
+			name:    "emule access level",
+			list:    "10.0.0.0 - 10.0.0.255 , 127 , blocked\n10.0.1.0 - 10.0.1.255 , 128 , allowed\n",
+			blocked: []string{"10.0.0.9"},
+			allowed: []string{"10.0.1.9"},
+		},
+		{
+			name:    "p2p",
+			list:    "Some Corp:5.6.7.8-5.6.7.20\n",
+			blocked: []string{"5.6.7.8", "5.6.7.20"},
+			allowed: []string{"5.6.7.7", "5.6.7.21"},
+		},
+		{
+			name:    "p2p name with colons",
+			list:    "Corp: Europe: Office, Inc.:5.6.7.8-5.6.7.20\n",
+			blocked: []string{"5.6.7.10"},
+			allowed: []string{"5.6.7.21"},
+		},
+		{
+			name:    "cidr",
+			list:    "192.168.0.0/16\n",
+			blocked: []string{"192.168.0.0", "192.168.255.255"},
+			allowed: []string{"192.167.255.255", "192.169.0.0"},
+		},
+		{
+			name:    "single address and reversed range",
+			list:    "8.8.8.8\n9.9.9.20 - 9.9.9.10\n",
+			blocked: []string{"8.8.8.8", "9.9.9.15"},
+			allowed: []string{"8.8.8.9", "9.9.9.21"},
+		},
+		{
+			name:    "ipv6",
+			list:    "2001:db8::/32\nsix:2001:db9::10-2001:db9::20\nfe80::1 - fe80::ff , 0 , link local\n",
+			blocked: []string{"2001:db8::1", "[2001:db8:ffff::1]:6881", "2001:db9::15", "fe80::80"},
+			allowed: []string{"2001:db7::1", "2001:db9::21", "fe80::100", "1.2.3.4"},
+		},
+		{
+			name:    "comments and blank lines",
+			list:    "# comment\n\n// another\n   \n1.1.1.1\n",
+			blocked: []string{"1.1.1.1"},
+			allowed: []string{"1.1.1.2", "not an address"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := load(t, tt.list)
+			for _, host := range tt.blocked {
+				if !f.Blocked(host) {
+					t.Errorf("%s is not blocked", host)
+				}
+			}
+			for _, host := range tt.allowed {
+				if f.Blocked(host) {
+					t.Errorf("%s is blocked", host)
+				}
+			}
+		})
+	}
+}
+
+func TestMerge(t *testing.T) {
+	f := load(t, strings.Join([]string{
+		"10.0.0.0 - 10.0.0.100 , 0 , a",
+		"10.0.0.50 - 10.0.0.200 , 0 , overlaps a",
+		"10.0.0.201 - 10.0.0.255 , 0 , adjacent",
+		"10.0.0.10 - 10.0.0.20 , 0 , inside",
+		"10.0.2.0 - 10.0.2.255 , 0 , separate",
+	}, "\n"))
+
+	if f.Len() != 2 {
+		t.Fatalf("got %d ranges, want 2", f.Len())
+	}
+	for _, host := range []string{"10.0.0.0", "10.0.0.150", "10.0.0.255", "10.0.2.1"} {
+		if !f.Blocked(host) {
+			t.Errorf("%s is not blocked", host)
+		}
+	}
+	if f.Blocked("10.0.1.1") {
+		t.Error("the gap between ranges is blocked")
+	}
+}
+
+func TestMalformed(t *testing.T) {
+	for _, line := range []string{
+		"garbage",
+		"1.2.3.4 - nonsense",
+		"1.2.3.4 - 1.2.3.5 , high , bad level",
+		"1.2.3.256",
+		"10.0.0.0/33",
+		"name:1.2.3.4-",
+	} {
+		path := filepath.Join(t.TempDir(), "filter.txt")
+		os.WriteFile(path, []byte("1.1.1.1\n"+line+"\n"), 0644)
+
+		f := load(t, "9.9.9.9\n")
+		err := f.LoadFile(path)
+		if err == nil {
+			t.Errorf("%q was accepted", line)
+			continue
+		}
+		if !strings.Contains(err.Error(), "line 2") {
+			t.Errorf("%q: error %q does not name the line", line, err)
+		}
+		if !f.Blocked("9.9.9.9") || f.Blocked("1.1.1.1") {
+			t.Errorf("%q: a failed load replaced the filter", line)
+		}
+	}
+}
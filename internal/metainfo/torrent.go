@@ -15,6 +15,20 @@ type TorrentMeta struct {
 	Pieces      [][]byte
 	InfoBytes   []byte
 	InfoHash    [20]byte
+
+	// Files is nil for single-file torrents.
+	Files []File
+	// URLList holds BEP 19 web seeds.
+	URLList []string
+	// HTTPSeeds holds BEP 17 seeds, which serve pieces by index.
+	HTTPSeeds []string
+}
+
+// File is one entry of a multi-file torrent. Path is relative to the
+// torrent's directory, one element per path component.
+type File struct {
+	Path   []string
+	Length int64
 }
 
 func ParseTorrent(data []byte) (*TorrentMeta, error) {
@@ -26,6 +40,7 @@ func ParseTorrent(data []byte) (*TorrentMeta, error) {
 	dec.PosIncr(1)
 
 	var announce string
+	var urlList, httpSeeds []string
 	var infoDict bencode.BDict
 	var infoBytes []byte
 
@@ -44,6 +59,18 @@ func ParseTorrent(data []byte) (*TorrentMeta, error) {
 				return nil, err
 			}
 			announce = string(val.(bencode.BString))
+		case "url-list":
+			val, err := dec.Decode()
+			if err != nil {
+				return nil, err
+			}
+			urlList = stringList(val)
+		case "httpseeds":
+			val, err := dec.Decode()
+			if err != nil {
+				return nil, err
+			}
+			httpSeeds = stringList(val)
 		case "info":
 			dict, raw, err := dec.DecodeDictWithSpan()
 			if err != nil {
@@ -64,12 +91,21 @@ func ParseTorrent(data []byte) (*TorrentMeta, error) {
 	}
 
 	var totalLength int64
+	var files []File
 	if val, ok := infoDict["length"]; ok {
 		totalLength = int64(val.(bencode.BInt))
-	} else if files, ok := infoDict["files"]; ok {
-		for _, f := range files.(bencode.BList) {
+	} else if list, ok := infoDict["files"]; ok {
+		for _, f := range list.(bencode.BList) {
 			fileDict := f.(bencode.BDict)
-			totalLength += int64(fileDict["length"].(bencode.BInt))
+			file := File{
+				Path:   stringList(fileDict["path"]),
+				Length: int64(fileDict["length"].(bencode.BInt)),
+			}
+			if len(file.Path) == 0 {
+				return nil, errors.New("file entry without a path")
+			}
+			files = append(files, file)
+			totalLength += file.Length
 		}
 	}
 
@@ -90,5 +126,29 @@ func ParseTorrent(data []byte) (*TorrentMeta, error) {
 		Pieces:      pieces,
 		InfoBytes:   infoBytes,
 		InfoHash:    sha1.Sum(infoBytes),
+		Files:       files,
+		URLList:     urlList,
+		HTTPSeeds:   httpSeeds,
 	}, nil
 }
+
+// stringList accepts either a single string or a list of strings, as
+// url-list and similar keys allow both.
+func stringList(val bencode.Bvalue) []string {
+	switch v := val.(type) {
+	case bencode.BString:
+		if len(v) == 0 {
+			return nil
+		}
+		return []string{string(v)}
+	case bencode.BList:
+		var out []string
+		for _, item := range v {
+			if s, ok := item.(bencode.BString); ok && len(s) > 0 {
+				out = append(out, string(s))
+			}
+		}
+		return out
+	}
+	return nil
+}
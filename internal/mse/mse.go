@@ -0,0 +1,323 @@
+package mse
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/rc4"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"sync"
+)
+
+type Policy int
+
+const (
+	PolicyDisabled Policy = iota
+	PolicyPrefer
+	PolicyRequire
+)
+
+const (
+	CryptoPlaintext uint32 = 0x01
+	CryptoRC4       uint32 = 0x02
+)
+
+const (
+	keyLength = 96
+	maxPad    = 512
+)
+
+var (
+	prime, _  = new(big.Int).SetString("FFFFFFFFFFFFFFFFC90FDAA22168C234C4C6628B80DC1CD129024E088A67CC74020BBEA63B139B22514A08798E3404DDEF9519B3CD3A431B302B0A6DF25F14374FE1356D6D51C245E485B576625E7EC6F44C42E9A63A36210000000000090563", 16)
+	generator = big.NewInt(2)
+	vc        = make([]byte, 8)
+)
+
+var ErrNoMatchingKey = errors.New("mse: no torrent matches the offered info hash")
+
+// Initiate runs the outgoing side of the handshake with skey being the info
+// hash of the torrent we want. provide is a mask of the Crypto* methods we
+// accept; the returned conn speaks whichever one the peer selected.
+func Initiate(conn net.Conn, skey [20]byte, provide uint32) (net.Conn, error) {
+	priv, pub, err := newKeyPair()
+	if err != nil {
+		return nil, err
+	}
+	if err := writeWithPad(conn, pub); err != nil {
+		return nil, err
+	}
+
+	r := bufio.NewReader(conn)
+	otherPub := make([]byte, keyLength)
+	if _, err := io.ReadFull(r, otherPub); err != nil {
+		return nil, err
+	}
+	s := sharedSecret(priv, otherPub)
+
+	enc := newCipher(hash([]byte("keyA"), s, skey[:]))
+	dec := newCipher(hash([]byte("keyB"), s, skey[:]))
+
+	req2 := hash([]byte("req2"), skey[:])
+	req3 := hash([]byte("req3"), s)
+	for i := range req2 {
+		req2[i] ^= req3[i]
+	}
+
+	plain := make([]byte, 0, 16)
+	plain = append(plain, vc...)
+	plain = binary.BigEndian.AppendUint32(plain, provide)
+	plain = binary.BigEndian.AppendUint16(plain, 0) // len(PadC)
+	plain = binary.BigEndian.AppendUint16(plain, 0) // len(IA)
+	enc.XORKeyStream(plain, plain)
+
+	var msg []byte
+	msg = append(msg, hash([]byte("req1"), s)...)
+	msg = append(msg, req2...)
+	msg = append(msg, plain...)
+	if _, err := conn.Write(msg); err != nil {
+		return nil, err
+	}
+
+	// The encrypted VC marks the end of PadB.
+	probe := newCipher(hash([]byte("keyB"), s, skey[:]))
+	pattern := make([]byte, len(vc))
+	probe.XORKeyStream(pattern, vc)
+	if err := syncTo(r, pattern, maxPad+len(pattern)); err != nil {
+		return nil, err
+	}
+	dec.XORKeyStream(make([]byte, len(vc)), pattern)
+
+	head := make([]byte, 6)
+	if _, err := io.ReadFull(r, head); err != nil {
+		return nil, err
+	}
+	dec.XORKeyStream(head, head)
+	selected := binary.BigEndian.Uint32(head[0:4])
+	padLen := int(binary.BigEndian.Uint16(head[4:6]))
+	if padLen > maxPad {
+		return nil, fmt.Errorf("mse: padding too long: %d", padLen)
+	}
+	pad := make([]byte, padLen)
+	if _, err := io.ReadFull(r, pad); err != nil {
+		return nil, err
+	}
+	dec.XORKeyStream(pad, pad)
+
+	switch {
+	case selected == CryptoRC4 && provide&CryptoRC4 != 0:
+		return &cryptConn{Conn: conn, r: &cipherReader{r: r, c: dec}, enc: enc}, nil
+	case selected == CryptoPlaintext && provide&CryptoPlaintext != 0:
+		return &cryptConn{Conn: conn, r: r}, nil
+	default:
+		return nil, fmt.Errorf("mse: peer selected unsupported method %#x", selected)
+	}
+}
+
+// Accept runs the receiving side. r must yield the peer's bytes from the
+// very start of the connection, which lets callers peek at the stream to
+// tell plaintext handshakes apart first. skeys are the info hashes we serve
+// and allowed masks the methods we are willing to select, RC4 winning when
+// both sides offer it.
+func Accept(conn net.Conn, r io.Reader, skeys [][20]byte, allowed uint32) (net.Conn, [20]byte, error) {
+	var skey [20]byte
+	br := bufio.NewReader(r)
+
+	otherPub := make([]byte, keyLength)
+	if _, err := io.ReadFull(br, otherPub); err != nil {
+		return nil, skey, err
+	}
+
+	priv, pub, err := newKeyPair()
+	if err != nil {
+		return nil, skey, err
+	}
+	if err := writeWithPad(conn, pub); err != nil {
+		return nil, skey, err
+	}
+	s := sharedSecret(priv, otherPub)
+
+	if err := syncTo(br, hash([]byte("req1"), s), maxPad+20); err != nil {
+		return nil, skey, err
+	}
+
+	obfuscated := make([]byte, 20)
+	if _, err := io.ReadFull(br, obfuscated); err != nil {
+		return nil, skey, err
+	}
+	req3 := hash([]byte("req3"), s)
+	for i := range obfuscated {
+		obfuscated[i] ^= req3[i]
+	}
+	found := false
+	for _, k := range skeys {
+		if bytes.Equal(obfuscated, hash([]byte("req2"), k[:])) {
+			skey, found = k, true
+			break
+		}
+	}
+	if !found {
+		return nil, skey, ErrNoMatchingKey
+	}
+
+	dec := newCipher(hash([]byte("keyA"), s, skey[:]))
+	enc := newCipher(hash([]byte("keyB"), s, skey[:]))
+
+	head := make([]byte, 14)
+	if _, err := io.ReadFull(br, head); err != nil {
+		return nil, skey, err
+	}
+	dec.XORKeyStream(head, head)
+	if !bytes.Equal(head[0:8], vc) {
+		return nil, skey, errors.New("mse: bad verification constant")
+	}
+	provide := binary.BigEndian.Uint32(head[8:12])
+	padLen := int(binary.BigEndian.Uint16(head[12:14]))
+	if padLen > maxPad {
+		return nil, skey, fmt.Errorf("mse: padding too long: %d", padLen)
+	}
+
+	rest := make([]byte, padLen+2)
+	if _, err := io.ReadFull(br, rest); err != nil {
+		return nil, skey, err
+	}
+	dec.XORKeyStream(rest, rest)
+	ia := make([]byte, binary.BigEndian.Uint16(rest[padLen:]))
+	if _, err := io.ReadFull(br, ia); err != nil {
+		return nil, skey, err
+	}
+	dec.XORKeyStream(ia, ia)
+
+	var selected uint32
+	switch {
+	case provide&allowed&CryptoRC4 != 0:
+		selected = CryptoRC4
+	case provide&allowed&CryptoPlaintext != 0:
+		selected = CryptoPlaintext
+	default:
+		return nil, skey, fmt.Errorf("mse: no common crypto method (offered %#x)", provide)
+	}
+
+	reply := make([]byte, 0, 14)
+	reply = append(reply, vc...)
+	reply = binary.BigEndian.AppendUint32(reply, selected)
+	reply = binary.BigEndian.AppendUint16(reply, 0) // len(PadD)
+	enc.XORKeyStream(reply, reply)
+	if _, err := conn.Write(reply); err != nil {
+		return nil, skey, err
+	}
+
+	if selected == CryptoPlaintext {
+		return &cryptConn{Conn: conn, r: io.MultiReader(bytes.NewReader(ia), br)}, skey, nil
+	}
+	stream := io.MultiReader(bytes.NewReader(ia), &cipherReader{r: br, c: dec})
+	return &cryptConn{Conn: conn, r: stream, enc: enc}, skey, nil
+}
+
+// IsPlaintextHandshake reports whether the first bytes of a connection are
+// an unencrypted BitTorrent handshake rather than an MSE public key.
+func IsPlaintextHandshake(prefix []byte) bool {
+	return len(prefix) >= 20 && prefix[0] == 19 && string(prefix[1:20]) == "BitTorrent protocol"
+}
+
+func newKeyPair() (*big.Int, []byte, error) {
+	privBytes := make([]byte, 20)
+	if _, err := rand.Read(privBytes); err != nil {
+		return nil, nil, err
+	}
+	priv := new(big.Int).SetBytes(privBytes)
+	pub := new(big.Int).Exp(generator, priv, prime)
+	return priv, pub.FillBytes(make([]byte, keyLength)), nil
+}
+
+func sharedSecret(priv *big.Int, otherPub []byte) []byte {
+	y := new(big.Int).SetBytes(otherPub)
+	return new(big.Int).Exp(y, priv, prime).FillBytes(make([]byte, keyLength))
+}
+
+func hash(parts ...[]byte) []byte {
+	h := sha1.New()
+	for _, p := range parts {
+		h.Write(p)
+	}
+	return h.Sum(nil)
+}
+
+// newCipher returns RC4 keyed with key after dropping the first 1024 bytes
+// of keystream, as the spec requires.
+func newCipher(key []byte) *rc4.Cipher {
+	c, _ := rc4.NewCipher(key)
+	discard := make([]byte, 1024)
+	c.XORKeyStream(discard, discard)
+	return c
+}
+
+func writeWithPad(w io.Writer, pub []byte) error {
+	var n [2]byte
+	if _, err := rand.Read(n[:]); err != nil {
+		return err
+	}
+	pad := make([]byte, int(binary.BigEndian.Uint16(n[:]))%(maxPad+1))
+	if _, err := rand.Read(pad); err != nil {
+		return err
+	}
+	_, err := w.Write(append(append([]byte(nil), pub...), pad...))
+	return err
+}
+
+// syncTo consumes r up to and including pattern, giving up after limit bytes.
+func syncTo(r *bufio.Reader, pattern []byte, limit int) error {
+	window := make([]byte, 0, limit)
+	for len(window) < limit {
+		b, err := r.ReadByte()
+		if err != nil {
+			return err
+		}
+		window = append(window, b)
+		if bytes.HasSuffix(window, pattern) {
+			return nil
+		}
+	}
+	return errors.New("mse: could not synchronize with peer")
+}
+
+type cipherReader struct {
+	r io.Reader
+	c *rc4.Cipher
+}
+
+func (cr *cipherReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.c.XORKeyStream(p[:n], p[:n])
+	return n, err
+}
+
+// cryptConn is the connection handed back after the handshake. Reads drain
+// whatever the handshake buffered first; writes are encrypted unless
+// plaintext was selected.
+type cryptConn struct {
+	net.Conn
+	r   io.Reader
+	enc *rc4.Cipher
+	wmu sync.Mutex
+}
+
+func (c *cryptConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+func (c *cryptConn) Write(p []byte) (int, error) {
+	if c.enc == nil {
+		return c.Conn.Write(p)
+	}
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	buf := make([]byte, len(p))
+	c.enc.XORKeyStream(buf, p)
+	return c.Conn.Write(buf)
+}
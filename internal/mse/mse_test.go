@@ -0,0 +1,192 @@
+package mse
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordingConn keeps a copy of everything written through it, so tests
+// can check what actually went over the wire.
+type recordingConn struct {
+	net.Conn
+	mu      sync.Mutex
+	written bytes.Buffer
+}
+
+func (c *recordingConn) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	c.written.Write(p)
+	c.mu.Unlock()
+	return c.Conn.Write(p)
+}
+
+func (c *recordingConn) wire() []byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]byte(nil), c.written.Bytes()...)
+}
+
+// side is how one end of a handshake came out.
+type side struct {
+	conn net.Conn
+	skey [20]byte
+	err  error
+}
+
+// pipeHandshake runs Initiate and Accept against each other over net.Pipe.
+// The accepting side hangs up when it fails, as the listener does, so the
+// initiator never waits forever.
+func pipeHandshake(t *testing.T, skey [20]byte, provide uint32, skeys [][20]byte, allowed uint32) (rec *recordingConn, out, in side) {
+	t.Helper()
+	a, b := net.Pipe()
+	t.Cleanup(func() { a.Close(); b.Close() })
+	deadline := time.Now().Add(5 * time.Second)
+	a.SetDeadline(deadline)
+	b.SetDeadline(deadline)
+
+	done := make(chan side, 1)
+	go func() {
+		conn, key, err := Accept(b, b, skeys, allowed)
+		if err != nil {
+			b.Close()
+		}
+		done <- side{conn, key, err}
+	}()
+
+	rec = &recordingConn{Conn: a}
+	conn, err := Initiate(rec, skey, provide)
+	if err != nil {
+		a.Close()
+	}
+	return rec, side{conn, skey, err}, <-done
+}
+
+// exchange sends a message each way and checks both arrive intact.
+func exchange(t *testing.T, x, y net.Conn) {
+	t.Helper()
+	for _, dir := range []struct {
+		from, to net.Conn
+		msg      string
+	}{
+		{x, y, "ping from the initiator"},
+		{y, x, "pong from the acceptor"},
+	} {
+		errc := make(chan error, 1)
+		go func() {
+			_, err := dir.from.Write([]byte(dir.msg))
+			errc <- err
+		}()
+		got := make([]byte, len(dir.msg))
+		if _, err := io.ReadFull(dir.to, got); err != nil {
+			t.Fatal(err)
+		}
+		if err := <-errc; err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != dir.msg {
+			t.Fatalf("got %q, want %q", got, dir.msg)
+		}
+	}
+}
+
+func TestHandshakePolicies(t *testing.T) {
+	skey := [20]byte{1, 2, 3}
+	other := [20]byte{9, 9, 9}
+
+	tests := []struct {
+		name      string
+		provide   uint32
+		allowed   uint32
+		encrypted bool
+	}{
+		{"prefer", CryptoRC4 | CryptoPlaintext, CryptoRC4 | CryptoPlaintext, true},
+		{"require", CryptoRC4, CryptoRC4, true},
+		{"prefer meets require", CryptoRC4 | CryptoPlaintext, CryptoRC4, true},
+		{"plaintext", CryptoPlaintext, CryptoRC4 | CryptoPlaintext, false},
+		{"plaintext only acceptor", CryptoRC4 | CryptoPlaintext, CryptoPlaintext, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec, out, in := pipeHandshake(t, skey, tt.provide, [][20]byte{other, skey}, tt.allowed)
+			if out.err != nil {
+				t.Fatalf("Initiate: %v", out.err)
+			}
+			if in.err != nil {
+				t.Fatalf("Accept: %v", in.err)
+			}
+			if in.skey != skey {
+				t.Fatalf("Accept picked key %x, want %x", in.skey, skey)
+			}
+
+			exchange(t, out.conn, in.conn)
+
+			sent := bytes.Contains(rec.wire(), []byte("ping from the initiator"))
+			if tt.encrypted && sent {
+				t.Fatal("RC4 was selected but the payload went out in the clear")
+			}
+			if !tt.encrypted && !sent {
+				t.Fatal("plaintext was selected but the payload was not sent as is")
+			}
+		})
+	}
+}
+
+func TestHandshakeMismatchRefused(t *testing.T) {
+	skey := [20]byte{1, 2, 3}
+
+	tests := []struct {
+		name             string
+		provide, allowed uint32
+	}{
+		{"plaintext against require", CryptoPlaintext, CryptoRC4},
+		{"require against plaintext", CryptoRC4, CryptoPlaintext},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, out, in := pipeHandshake(t, skey, tt.provide, [][20]byte{skey}, tt.allowed)
+			if in.err == nil {
+				t.Fatal("Accept agreed on a method the initiator did not offer")
+			}
+			if out.err == nil {
+				t.Fatal("Initiate succeeded although the peer refused")
+			}
+		})
+	}
+}
+
+func TestHandshakeUnknownTorrent(t *testing.T) {
+	_, out, in := pipeHandshake(t, [20]byte{1}, CryptoRC4, [][20]byte{{2}, {3}}, CryptoRC4)
+	if !errors.Is(in.err, ErrNoMatchingKey) {
+		t.Fatalf("Accept: got %v, want ErrNoMatchingKey", in.err)
+	}
+	if out.err == nil {
+		t.Fatal("Initiate succeeded for a torrent the peer does not have")
+	}
+}
+
+func TestIsPlaintextHandshake(t *testing.T) {
+	bt := append([]byte{19}, "BitTorrent protocol"...)
+
+	tests := []struct {
+		name   string
+		prefix []byte
+		want   bool
+	}{
+		{"handshake", bt, true},
+		{"handshake with more", append(append([]byte(nil), bt...), 0, 0, 0), true},
+		{"too short", bt[:19], false},
+		{"wrong length byte", append([]byte{18}, bt[1:]...), false},
+		{"other protocol", append([]byte{19}, "BitTorrent protocoX"...), false},
+		{"public key", bytes.Repeat([]byte{0xc9}, keyLength), false},
+	}
+	for _, tt := range tests {
+		if got := IsPlaintextHandshake(tt.prefix); got != tt.want {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,21 @@
+package netbind
+
+import (
+	"net"
+	"strings"
+	"syscall"
+)
+
+// bindToDevice sets IP_BOUND_IF, or IPV6_BOUND_IF for IPv6 sockets, which
+// makes the kernel send the socket's traffic out of the named interface
+// only.
+func bindToDevice(fd uintptr, network, iface string) error {
+	ifi, err := net.InterfaceByName(iface)
+	if err != nil {
+		return err
+	}
+	if strings.HasSuffix(network, "6") {
+		return syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_BOUND_IF, ifi.Index)
+	}
+	return syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_BOUND_IF, ifi.Index)
+}
@@ -0,0 +1,17 @@
+package netbind
+
+import (
+	"errors"
+	"syscall"
+)
+
+// bindToDevice sets SO_BINDTODEVICE, which makes the kernel send the
+// socket's traffic out of the named interface only. Before Linux 5.7 that
+// needs CAP_NET_RAW; without it the source address has to do.
+func bindToDevice(fd uintptr, network, iface string) error {
+	err := syscall.SetsockoptString(int(fd), syscall.SOL_SOCKET, syscall.SO_BINDTODEVICE, iface)
+	if errors.Is(err, syscall.EPERM) {
+		return nil
+	}
+	return err
+}
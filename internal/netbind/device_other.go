@@ -0,0 +1,9 @@
+//go:build !linux && !darwin
+
+package netbind
+
+// bindToDevice is a no-op where the platform has no per-socket interface
+// option; the local address still selects the interface.
+func bindToDevice(fd uintptr, network, iface string) error {
+	return nil
+}
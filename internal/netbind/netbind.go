@@ -0,0 +1,189 @@
+package netbind
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"syscall"
+)
+
+var ErrUnavailable = errors.New("bound interface is unavailable")
+
+// Binding pins traffic to one network interface, one local address, or a
+// given address on a given interface. The zero value leaves the choice to
+// the operating system.
+type Binding struct {
+	Interface string
+	Address   string
+}
+
+func (b Binding) Enabled() bool {
+	return b.Interface != "" || b.Address != ""
+}
+
+// LocalIP returns the address to bind to. It fails with ErrUnavailable
+// when the interface is missing or down, or no longer carries the
+// configured address, which is how a dropped VPN shows up.
+func (b Binding) LocalIP() (net.IP, error) {
+	if !b.Enabled() {
+		return nil, nil
+	}
+
+	var want net.IP
+	if b.Address != "" {
+		if want = net.ParseIP(b.Address); want == nil {
+			return nil, fmt.Errorf("invalid bind address %q", b.Address)
+		}
+	}
+
+	var ifaces []net.Interface
+	if b.Interface != "" {
+		iface, err := net.InterfaceByName(b.Interface)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s: %v", ErrUnavailable, b.Interface, err)
+		}
+		ifaces = []net.Interface{*iface}
+	} else {
+		var err error
+		if ifaces, err = net.Interfaces(); err != nil {
+			return nil, err
+		}
+	}
+
+	// Prefer IPv4, since most peers and trackers still are.
+	var v6 net.IP
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 {
+			continue
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, a := range addrs {
+			ipnet, ok := a.(*net.IPNet)
+			if !ok {
+				continue
+			}
+			ip := ipnet.IP
+			switch {
+			case want != nil:
+				if ip.Equal(want) {
+					return ip, nil
+				}
+			case ip.To4() != nil:
+				return ip, nil
+			case v6 == nil && ip.IsGlobalUnicast():
+				v6 = ip
+			}
+		}
+	}
+	if v6 != nil {
+		return v6, nil
+	}
+
+	what := b.Interface
+	if b.Address != "" {
+		what = b.Address
+	}
+	return nil, fmt.Errorf("%w: no usable address on %s", ErrUnavailable, what)
+}
+
+// Dialer returns a dialer whose connections leave from the bound address
+// and, when an interface is configured, are pinned to it by the kernel so
+// they cannot take another route. Host names are looked up over the same
+// binding.
+func (b Binding) Dialer() (*net.Dialer, error) {
+	ip, err := b.LocalIP()
+	if err != nil {
+		return nil, err
+	}
+	d := &net.Dialer{Control: b.control}
+	if ip != nil {
+		d.LocalAddr = &net.TCPAddr{IP: ip}
+		d.Resolver = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				dns := &net.Dialer{Control: b.control}
+				if strings.HasPrefix(network, "udp") {
+					dns.LocalAddr = &net.UDPAddr{IP: ip}
+				} else {
+					dns.LocalAddr = &net.TCPAddr{IP: ip}
+				}
+				return dns.DialContext(ctx, network, addr)
+			},
+		}
+	}
+	return d, nil
+}
+
+// DialContext dials a TCP connection from the bound address, looking the
+// address up on every call so an interface change is noticed.
+func (b Binding) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	d, err := b.Dialer()
+	if err != nil {
+		return nil, err
+	}
+	return d.DialContext(ctx, network, addr)
+}
+
+// ListenPacket opens a UDP socket on the bound address and a free port.
+func (b Binding) ListenPacket() (net.PacketConn, error) {
+	return b.ListenUDP(":0")
+}
+
+// ListenUDP opens a UDP socket on the port of addr, bound like Dialer's
+// connections.
+func (b Binding) ListenUDP(addr string) (net.PacketConn, error) {
+	bound, err := b.ListenAddr(addr)
+	if err != nil {
+		return nil, err
+	}
+	lc := net.ListenConfig{Control: b.control}
+	return lc.ListenPacket(context.Background(), "udp", bound)
+}
+
+// Listen accepts TCP connections on the port of addr, bound like Dialer's
+// connections.
+func (b Binding) Listen(addr string) (net.Listener, error) {
+	bound, err := b.ListenAddr(addr)
+	if err != nil {
+		return nil, err
+	}
+	lc := net.ListenConfig{Control: b.control}
+	return lc.Listen(context.Background(), "tcp", bound)
+}
+
+// control pins a socket to the configured interface before it is bound.
+func (b Binding) control(network, address string, c syscall.RawConn) error {
+	if b.Interface == "" {
+		return nil
+	}
+	var serr error
+	err := c.Control(func(fd uintptr) {
+		serr = bindToDevice(fd, network, b.Interface)
+	})
+	if err != nil {
+		return err
+	}
+	if serr != nil {
+		return fmt.Errorf("bind to %s: %w", b.Interface, serr)
+	}
+	return nil
+}
+
+// ListenAddr rewrites a listen address such as ":6881" to the bound
+// address, keeping the port.
+func (b Binding) ListenAddr(addr string) (string, error) {
+	ip, err := b.LocalIP()
+	if err != nil || ip == nil {
+		return addr, err
+	}
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(ip.String(), port), nil
+}
@@ -0,0 +1,62 @@
+package netbind
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+)
+
+func loopback(t *testing.T) string {
+	t.Helper()
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagLoopback != 0 && iface.Flags&net.FlagUp != 0 {
+			return iface.Name
+		}
+	}
+	t.Skip("no loopback interface")
+	return ""
+}
+
+func TestBoundSocketsStayOnInterface(t *testing.T) {
+	b := Binding{Interface: loopback(t)}
+	ln, err := b.Listen(":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	if ip := ln.Addr().(*net.TCPAddr).IP; !ip.IsLoopback() {
+		t.Fatalf("listening on %v, want a loopback address", ip)
+	}
+	go func() {
+		if c, err := ln.Accept(); err == nil {
+			c.Close()
+		}
+	}()
+
+	conn, err := b.DialContext(context.Background(), "tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	pc, err := b.ListenPacket()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pc.Close()
+}
+
+func TestMissingInterfaceIsUnavailable(t *testing.T) {
+	b := Binding{Interface: "no-such-interface"}
+	if _, err := b.Dialer(); !errors.Is(err, ErrUnavailable) {
+		t.Errorf("Dialer: got %v", err)
+	}
+	if _, err := b.Listen(":0"); !errors.Is(err, ErrUnavailable) {
+		t.Errorf("Listen: got %v", err)
+	}
+}
@@ -0,0 +1,134 @@
+package p2p
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+type BanEntry struct {
+	IP      string    `json:"ip"`
+	Reason  string    `json:"reason"`
+	Expires time.Time `json:"expires"`
+}
+
+// BanList is shared by every torrent of a Manager, so a peer caught sending
+// bad data is dropped everywhere.
+type BanList struct {
+	mu      sync.Mutex
+	entries map[string]BanEntry
+}
+
+func NewBanList() *BanList {
+	return &BanList{entries: make(map[string]BanEntry)}
+}
+
+func (b *BanList) Ban(ip, reason string, d time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.entries[ip] = BanEntry{IP: ip, Reason: reason, Expires: time.Now().Add(d)}
+}
+
+func (b *BanList) Unban(ip string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	_, ok := b.entries[ip]
+	delete(b.entries, ip)
+	return ok
+}
+
+func (b *BanList) IsBanned(ip string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	e, ok := b.entries[ip]
+	if !ok {
+		return false
+	}
+	if time.Now().After(e.Expires) {
+		delete(b.entries, ip)
+		return false
+	}
+	return true
+}
+
+func (b *BanList) List() []BanEntry {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	list := []BanEntry{}
+	for ip, e := range b.entries {
+		if now.After(e.Expires) {
+			delete(b.entries, ip)
+			continue
+		}
+		list = append(list, e)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].IP < list[j].IP })
+	return list
+}
+
+// suspectTimeout is how long the senders of a bad piece are kept off it.
+// When nobody else has the piece, one of them then fetches it alone, which
+// either clears the suspect copy or gets that peer banned.
+const suspectTimeout = 2 * time.Minute
+
+// handleHashFailure bans the sender of a bad piece when a single peer sent
+// all of it. Otherwise the copy is kept as a suspect and the piece is
+// re-downloaded from one peer outside the original set, so the blocks that
+// differ point at the culprit.
+func (t *Torrent) handleHashFailure(pw *pieceWork, data []byte, sources []string) {
+	contributors := uniqueSources(sources)
+	if len(contributors) == 1 {
+		t.banPeer(contributors[0], fmt.Sprintf("sent bad data for piece %d", pw.index))
+		return
+	}
+
+	pw.suspect = append([]byte(nil), data...)
+	pw.suspectSources = sources
+	pw.suspectUntil = time.Now().Add(suspectTimeout)
+}
+
+func (t *Torrent) attributeBadBlocks(pw *pieceWork, good []byte) {
+	for i, src := range pw.suspectSources {
+		begin := i * MaxBlockSize
+		end := begin + MaxBlockSize
+		if end > len(good) {
+			end = len(good)
+		}
+		if src != "" && !bytes.Equal(good[begin:end], pw.suspect[begin:end]) {
+			t.banPeer(src, fmt.Sprintf("sent bad block %d of piece %d", i, pw.index))
+		}
+	}
+	pw.suspect = nil
+	pw.suspectSources = nil
+	pw.suspectUntil = time.Time{}
+}
+
+func (t *Torrent) banPeer(ip, reason string) {
+	fmt.Printf("   ! Banning %s for %v: %s\n", ip, t.Config.BanDuration, reason)
+	t.bans.Ban(ip, reason, t.Config.BanDuration)
+}
+
+func uniqueSources(sources []string) []string {
+	var unique []string
+	seen := make(map[string]bool)
+	for _, src := range sources {
+		if src != "" && !seen[src] {
+			seen[src] = true
+			unique = append(unique, src)
+		}
+	}
+	return unique
+}
+
+func peerIP(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
@@ -0,0 +1,103 @@
+package p2p
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestBadPieceFromOnePeerBansIt(t *testing.T) {
+	tor := &Torrent{Config: DefaultConfig(), bans: NewBanList()}
+	pw := &pieceWork{index: 4}
+	tor.handleHashFailure(pw, make([]byte, 2*MaxBlockSize), []string{"10.0.0.1", "10.0.0.1"})
+
+	if !tor.bans.IsBanned("10.0.0.1") {
+		t.Error("the only sender of a bad piece was not banned")
+	}
+	if pw.suspect != nil {
+		t.Error("kept a suspect copy although the culprit is known")
+	}
+}
+
+func TestBadBlocksAreAttributed(t *testing.T) {
+	tor := &Torrent{Config: DefaultConfig(), bans: NewBanList()}
+	good := bytes.Repeat([]byte{1}, 3*MaxBlockSize)
+	bad := append([]byte(nil), good...)
+	bad[MaxBlockSize+10] = 0
+
+	pw := &pieceWork{index: 4}
+	sources := []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"}
+	tor.handleHashFailure(pw, bad, sources)
+	if len(tor.bans.List()) != 0 {
+		t.Fatalf("banned %v before knowing who sent the bad block", tor.bans.List())
+	}
+
+	// The senders are kept off the piece so someone else fetches it.
+	contributor := &peerState{ip: "10.0.0.2"}
+	outsider := &peerState{ip: "10.0.0.9"}
+	if contributor.canDownload(pw) {
+		t.Error("a sender of the bad copy may fetch the piece again")
+	}
+	if !outsider.canDownload(pw) {
+		t.Error("an outsider may not fetch the piece")
+	}
+
+	tor.attributeBadBlocks(pw, good)
+	for _, ip := range sources {
+		if banned := tor.bans.IsBanned(ip); banned != (ip == "10.0.0.2") {
+			t.Errorf("%s banned: %v", ip, banned)
+		}
+	}
+	if pw.suspect != nil || pw.suspectSources != nil {
+		t.Error("the suspect copy outlived the attribution")
+	}
+	if !contributor.canDownload(pw) {
+		t.Error("the piece is still held back after the attribution")
+	}
+}
+
+// If only the senders of a bad copy have the piece, it must not be held
+// back from them for good.
+func TestSuspectExclusionExpires(t *testing.T) {
+	tor := &Torrent{Config: DefaultConfig(), bans: NewBanList()}
+	pw := &pieceWork{index: 4}
+	tor.handleHashFailure(pw, make([]byte, 2*MaxBlockSize), []string{"10.0.0.1", "10.0.0.2"})
+
+	s := &peerState{ip: "10.0.0.1"}
+	if s.canDownload(pw) {
+		t.Fatal("a sender of the bad copy may fetch the piece again")
+	}
+	pw.suspectUntil = time.Now().Add(-time.Second)
+	if !s.canDownload(pw) {
+		t.Error("the exclusion did not expire")
+	}
+
+	// Fetched alone and bad again, the piece now points at that peer.
+	tor.handleHashFailure(pw, make([]byte, 2*MaxBlockSize), []string{"10.0.0.1", "10.0.0.1"})
+	if !tor.bans.IsBanned("10.0.0.1") {
+		t.Error("a peer that sent a whole bad piece on its own was not banned")
+	}
+}
+
+func TestBanExpiry(t *testing.T) {
+	b := NewBanList()
+	b.Ban("10.0.0.1", "bad data", time.Hour)
+	b.Ban("10.0.0.2", "bad data", -time.Second)
+
+	if !b.IsBanned("10.0.0.1") {
+		t.Error("active ban not reported")
+	}
+	if b.IsBanned("10.0.0.2") {
+		t.Error("expired ban still in force")
+	}
+	if list := b.List(); len(list) != 1 || list[0].IP != "10.0.0.1" {
+		t.Errorf("List = %v", list)
+	}
+
+	if !b.Unban("10.0.0.1") || b.IsBanned("10.0.0.1") {
+		t.Error("Unban did not lift the ban")
+	}
+	if b.Unban("10.0.0.1") {
+		t.Error("Unban reported a ban that was already gone")
+	}
+}
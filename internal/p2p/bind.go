@@ -0,0 +1,132 @@
+package p2p
+
+import (
+	"fmt"
+	"time"
+)
+
+func (t *Torrent) Pause() {
+	t.paused.Store(true)
+}
+
+// Resume also clears an error state, so the torrent retries whatever
+// failed.
+func (t *Torrent) Resume() {
+	t.errMu.Lock()
+	t.err = nil
+	t.errMu.Unlock()
+	t.paused.Store(false)
+}
+
+// Paused torrents keep their state but drop every peer and make no new
+// connections. A torrent in an error state, or held by the kill switch,
+// counts as paused.
+func (t *Torrent) Paused() bool {
+	return t.paused.Load() || t.killed.Load() || t.Err() != nil
+}
+
+// halt stops the torrent for good: peers are dropped and none are dialled
+// or accepted any more.
+func (t *Torrent) halt() {
+	t.stopOnce.Do(func() { close(t.stop) })
+}
+
+func (t *Torrent) stopped() bool {
+	select {
+	case <-t.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// Err is the problem that stopped the torrent, such as a full disk.
+func (t *Torrent) Err() error {
+	t.errMu.Lock()
+	defer t.errMu.Unlock()
+	return t.err
+}
+
+func (t *Torrent) setError(err error) {
+	fmt.Printf("Torrent %s stopped: %v\n", t.Name, err)
+	t.errMu.Lock()
+	t.err = err
+	t.errMu.Unlock()
+}
+
+// watchBinding is the kill switch for Config.Bind: when the interface or
+// address goes away all torrents are paused, so nothing falls back to
+// another route, and they resume once it is back. Torrents the user paused
+// stay paused. It runs until the manager is closed.
+func (m *Manager) watchBinding() {
+	for {
+		m.checkBinding()
+
+		interval := m.config().BindCheckInterval
+		if interval <= 0 {
+			interval = 2 * time.Second
+		}
+		select {
+		case <-m.stop:
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+func (m *Manager) checkBinding() {
+	bind := m.config().Bind
+	if !bind.Enabled() {
+		return
+	}
+	_, err := bind.LocalIP()
+
+	m.mu.Lock()
+	lost := m.bindLost
+	m.bindLost = err != nil
+	m.mu.Unlock()
+
+	switch {
+	case err != nil && !lost:
+		fmt.Printf("Kill switch: %v, pausing all torrents\n", err)
+		m.setKilled(true)
+	case err == nil && lost:
+		fmt.Println("Kill switch: bound interface is back, resuming torrents")
+		m.relisten()
+		m.setKilled(false)
+	}
+}
+
+func (m *Manager) setKilled(killed bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	for _, t := range m.Torrents {
+		t.killed.Store(killed)
+	}
+}
+
+// relisten rebinds the listener, whose address may have changed while the
+// interface was down.
+func (m *Manager) relisten() {
+	m.mu.Lock()
+	addr := m.listenAddr
+	ln, us := m.listener, m.utp
+	m.listener, m.utp = nil, nil
+	for _, t := range m.Torrents {
+		t.utp.Store(nil)
+	}
+	m.mu.Unlock()
+
+	if addr == "" {
+		return
+	}
+	if ln != nil {
+		ln.Close()
+	}
+	if us != nil {
+		us.Close()
+	}
+	if err := m.Listen(addr); err != nil {
+		fmt.Printf("Kill switch: could not listen on %s again: %v\n", addr, err)
+	}
+}
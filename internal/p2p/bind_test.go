@@ -0,0 +1,59 @@
+package p2p
+
+import (
+	"testing"
+	"time"
+)
+
+func TestKillSwitchKeepsUserPause(t *testing.T) {
+	m := NewManager([20]byte{})
+	user, other := &Torrent{}, &Torrent{}
+	m.Torrents["a"], m.Torrents["b"] = user, other
+	user.Pause()
+
+	m.setKilled(true)
+	if !user.Paused() || !other.Paused() {
+		t.Fatal("kill switch did not pause every torrent")
+	}
+	other.Resume()
+	if !other.Paused() {
+		t.Error("Resume lifted the kill switch")
+	}
+
+	m.setKilled(false)
+	if !user.Paused() {
+		t.Error("torrent paused by the user was resumed")
+	}
+	if other.Paused() {
+		t.Error("torrent paused by the kill switch stayed paused")
+	}
+}
+
+func TestKillSwitchRunsUntilClose(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.ResumeDir = ""
+	cfg.Bind.Interface = "no-such-interface"
+	cfg.BindCheckInterval = time.Hour
+	data := make([]byte, MaxBlockSize)
+	tor := newFileTorrent(t, t.TempDir(), testMeta("bound", data, MaxBlockSize, nil), cfg)
+	m := &Manager{
+		Torrents: map[string]*Torrent{"bound": tor},
+		Config:   cfg,
+		stop:     make(chan struct{}),
+	}
+
+	done := make(chan struct{})
+	go func() {
+		m.watchBinding()
+		close(done)
+	}()
+	// The first check must not wait out the interval.
+	waitFor(t, "the kill switch", time.Second, tor.Paused)
+
+	m.Close()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("the kill switch kept running after Close")
+	}
+}
@@ -0,0 +1,133 @@
+package p2p
+
+import (
+	"time"
+	"torrent-client/internal/mse"
+	"torrent-client/internal/netbind"
+	"torrent-client/internal/proxy"
+	"torrent-client/internal/storage"
+)
+
+type Config struct {
+	KeepAliveInterval time.Duration
+	IdleTimeout       time.Duration
+	SnubTimeout       time.Duration
+	BanDuration       time.Duration
+
+	MaxConnections           int
+	MaxConnectionsPerTorrent int
+	MaxHalfOpen              int
+	RetryBackoff             time.Duration
+	MaxRetryBackoff          time.Duration
+
+	AllowedFastCount int
+
+	ListenAddr string
+	Encryption mse.Policy
+	EnableUTP  bool
+
+	IPFilterPath string
+
+	// DownloadDir is where torrents are saved unless AddOptions.SavePath
+	// says otherwise.
+	DownloadDir string
+	Allocation  storage.Allocation
+
+	// IncompleteDir, if set, holds torrents while they download; they move
+	// to their save path once finished. IncompleteSuffix, such as ".part",
+	// is added to the name of every file until all of its pieces are in.
+	IncompleteDir    string
+	IncompleteSuffix string
+
+	// CompletedDir is where finished torrents are moved, if set. It takes
+	// precedence over the save path. They keep seeding from there.
+	CompletedDir string
+
+	// DiskCacheSize bounds each torrent's write-back and read cache in
+	// bytes. Zero writes pieces straight to storage.
+	DiskCacheSize int
+
+	// ResumeDir holds fast-resume files, rewritten every ResumeInterval and
+	// on Close. Empty turns fast-resume off.
+	ResumeDir      string
+	ResumeInterval time.Duration
+
+	// VerifyWorkers hash pieces in parallel, one per CPU when zero.
+	// VerifyRate caps their disk reads in bytes per second; zero is
+	// unlimited.
+	VerifyWorkers int
+	VerifyRate    int64
+
+	// StreamWindow is how many pieces ahead of a streaming reader are
+	// fetched before anything else.
+	StreamWindow int
+	// StreamDeadline is how long one peer gets for a piece a stream is
+	// about to read before it is also requested from another. Zero waits
+	// for the first peer.
+	StreamDeadline time.Duration
+
+	// Proxy carries tracker and peer traffic. While one is set, peers are
+	// only dialled over TCP through it; Proxy.Only also turns off the
+	// listener so nothing reaches us directly.
+	Proxy proxy.Config
+
+	// Bind pins peer, tracker and listener sockets to one interface or
+	// address. If it disappears every torrent is paused until it returns.
+	Bind              netbind.Binding
+	BindCheckInterval time.Duration
+}
+
+func DefaultConfig() Config {
+	return Config{
+		KeepAliveInterval: 2 * time.Minute,
+		IdleTimeout:       3 * time.Minute,
+		SnubTimeout:       60 * time.Second,
+		BanDuration:       time.Hour,
+
+		MaxConnections:           200,
+		MaxConnectionsPerTorrent: 50,
+		MaxHalfOpen:              8,
+		RetryBackoff:             30 * time.Second,
+		MaxRetryBackoff:          30 * time.Minute,
+
+		AllowedFastCount: 10,
+
+		ListenAddr: ":6881",
+		Encryption: mse.PolicyPrefer,
+		EnableUTP:  true,
+
+		DownloadDir:    ".",
+		ResumeDir:      ".resume",
+		ResumeInterval: 30 * time.Second,
+		Allocation:     storage.AllocateSparse,
+		DiskCacheSize:  32 << 20,
+		StreamWindow:   16,
+		StreamDeadline: 5 * time.Second,
+
+		BindCheckInterval: 2 * time.Second,
+	}
+}
+
+// SetConfig replaces the Manager's configuration. Torrents already added
+// keep the one they were started with.
+func (m *Manager) SetConfig(c Config) {
+	m.mu.Lock()
+	m.Config = c
+	m.mu.Unlock()
+}
+
+// config is a copy of the configuration that is safe to read while
+// SetConfig runs.
+func (m *Manager) config() Config {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.Config
+}
+
+// network is how outgoing connections reach the internet: through the
+// proxy, if any, from the bound address.
+func (c Config) network() proxy.Config {
+	px := c.Proxy
+	px.Bind = c.Bind
+	return px
+}
@@ -0,0 +1,70 @@
+package p2p
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+	"torrent-client/internal/storage"
+)
+
+// prepareStorage makes sure the torrent fits on disk and then allocates
+// its files as Config.Allocation asks. Backends that cannot allocate are
+// left alone.
+func (t *Torrent) prepareStorage() error {
+	alloc, ok := t.store.(storage.Allocator)
+	if !ok {
+		return nil
+	}
+
+	needed, err := alloc.Needed()
+	if err != nil {
+		return err
+	}
+	if free, err := storage.FreeSpace(filepath.Dir(t.SavePath())); err == nil && needed > free {
+		return fmt.Errorf("%w: need %d more bytes, %d free", storage.ErrNoSpace, needed, free)
+	}
+	if err := alloc.Allocate(t.Config.Allocation); err != nil {
+		return fmt.Errorf("allocating files: %w", err)
+	}
+	return nil
+}
+
+// diskFailed puts the torrent in an error state when a piece could not be
+// saved and queues the piece again.
+func (t *Torrent) diskFailed(index int, err error) {
+	if errors.Is(err, syscall.ENOSPC) {
+		err = fmt.Errorf("%w: %v", storage.ErrNoSpace, err)
+	}
+	t.setError(fmt.Errorf("saving piece %d: %w", index, err))
+
+	t.haveMu.Lock()
+	lost := t.have.HasPiece(index)
+	t.have.ClearPiece(index)
+	t.haveMu.Unlock()
+	if lost {
+		t.BytesDownloaded.Add(-int64(t.calculatePieceSize(index)))
+		t.queuePiece(t.newPieceWork(index))
+	}
+}
+
+// markComplete tells the storage about a piece found complete on disk
+// rather than written by us.
+func (t *Torrent) markComplete(index int) {
+	if err := t.store.MarkComplete(index); err != nil {
+		fmt.Printf("Could not finish piece %d of %s: %v\n", index, t.Name, err)
+	}
+}
+
+func pathExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+func errString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
@@ -0,0 +1,297 @@
+package p2p
+
+import (
+	"container/list"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+	"torrent-client/internal/storage"
+)
+
+const (
+	diskFlushInterval = 2 * time.Second
+	// maxCoalesce bounds a single write made of adjacent pieces.
+	maxCoalesce = 8 << 20
+)
+
+// CacheStats describes a torrent's disk cache.
+type CacheStats struct {
+	Hits   int64 `json:"hits"`
+	Misses int64 `json:"misses"`
+	Dirty  int   `json:"dirty"`
+	Cached int   `json:"cached"`
+}
+
+type cachedPiece struct {
+	index int
+	data  []byte
+}
+
+// diskIO sits between a torrent and its storage. Verified pieces wait in a
+// bounded write-back cache for a background writer, which merges runs of
+// adjacent pieces into single writes, so a slow disk only holds up the
+// download once the cache is full. Pieces read for peers are kept in the
+// same budget, least recently used first out.
+type diskIO struct {
+	store       storage.Storage
+	pieceLength int64
+	length      int64
+	limit       int
+	onError     func(index int, err error)
+
+	mu         sync.Mutex
+	space      *sync.Cond
+	dirty      map[int][]byte
+	dirtyBytes int
+	clean      map[int]*list.Element
+	lru        *list.List
+	cleanBytes int
+
+	// flushMu lets one flush run at a time, so Flush returning means
+	// everything dirty when it was called is on disk.
+	flushMu sync.Mutex
+	kick    chan struct{}
+	closed  chan struct{}
+	stopped chan struct{}
+
+	hits   atomic.Int64
+	misses atomic.Int64
+}
+
+// newDiskIO caches up to limit bytes; with no limit every write goes
+// straight to storage. onError hears about pieces that could not be
+// written.
+func newDiskIO(store storage.Storage, pieceLength, length int64, limit int, onError func(int, error)) *diskIO {
+	d := &diskIO{
+		store:       store,
+		pieceLength: pieceLength,
+		length:      length,
+		limit:       limit,
+		onError:     onError,
+		dirty:       make(map[int][]byte),
+		clean:       make(map[int]*list.Element),
+		lru:         list.New(),
+		kick:        make(chan struct{}, 1),
+		closed:      make(chan struct{}),
+		stopped:     make(chan struct{}),
+	}
+	d.space = sync.NewCond(&d.mu)
+	go d.writeLoop()
+	return d
+}
+
+// WritePiece queues a verified piece, waiting while the cache is full.
+func (d *diskIO) WritePiece(index int, data []byte) {
+	if d.limit <= 0 || d.isClosed() {
+		d.writeRun([]int{index}, [][]byte{data})
+		return
+	}
+
+	d.mu.Lock()
+	for d.dirtyBytes > 0 && d.dirtyBytes+len(data) > d.limit {
+		d.wake()
+		d.space.Wait()
+	}
+	if old, ok := d.dirty[index]; ok {
+		d.dirtyBytes -= len(old)
+	}
+	d.dropClean(index)
+	d.dirty[index] = data
+	d.dirtyBytes += len(data)
+	d.trim()
+	full := d.dirtyBytes >= d.limit/2
+	d.mu.Unlock()
+
+	if full {
+		d.wake()
+	}
+}
+
+// ReadAt reads within one piece, from the cache when possible. A miss
+// loads and caches the whole piece.
+func (d *diskIO) ReadAt(p []byte, off int64) (int, error) {
+	index := int(off / d.pieceLength)
+	begin := int(off % d.pieceLength)
+
+	d.mu.Lock()
+	if data, ok := d.dirty[index]; ok {
+		n := copy(p, data[begin:])
+		d.mu.Unlock()
+		d.hits.Add(1)
+		return n, nil
+	}
+	if el, ok := d.clean[index]; ok {
+		d.lru.MoveToFront(el)
+		n := copy(p, el.Value.(*cachedPiece).data[begin:])
+		d.mu.Unlock()
+		d.hits.Add(1)
+		return n, nil
+	}
+	d.mu.Unlock()
+	d.misses.Add(1)
+
+	if d.limit <= 0 {
+		return d.store.ReadAt(p, off)
+	}
+	start := int64(index) * d.pieceLength
+	data := make([]byte, min(d.pieceLength, d.length-start))
+	if _, err := d.store.ReadAt(data, start); err != nil {
+		return 0, err
+	}
+	d.mu.Lock()
+	if _, ok := d.dirty[index]; !ok {
+		d.addClean(index, data)
+	}
+	d.mu.Unlock()
+	return copy(p, data[begin:]), nil
+}
+
+// Flush writes every dirty piece before returning.
+func (d *diskIO) Flush() {
+	d.flush()
+}
+
+func (d *diskIO) Close() {
+	if d.isClosed() {
+		return
+	}
+	close(d.closed)
+	<-d.stopped
+	d.flush()
+}
+
+func (d *diskIO) isClosed() bool {
+	select {
+	case <-d.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+func (d *diskIO) Stats() CacheStats {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return CacheStats{
+		Hits:   d.hits.Load(),
+		Misses: d.misses.Load(),
+		Dirty:  d.dirtyBytes,
+		Cached: d.cleanBytes,
+	}
+}
+
+func (d *diskIO) wake() {
+	select {
+	case d.kick <- struct{}{}:
+	default:
+	}
+}
+
+func (d *diskIO) writeLoop() {
+	defer close(d.stopped)
+	ticker := time.NewTicker(diskFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-d.kick:
+		case <-ticker.C:
+		case <-d.closed:
+			return
+		}
+		d.flush()
+	}
+}
+
+// flush writes the dirty pieces in index order, one write per run of
+// adjacent pieces. They stay readable from the cache until written and
+// then move to the read cache.
+func (d *diskIO) flush() {
+	d.flushMu.Lock()
+	defer d.flushMu.Unlock()
+
+	d.mu.Lock()
+	indexes := make([]int, 0, len(d.dirty))
+	for index := range d.dirty {
+		indexes = append(indexes, index)
+	}
+	slices.Sort(indexes)
+	pieces := make([][]byte, len(indexes))
+	for i, index := range indexes {
+		pieces[i] = d.dirty[index]
+	}
+	d.mu.Unlock()
+
+	for start := 0; start < len(indexes); {
+		end, size := start+1, len(pieces[start])
+		for end < len(indexes) && indexes[end] == indexes[end-1]+1 && size+len(pieces[end]) <= maxCoalesce {
+			size += len(pieces[end])
+			end++
+		}
+		written := d.writeRun(indexes[start:end], pieces[start:end])
+
+		d.mu.Lock()
+		for i := start; i < end; i++ {
+			// A piece written again meanwhile stays dirty.
+			if data, ok := d.dirty[indexes[i]]; ok && &data[0] == &pieces[i][0] {
+				delete(d.dirty, indexes[i])
+				d.dirtyBytes -= len(data)
+				if written {
+					d.addClean(indexes[i], data)
+				}
+			}
+		}
+		d.space.Broadcast()
+		d.mu.Unlock()
+		start = end
+	}
+}
+
+// writeRun writes adjacent pieces in one go and reports whether they all
+// made it to storage.
+func (d *diskIO) writeRun(indexes []int, pieces [][]byte) bool {
+	buf := pieces[0]
+	if len(pieces) > 1 {
+		buf = slices.Concat(pieces...)
+	}
+	if _, err := d.store.WriteAt(buf, int64(indexes[0])*d.pieceLength); err != nil {
+		for _, index := range indexes {
+			d.onError(index, err)
+		}
+		return false
+	}
+	ok := true
+	for _, index := range indexes {
+		if err := d.store.MarkComplete(index); err != nil {
+			d.onError(index, err)
+			ok = false
+		}
+	}
+	return ok
+}
+
+// addClean and the helpers below expect d.mu held.
+func (d *diskIO) addClean(index int, data []byte) {
+	if d.limit <= 0 {
+		return
+	}
+	d.dropClean(index)
+	d.clean[index] = d.lru.PushFront(&cachedPiece{index, data})
+	d.cleanBytes += len(data)
+	d.trim()
+}
+
+func (d *diskIO) dropClean(index int) {
+	if el, ok := d.clean[index]; ok {
+		d.lru.Remove(el)
+		delete(d.clean, index)
+		d.cleanBytes -= len(el.Value.(*cachedPiece).data)
+	}
+}
+
+// trim evicts clean pieces until dirty and clean fit the limit together.
+func (d *diskIO) trim() {
+	for d.dirtyBytes+d.cleanBytes > d.limit && d.lru.Len() > 0 {
+		d.dropClean(d.lru.Back().Value.(*cachedPiece).index)
+	}
+}
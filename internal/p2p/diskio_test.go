@@ -0,0 +1,150 @@
+package p2p
+
+import (
+	"bytes"
+	"errors"
+	"slices"
+	"sync"
+	"testing"
+
+	"torrent-client/internal/storage"
+)
+
+// recordingStore keeps the torrent in memory and logs every write.
+type recordingStore struct {
+	mu       sync.Mutex
+	data     []byte
+	writes   [][2]int64 // offset, length
+	reads    int
+	complete []int
+	fail     error
+}
+
+func (s *recordingStore) ReadAt(p []byte, off int64) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.reads++
+	return copy(p, s.data[off:]), nil
+}
+
+func (s *recordingStore) WriteAt(p []byte, off int64) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.fail != nil {
+		return 0, s.fail
+	}
+	s.writes = append(s.writes, [2]int64{off, int64(len(p))})
+	return copy(s.data[off:], p), nil
+}
+
+func (s *recordingStore) MarkComplete(piece int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.complete = append(s.complete, piece)
+	return nil
+}
+
+func (s *recordingStore) Close() error { return nil }
+
+var _ storage.Storage = (*recordingStore)(nil)
+
+func piece(index, length int) []byte {
+	return bytes.Repeat([]byte{byte('a' + index)}, length)
+}
+
+func TestDiskCacheCoalescesAdjacentPieces(t *testing.T) {
+	const pl = 1024
+	store := &recordingStore{data: make([]byte, 8*pl)}
+	d := newDiskIO(store, pl, 8*pl, 64*pl, func(int, error) { t.Error("write failed") })
+	defer d.Close()
+
+	for _, index := range []int{2, 0, 1, 5, 6} {
+		d.WritePiece(index, piece(index, pl))
+	}
+	d.Flush()
+
+	want := [][2]int64{{0, 3 * pl}, {5 * pl, 2 * pl}}
+	if !slices.Equal(store.writes, want) {
+		t.Errorf("writes %v, want %v", store.writes, want)
+	}
+	slices.Sort(store.complete)
+	if !slices.Equal(store.complete, []int{0, 1, 2, 5, 6}) {
+		t.Errorf("completed %v", store.complete)
+	}
+	for _, index := range []int{0, 1, 2, 5, 6} {
+		if !bytes.Equal(store.data[index*pl:(index+1)*pl], piece(index, pl)) {
+			t.Errorf("piece %d was not stored", index)
+		}
+	}
+	if s := d.Stats(); s.Dirty != 0 || s.Cached != 5*pl {
+		t.Errorf("stats %+v after flush", s)
+	}
+}
+
+func TestDiskCacheServesReads(t *testing.T) {
+	const pl = 1024
+	store := &recordingStore{data: make([]byte, 4*pl)}
+	copy(store.data[3*pl:], piece(3, pl))
+	// Room for two pieces.
+	d := newDiskIO(store, pl, 4*pl, 2*pl, func(int, error) {})
+	defer d.Close()
+
+	d.WritePiece(0, piece(0, pl))
+	buf := make([]byte, 10)
+	if _, err := d.ReadAt(buf, 100); err != nil || !bytes.Equal(buf, piece(0, 10)) {
+		t.Fatalf("dirty read %q, %v", buf, err)
+	}
+	if store.reads != 0 {
+		t.Error("a dirty piece was read from storage")
+	}
+
+	d.ReadAt(buf, 3*pl)
+	d.ReadAt(buf, 3*pl+20)
+	if store.reads != 1 {
+		t.Errorf("%d storage reads for one piece", store.reads)
+	}
+	if s := d.Stats(); s.Hits != 2 || s.Misses != 1 {
+		t.Errorf("stats %+v", s)
+	}
+
+	// Flushing moves piece 0 to the read cache; a third piece pushes out
+	// the least recently used one, piece 3 after the read below.
+	d.Flush()
+	d.ReadAt(buf, 0)
+	d.WritePiece(1, piece(1, pl))
+	if s := d.Stats(); s.Dirty+s.Cached > 2*pl {
+		t.Errorf("cache holds %d bytes over its %d limit", s.Dirty+s.Cached, 2*pl)
+	}
+	reads := store.reads
+	d.ReadAt(buf, 0)
+	if store.reads != reads {
+		t.Error("the most recently used piece was evicted")
+	}
+}
+
+func TestDiskCacheReportsFailedWrites(t *testing.T) {
+	const pl = 1024
+	store := &recordingStore{data: make([]byte, 4*pl), fail: errors.New("disk full")}
+	var mu sync.Mutex
+	var failed []int
+	d := newDiskIO(store, pl, 4*pl, 8*pl, func(index int, err error) {
+		mu.Lock()
+		failed = append(failed, index)
+		mu.Unlock()
+	})
+	defer d.Close()
+
+	d.WritePiece(1, piece(1, pl))
+	d.WritePiece(2, piece(2, pl))
+	d.Flush()
+
+	mu.Lock()
+	defer mu.Unlock()
+	slices.Sort(failed)
+	if !slices.Equal(failed, []int{1, 2}) {
+		t.Errorf("failures reported for %v, want [1 2]", failed)
+	}
+	if s := d.Stats(); s.Dirty != 0 || s.Cached != 0 {
+		t.Errorf("failed pieces left in the cache: %+v", s)
+	}
+}
@@ -0,0 +1,101 @@
+package p2p
+
+import (
+	"net"
+	"torrent-client/internal/peer"
+)
+
+func (t *Torrent) markHave(index int) {
+	t.haveMu.Lock()
+	defer t.haveMu.Unlock()
+	t.have.SetPiece(index)
+	t.wakeHave()
+}
+
+// wakeHave releases streams waiting for a piece; call with haveMu held.
+func (t *Torrent) wakeHave() {
+	if t.haveWake != nil {
+		close(t.haveWake)
+		t.haveWake = nil
+	}
+}
+
+func (t *Torrent) hasPiece(index int) bool {
+	t.haveMu.Lock()
+	defer t.haveMu.Unlock()
+	return t.have.HasPiece(index)
+}
+
+func (t *Torrent) haveCount() int {
+	t.haveMu.Lock()
+	defer t.haveMu.Unlock()
+	return t.have.Count()
+}
+
+func (t *Torrent) haveSnapshot() peer.Bitfield {
+	t.haveMu.Lock()
+	defer t.haveMu.Unlock()
+	return append(peer.Bitfield(nil), t.have...)
+}
+
+// sendInitialState announces what we have right after the handshake. Fast
+// peers must get exactly one of have_all, have_none or bitfield, followed by
+// their allowed-fast set.
+func (t *Torrent) sendInitialState(s *peerState) error {
+	have := t.haveSnapshot()
+	count := have.Count()
+
+	if !s.fast {
+		if count == 0 {
+			return nil
+		}
+		return s.session.SendBitfield(have)
+	}
+
+	var err error
+	switch count {
+	case 0:
+		err = s.session.SendHaveNone()
+	case len(t.PieceHashes):
+		err = s.session.SendHaveAll()
+	default:
+		err = s.session.SendBitfield(have)
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, index := range peer.AllowedFastSet(net.ParseIP(s.ip), t.InfoHash, len(t.PieceHashes), t.Config.AllowedFastCount) {
+		s.allowedToPeer[index] = true
+		if err := s.session.SendAllowedFast(index); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// serveRequest answers a block request. Unchoked peers get any piece we
+// have; while we choke a peer only its allowed-fast pieces are served. Fast
+// peers get an explicit reject for everything refused, others are ignored
+// as the base protocol expects.
+func (t *Torrent) serveRequest(s *peerState, ev peer.Event) {
+	allowed := !s.amChoking || (s.fast && s.allowedToPeer[ev.Index])
+	if !allowed || !t.hasPiece(ev.Index) || ev.Length > MaxBlockSize || ev.Begin+ev.Length > t.calculatePieceSize(ev.Index) {
+		if s.fast {
+			s.session.SendReject(ev.Index, ev.Begin, ev.Length)
+		}
+		return
+	}
+
+	data := make([]byte, ev.Length)
+	if _, err := t.disk.ReadAt(data, int64(ev.Index)*int64(t.PieceLength)+int64(ev.Begin)); err != nil {
+		if s.fast {
+			s.session.SendReject(ev.Index, ev.Begin, ev.Length)
+		}
+		return
+	}
+	if s.session.SendPiece(ev.Index, ev.Begin, data) == nil {
+		t.uploaded.Add(int64(len(data)))
+		t.updatePeer(s.addr, func(p *PeerStats) { p.Uploaded += len(data) })
+	}
+}
@@ -0,0 +1,32 @@
+package p2p
+
+import "fmt"
+
+// LoadIPFilter replaces the Manager's IP filter with the ranges in path and
+// drops connected peers that are now blocked on their next tick.
+func (m *Manager) LoadIPFilter(path string) error {
+	if err := m.Filter.LoadFile(path); err != nil {
+		return err
+	}
+	fmt.Printf("IP filter loaded from %s: %d ranges\n", path, m.Filter.Len())
+	return nil
+}
+
+// blocked reports whether we refuse to talk to addr, because it is either
+// banned or inside a filtered range.
+func (t *Torrent) blocked(addr string) bool {
+	return t.bans.IsBanned(peerIP(addr)) || t.filter.Blocked(addr)
+}
+
+// addPeers hands newly learned peers to the connection pool. Every source
+// of peer addresses should go through here so the IP filter applies to
+// all of them; incoming connections are checked by the listener.
+func (t *Torrent) addPeers(addrs ...string) {
+	allowed := addrs[:0:0]
+	for _, addr := range addrs {
+		if !t.filter.Blocked(addr) {
+			allowed = append(allowed, addr)
+		}
+	}
+	t.candidates.Add(allowed...)
+}
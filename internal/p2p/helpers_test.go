@@ -0,0 +1,83 @@
+package p2p
+
+import (
+	"crypto/sha1"
+	"path/filepath"
+	"testing"
+
+	"torrent-client/internal/ipfilter"
+	"torrent-client/internal/metainfo"
+	"torrent-client/internal/peer"
+	"torrent-client/internal/storage"
+)
+
+// testMeta describes data split into pieces of pieceLength, as a single
+// file unless files are given.
+func testMeta(name string, data []byte, pieceLength int, files []metainfo.File) *metainfo.TorrentMeta {
+	meta := &metainfo.TorrentMeta{
+		Name:        name,
+		PieceLength: int64(pieceLength),
+		Length:      int64(len(data)),
+		Files:       files,
+	}
+	meta.InfoHash = sha1.Sum([]byte(name))
+	for off := 0; off < len(data); off += pieceLength {
+		sum := sha1.Sum(data[off:min(off+pieceLength, len(data))])
+		meta.Pieces = append(meta.Pieces, sum[:])
+	}
+	return meta
+}
+
+// newTestTorrent sets up a torrent over store the way AddTorrent does,
+// without contacting a tracker or starting the download.
+func newTestTorrent(t *testing.T, meta *metainfo.TorrentMeta, store storage.Storage, cfg Config) *Torrent {
+	t.Helper()
+	tor := &Torrent{
+		InfoHash:    meta.InfoHash,
+		PieceLength: int(meta.PieceLength),
+		Length:      int(meta.Length),
+		Name:        meta.Name,
+		Files:       meta.Files,
+		Config:      cfg,
+		bans:        NewBanList(),
+		filter:      ipfilter.New(),
+		candidates:  newCandidateList(),
+		picker:      newPiecePicker(),
+		results:     make(chan *pieceResult),
+		rechecked:   make(chan struct{}, 1),
+		stop:        make(chan struct{}),
+		store:       store,
+	}
+	for _, h := range meta.Pieces {
+		tor.PieceHashes = append(tor.PieceHashes, [20]byte(h))
+	}
+	if fb, ok := store.(storage.FileBacked); ok && len(fb.Paths()) > 0 {
+		tor.savePath = fb.Paths()[0]
+		if len(meta.Files) > 0 {
+			tor.savePath = filepath.Dir(tor.savePath)
+		}
+	}
+	tor.picker.order = tor.pieceOrder
+	if err := tor.setPriorities(nil); err != nil {
+		t.Fatal(err)
+	}
+	tor.have = peer.NewBitfield(len(tor.PieceHashes))
+	tor.disk = newDiskIO(store, meta.PieceLength, meta.Length, cfg.DiskCacheSize, tor.diskFailed)
+	t.Cleanup(func() {
+		tor.halt()
+		tor.picker.Close()
+		tor.disk.Close()
+		store.Close()
+	})
+	return tor
+}
+
+// newFileTorrent is newTestTorrent over files below dir.
+func newFileTorrent(t *testing.T, dir string, meta *metainfo.TorrentMeta, cfg Config) *Torrent {
+	t.Helper()
+	store, err := storage.NewFile(dir, meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return newTestTorrent(t, meta, store, cfg)
+}
@@ -0,0 +1,76 @@
+package p2p
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// retryAfterError is a server asking us to come back later rather than a
+// failure.
+type retryAfterError struct {
+	wait time.Duration
+}
+
+func (e *retryAfterError) Error() string {
+	return fmt.Sprintf("server busy, retry after %s", e.wait)
+}
+
+func (t *Torrent) httpSeedLoop(base string) {
+	t.seedLoop(base, "HTTP seed", t.fetchHTTPSeedPiece)
+}
+
+// fetchHTTPSeedPiece asks a BEP 17 seed for a whole piece by index. A 503
+// carries the number of seconds to wait in its body.
+func (t *Torrent) fetchHTTPSeedPiece(client *http.Client, base string, pw *pieceWork) ([]byte, error) {
+	sep := "?"
+	if strings.Contains(base, "?") {
+		sep = "&"
+	}
+	var hash strings.Builder
+	for _, b := range t.InfoHash {
+		fmt.Fprintf(&hash, "%%%02X", b)
+	}
+	u := fmt.Sprintf("%s%sinfo_hash=%s&piece=%d&ranges=0-%d", base, sep, hash.String(), pw.index, pw.length-1)
+
+	resp, err := client.Get(u)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusServiceUnavailable:
+		return nil, &retryAfterError{wait: retryAfter(resp, t.Config.MaxRetryBackoff)}
+	default:
+		return nil, fmt.Errorf("%s", resp.Status)
+	}
+
+	data := make([]byte, pw.length)
+	if _, err := io.ReadFull(resp.Body, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// retryAfter reads the wait from the body, as BEP 17 specifies, falling
+// back to the Retry-After header and then to a minute.
+func retryAfter(resp *http.Response, limit time.Duration) time.Duration {
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 64))
+	secs, err := strconv.Atoi(strings.TrimSpace(string(body)))
+	if err != nil {
+		secs, err = strconv.Atoi(resp.Header.Get("Retry-After"))
+	}
+	if err != nil || secs <= 0 {
+		return time.Minute
+	}
+	wait := time.Duration(secs) * time.Second
+	if wait > limit {
+		wait = limit
+	}
+	return wait
+}
@@ -0,0 +1,162 @@
+package p2p
+
+import (
+	"bytes"
+	"errors"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func httpSeedTorrent(t *testing.T, cfg Config) (*Torrent, []byte) {
+	t.Helper()
+	data := make([]byte, 10000)
+	rand.New(rand.NewSource(10)).Read(data)
+	return newFileTorrent(t, t.TempDir(), testMeta("seeded.bin", data, 4096, nil), cfg), data
+}
+
+func TestHTTPSeedRequest(t *testing.T) {
+	tor, data := httpSeedTorrent(t, DefaultConfig())
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		if q.Get("token") != "abc" {
+			t.Errorf("query of the base URL lost: %s", r.URL.RawQuery)
+		}
+		if q.Get("info_hash") != string(tor.InfoHash[:]) {
+			t.Errorf("info_hash = %x", q.Get("info_hash"))
+		}
+		index, _ := strconv.Atoi(q.Get("piece"))
+		want := "0-" + strconv.Itoa(tor.calculatePieceSize(index)-1)
+		if q.Get("ranges") != want {
+			t.Errorf("ranges = %q, want %q", q.Get("ranges"), want)
+		}
+		begin := index * tor.PieceLength
+		w.Write(data[begin : begin+tor.calculatePieceSize(index)])
+	}))
+	defer srv.Close()
+
+	// The last piece is short.
+	for _, index := range []int{0, 2} {
+		pw := tor.newPieceWork(index)
+		got, err := tor.fetchHTTPSeedPiece(srv.Client(), srv.URL+"/seed?token=abc", pw)
+		if err != nil {
+			t.Fatal(err)
+		}
+		begin := index * tor.PieceLength
+		if !bytes.Equal(got, data[begin:begin+pw.length]) {
+			t.Fatalf("piece %d: wrong data", index)
+		}
+	}
+}
+
+func TestHTTPSeedBadResponses(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.MaxRetryBackoff = 10 * time.Minute
+	tor, _ := httpSeedTorrent(t, cfg)
+
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		wait    time.Duration // of the retryAfterError, zero for other errors
+	}{
+		{"busy", func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte("30"))
+		}, 30 * time.Second},
+		{"busy with header", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Retry-After", "45")
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}, 45 * time.Second},
+		{"busy for too long", func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte("86400"))
+		}, 10 * time.Minute},
+		{"busy without a wait", func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte("soon"))
+		}, time.Minute},
+		{"not found", func(w http.ResponseWriter, r *http.Request) {
+			http.NotFound(w, r)
+		}, 0},
+		{"short piece", func(w http.ResponseWriter, r *http.Request) {
+			w.Write(make([]byte, 100))
+		}, 0},
+	}
+	for _, tt := range tests {
+		srv := httptest.NewServer(tt.handler)
+		_, err := tor.fetchHTTPSeedPiece(srv.Client(), srv.URL, tor.newPieceWork(0))
+		srv.Close()
+
+		var busy *retryAfterError
+		switch {
+		case err == nil:
+			t.Errorf("%s: no error", tt.name)
+		case tt.wait == 0 && errors.As(err, &busy):
+			t.Errorf("%s: treated as busy", tt.name)
+		case tt.wait != 0 && !errors.As(err, &busy):
+			t.Errorf("%s: got %v, want a retry-after", tt.name, err)
+		case tt.wait != 0 && busy.wait != tt.wait:
+			t.Errorf("%s: wait %s, want %s", tt.name, busy.wait, tt.wait)
+		}
+	}
+}
+
+// A 503 is the server asking for a pause, not a failure: it must neither
+// be retried before the wait nor push up the backoff of later failures.
+func TestHTTPSeedLoopHonoursRetryAfter(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.RetryBackoff = 300 * time.Millisecond
+	tor, data := httpSeedTorrent(t, cfg)
+	tor.picker.Push(tor.newPieceWork(0))
+
+	var mu sync.Mutex
+	var times []time.Time
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		times = append(times, time.Now())
+		n := len(times)
+		mu.Unlock()
+		switch n {
+		case 1:
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte("1"))
+		case 2:
+			http.Error(w, "broken", http.StatusInternalServerError)
+		default:
+			w.Write(data[:4096])
+		}
+	}))
+	defer srv.Close()
+
+	done := make(chan struct{})
+	go func() {
+		tor.httpSeedLoop(srv.URL)
+		close(done)
+	}()
+	select {
+	case res := <-tor.results:
+		if !bytes.Equal(res.data, data[:4096]) {
+			t.Fatal("wrong piece delivered")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("piece never arrived")
+	}
+	tor.picker.Close()
+	<-done
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(times) != 3 {
+		t.Fatalf("%d requests, want 3", len(times))
+	}
+	if gap := times[1].Sub(times[0]); gap < time.Second {
+		t.Errorf("asked again %s after a 503 saying 1s", gap)
+	}
+	if gap := times[2].Sub(times[1]); gap < cfg.RetryBackoff || gap >= 2*cfg.RetryBackoff {
+		t.Errorf("retried %s after the first failure, want the base backoff of %s", gap, cfg.RetryBackoff)
+	}
+}
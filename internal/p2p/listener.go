@@ -0,0 +1,240 @@
+package p2p
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+	"torrent-client/internal/mse"
+	"torrent-client/internal/peer"
+	"torrent-client/internal/tracker"
+	"torrent-client/internal/utp"
+)
+
+// Listen accepts incoming peer connections on addr for every torrent the
+// Manager knows, plaintext or MSE-encrypted depending on Config.Encryption.
+// With uTP enabled the same port is bound on UDP, and that socket is also
+// used for outgoing uTP connections.
+func (m *Manager) Listen(addr string) error {
+	cfg := m.config()
+	if cfg.Proxy.Only {
+		return errors.New("incoming connections are disabled in proxy-only mode")
+	}
+	// Remembered even on failure so the kill switch can retry once the
+	// bound interface comes up.
+	m.mu.Lock()
+	m.listenAddr = addr
+	m.mu.Unlock()
+
+	ln, err := cfg.Bind.Listen(addr)
+	if err != nil {
+		return err
+	}
+
+	var us *utp.Socket
+	if cfg.EnableUTP {
+		pc, err := cfg.Bind.ListenUDP(addr)
+		if err != nil {
+			fmt.Printf("uTP disabled, could not bind %s: %v\n", addr, err)
+		} else {
+			us = utp.NewSocket(pc, true)
+		}
+	}
+
+	m.mu.Lock()
+	m.listener = ln
+	if us != nil {
+		m.utp = us
+		for _, t := range m.Torrents {
+			t.utp.Store(us)
+		}
+	}
+	m.mu.Unlock()
+
+	go m.acceptLoop(ln)
+	if us != nil {
+		go m.acceptLoop(us)
+	}
+	return nil
+}
+
+// listenPort is the port announced to trackers: the one we listen on, or
+// the configured one before Listen has run.
+func (m *Manager) listenPort() uint16 {
+	m.mu.RLock()
+	ln := m.listener
+	addr := m.Config.ListenAddr
+	m.mu.RUnlock()
+	if ln != nil {
+		if addr, ok := ln.Addr().(*net.TCPAddr); ok {
+			return uint16(addr.Port)
+		}
+	}
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return tracker.DefaultPort
+	}
+	n, err := strconv.ParseUint(port, 10, 16)
+	if err != nil || n == 0 {
+		return tracker.DefaultPort
+	}
+	return uint16(n)
+}
+
+func (m *Manager) acceptLoop(ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+		go m.handleIncoming(conn)
+	}
+}
+
+func (m *Manager) handleIncoming(conn net.Conn) {
+	if m.Filter.Blocked(conn.RemoteAddr().String()) {
+		conn.Close()
+		return
+	}
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+
+	hs, conn, err := m.acceptHandshake(conn)
+	if err != nil {
+		conn.Close()
+		return
+	}
+
+	t := m.torrentByHash(hs.InfoHash)
+	if t == nil || t.stopped() {
+		conn.Close()
+		return
+	}
+
+	reply := peer.NewHandshake(t.InfoHash, t.PeerID)
+	if _, err := conn.Write(reply.Serialize()); err != nil {
+		conn.Close()
+		return
+	}
+	conn.SetDeadline(time.Time{})
+
+	t.acceptPeer(conn.RemoteAddr().String(), conn, hs)
+}
+
+// acceptHandshake tells plaintext and encrypted connections apart by their
+// first 20 bytes and reads the BitTorrent handshake from either. The
+// returned conn is the one to keep using, encrypted or not.
+func (m *Manager) acceptHandshake(conn net.Conn) (*peer.Handshake, net.Conn, error) {
+	prefix := make([]byte, 20)
+	if _, err := io.ReadFull(conn, prefix); err != nil {
+		return nil, conn, err
+	}
+	stream := io.MultiReader(bytes.NewReader(prefix), conn)
+
+	policy := m.config().Encryption
+	if mse.IsPlaintextHandshake(prefix) {
+		if policy == mse.PolicyRequire {
+			return nil, conn, fmt.Errorf("plaintext connection refused")
+		}
+		hs, err := peer.Read(stream)
+		return hs, conn, err
+	}
+
+	if policy == mse.PolicyDisabled {
+		return nil, conn, fmt.Errorf("encrypted connection refused")
+	}
+	allowed := mse.CryptoRC4 | mse.CryptoPlaintext
+	if policy == mse.PolicyRequire {
+		allowed = mse.CryptoRC4
+	}
+
+	encrypted, skey, err := mse.Accept(conn, stream, m.infoHashes(), allowed)
+	if err != nil {
+		return nil, conn, err
+	}
+	hs, err := peer.Read(encrypted)
+	if err != nil {
+		return nil, encrypted, err
+	}
+	if hs.InfoHash != skey {
+		return nil, encrypted, fmt.Errorf("handshake info hash does not match MSE key")
+	}
+	return hs, encrypted, nil
+}
+
+func (m *Manager) infoHashes() [][20]byte {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var hashes [][20]byte
+	for _, t := range m.Torrents {
+		hashes = append(hashes, t.InfoHash)
+	}
+	return hashes
+}
+
+func (m *Manager) torrentByHash(infoHash [20]byte) *Torrent {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.Torrents[fmt.Sprintf("%x", infoHash)]
+}
+
+// dial connects over uTP and TCP at once and keeps whichever transport
+// succeeds first; the loser is closed as soon as it connects.
+func (t *Torrent) dial(addr string) (net.Conn, error) {
+	network := t.Config.network()
+	// uTP can neither go through a proxy nor, without the listener's
+	// socket, leave from the bound address.
+	if network.Enabled() || !t.Config.EnableUTP || (t.Config.Bind.Enabled() && t.utp.Load() == nil) {
+		return network.Dial(addr, dialTimeout)
+	}
+
+	type dialResult struct {
+		conn net.Conn
+		err  error
+	}
+	results := make(chan dialResult, 2)
+	go func() {
+		conn, err := t.dialUTP(addr)
+		results <- dialResult{conn, err}
+	}()
+	go func() {
+		conn, err := network.Dial(addr, dialTimeout)
+		results <- dialResult{conn, err}
+	}()
+
+	var firstErr error
+	for pending := 2; pending > 0; pending-- {
+		r := <-results
+		if r.err == nil {
+			go func(remaining int) {
+				for ; remaining > 0; remaining-- {
+					if loser := <-results; loser.err == nil {
+						loser.conn.Close()
+					}
+				}
+			}(pending - 1)
+			return r.conn, nil
+		}
+		if firstErr == nil {
+			firstErr = r.err
+		}
+	}
+	return nil, firstErr
+}
+
+func (t *Torrent) dialUTP(addr string) (net.Conn, error) {
+	us := t.utp.Load()
+	if us == nil {
+		return utp.Dial(addr, dialTimeout)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), dialTimeout)
+	defer cancel()
+	return us.DialContext(ctx, addr)
+}
@@ -0,0 +1,128 @@
+package p2p
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"torrent-client/internal/mse"
+	"torrent-client/internal/peer"
+	"torrent-client/internal/proxy"
+)
+
+// incoming plays a remote peer connecting to m: crypto 0 sends a plaintext
+// handshake, anything else runs MSE offering those methods first. It returns
+// what acceptHandshake made of it.
+func incoming(t *testing.T, m *Manager, infoHash [20]byte, crypto uint32) (*peer.Handshake, error) {
+	t.Helper()
+	local, remote := net.Pipe()
+	t.Cleanup(func() { local.Close(); remote.Close() })
+	deadline := time.Now().Add(5 * time.Second)
+	local.SetDeadline(deadline)
+	remote.SetDeadline(deadline)
+
+	go func() {
+		conn := net.Conn(remote)
+		if crypto != 0 {
+			encrypted, err := mse.Initiate(remote, infoHash, crypto)
+			if err != nil {
+				return
+			}
+			conn = encrypted
+		}
+		conn.Write(peer.NewHandshake(infoHash, [20]byte{'-', 'T', 'T'}).Serialize())
+	}()
+
+	hs, _, err := m.acceptHandshake(local)
+	return hs, err
+}
+
+func TestAcceptHandshakePolicy(t *testing.T) {
+	infoHash := [20]byte{7, 7, 7}
+
+	tests := []struct {
+		policy mse.Policy
+		crypto uint32
+		ok     bool
+	}{
+		{mse.PolicyDisabled, 0, true},
+		{mse.PolicyDisabled, mse.CryptoRC4, false},
+		{mse.PolicyPrefer, 0, true},
+		{mse.PolicyPrefer, mse.CryptoRC4 | mse.CryptoPlaintext, true},
+		{mse.PolicyPrefer, mse.CryptoPlaintext, true},
+		{mse.PolicyRequire, 0, false},
+		{mse.PolicyRequire, mse.CryptoRC4, true},
+		{mse.PolicyRequire, mse.CryptoPlaintext, false},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("policy %d crypto %#x", tt.policy, tt.crypto), func(t *testing.T) {
+			m := &Manager{
+				Config:   Config{Encryption: tt.policy},
+				Torrents: map[string]*Torrent{fmt.Sprintf("%x", infoHash): {InfoHash: infoHash}},
+			}
+
+			hs, err := incoming(t, m, infoHash, tt.crypto)
+			if !tt.ok {
+				if err == nil {
+					t.Fatal("connection accepted against the policy")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if hs.InfoHash != infoHash {
+				t.Fatalf("handshake for %x, want %x", hs.InfoHash, infoHash)
+			}
+		})
+	}
+}
+
+func TestProxyOnlyMode(t *testing.T) {
+	m := NewManager([20]byte{})
+	t.Cleanup(func() { m.Close() })
+	cfg := m.Config
+	cfg.ResumeDir = ""
+	cfg.Proxy = proxy.Config{Type: proxy.SOCKS5, Addr: "127.0.0.1:1", Only: true}
+	m.SetConfig(cfg)
+	if err := m.Listen("127.0.0.1:0"); err == nil {
+		t.Fatal("listening in proxy-only mode")
+	}
+
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+	direct := make(chan struct{}, 1)
+	go func() {
+		if conn, err := target.Accept(); err == nil {
+			conn.Close()
+			direct <- struct{}{}
+		}
+	}()
+
+	// uTP would go straight to the same port on UDP.
+	udp, err := net.ListenPacket("udp", target.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer udp.Close()
+	go func() {
+		if _, _, err := udp.ReadFrom(make([]byte, 1500)); err == nil {
+			direct <- struct{}{}
+		}
+	}()
+
+	tor := &Torrent{Config: cfg}
+	tor.Config.EnableUTP = true
+	if _, err := tor.dial(target.Addr().String()); err == nil {
+		t.Fatal("dial succeeded with the proxy down")
+	}
+	select {
+	case <-direct:
+		t.Fatal("the peer was dialled directly")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
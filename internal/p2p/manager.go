@@ -1,30 +1,86 @@
 package p2p
 
 import (
-	"crypto/sha1"
-	"encoding/binary"
+	"errors"
 	"fmt"
 	"net"
+	"path/filepath"
 	"sync"
+	"sync/atomic"
 	"time"
+	"torrent-client/internal/ipfilter"
 	"torrent-client/internal/metainfo"
+	"torrent-client/internal/mse"
 	"torrent-client/internal/peer"
 	"torrent-client/internal/storage"
 	"torrent-client/internal/tracker"
+	"torrent-client/internal/utp"
 )
 
-const MaxBlockSize = 16384
+const (
+	MaxBlockSize     = 16384
+	dialTimeout      = 5 * time.Second
+	handshakeTimeout = 10 * time.Second
+)
+
+var (
+	errSnubbed  = errors.New("peer snubbed us")
+	errRejected = errors.New("peer rejected our request")
+	errChoked   = errors.New("peer choked us mid-piece")
+	errPaused   = errors.New("torrent paused")
+	errObsolete = errors.New("piece arrived from another peer")
+)
 
 type Manager struct {
 	Torrents map[string]*Torrent
 	mu       sync.RWMutex
 	PeerID   [20]byte
+	Config   Config
+	Bans     *BanList
+	Filter   *ipfilter.Filter
+
+	pool       *connPool
+	listenAddr string
+	listener   net.Listener
+	utp        *utp.Socket
+	bindLost   bool
+
+	stop     chan struct{}
+	stopOnce sync.Once
 }
 
 type peerState struct {
-	conn     net.Conn
-	choked   bool
-	bitfield peer.Bitfield
+	session   *peer.Session
+	addr      string
+	ip        string
+	choked    bool
+	bitfield  peer.Bitfield
+	lastBlock time.Time
+
+	// snubbed is set when the peer sends nothing for Config.SnubTimeout and
+	// only cleared by its next block. The piece it stalled on is kept from
+	// it for another SnubTimeout so other peers get it first.
+	snubbed   bool
+	snubbedOn map[int]time.Time
+
+	// amChoking and amInterested are what we last told the peer,
+	// interested what it last told us.
+	amChoking    bool
+	amInterested bool
+	interested   bool
+
+	// requests we sent that the peer has not answered yet
+	requested map[blockRequest]bool
+
+	// fast extension (BEP 6) state
+	fast          bool
+	allowedFast   map[int]bool
+	suggested     map[int]bool
+	allowedToPeer map[int]bool
+}
+
+type blockRequest struct {
+	index, begin, length int
 }
 
 type Torrent struct {
@@ -35,13 +91,109 @@ type Torrent struct {
 	PieceLength     int
 	Length          int
 	Name            string
-	BytesDownloaded int
+	BytesDownloaded atomic.Int64
+	Config          Config
+
+	Files     []metainfo.File
+	WebSeeds  []string
+	HTTPSeeds []string
+
+	bans       *BanList
+	filter     *ipfilter.Filter
+	picker     *piecePicker
+	pool       *connPool
+	candidates *candidateList
+	utp        atomic.Pointer[utp.Socket]
+	store      storage.Storage
+	disk       *diskIO
+
+	haveMu   sync.Mutex
+	have     peer.Bitfield
+	haveWake chan struct{}
+
+	streamMu   sync.Mutex
+	streams    map[*Reader]int
+	sequential atomic.Bool
+
+	// liveMu also guards the sessions to announce pieces to.
+	liveMu   sync.Mutex
+	live     map[string]*PeerStats
+	sessions map[string]*peer.Session
+
+	stop     chan struct{}
+	stopOnce sync.Once
+
+	paused atomic.Bool
+	// killed is the kill switch's pause, kept apart from the user's so
+	// that lifting it leaves torrents the user paused alone.
+	killed atomic.Bool
+	errMu  sync.Mutex
+	err    error
+
+	prioMu          sync.Mutex
+	priorities      []FilePriority
+	piecePriorities []FilePriority
+
+	recheckMu  sync.Mutex
+	rechecked  chan struct{}
+	checking   atomic.Bool
+	checkDone  atomic.Int64
+	checkTotal atomic.Int64
+
+	moveMu       sync.Mutex
+	moving       atomic.Bool
+	completedDir string
+	// pathMu guards savePath, which a move changes.
+	pathMu   sync.Mutex
+	savePath string
+
+	// lifetime byte counters, carried over in the resume file
+	downloaded atomic.Int64
+	uploaded   atomic.Int64
+	resumeMu   sync.Mutex
+
+	results chan *pieceResult
 }
 
 type pieceWork struct {
-	index  int
-	hash   [20]byte
-	length int
+	index    int
+	hash     [20]byte
+	length   int
+	priority FilePriority
+
+	// suspect holds a copy that failed the hash check and suspectSources the
+	// IP that sent each of its blocks, kept until a clean copy from a single
+	// peer shows which blocks were bad. Until suspectUntil only peers
+	// outside suspectSources may fetch the piece.
+	suspect        []byte
+	suspectSources []string
+	suspectUntil   time.Time
+
+	// blocks marks the blocks of partial that arrived before an earlier
+	// attempt failed, and blockSources who sent them.
+	blocks       []bool
+	partial      []byte
+	blockSources []string
+}
+
+func (pw *pieceWork) stash(data []byte, blocks []bool, sources []string) {
+	pw.partial = data
+	pw.blocks = blocks
+	pw.blockSources = sources
+}
+
+// restore hands a stashed partial piece to a new attempt.
+func (pw *pieceWork) restore(progress *peer.PieceProgress, received []bool, sources []string) {
+	copy(progress.Buffer, pw.partial)
+	copy(sources, pw.blockSources)
+	for i, ok := range pw.blocks {
+		if !ok || i >= len(received) {
+			continue
+		}
+		received[i] = true
+		progress.Downloaded += min(MaxBlockSize, pw.length-i*MaxBlockSize)
+	}
+	pw.partial, pw.blocks, pw.blockSources = nil, nil, nil
 }
 
 type pieceResult struct {
@@ -50,61 +202,156 @@ type pieceResult struct {
 }
 
 type TorrentStats struct {
-	Name        string  `json:"name"`
-	Percent     float64 `json:"percent"`
-	Downloaded  int     `json:"downloaded"`
-	TotalLength int     `json:"totalLength"`
-	Peers       int     `json:"peers"`
-	InfoHash    string  `json:"infoHash"`
+	Name        string     `json:"name"`
+	Percent     float64    `json:"percent"`
+	Downloaded  int        `json:"downloaded"`
+	TotalLength int        `json:"totalLength"`
+	Peers       int        `json:"peers"`
+	Connected   int        `json:"connected"`
+	InfoHash    string     `json:"infoHash"`
+	Paused      bool       `json:"paused"`
+	SavePath    string     `json:"savePath"`
+	Error       string     `json:"error"`
+	DiskCache   CacheStats `json:"diskCache"`
+	Wanted      int64      `json:"wanted"`
+	Sequential  bool       `json:"sequential"`
+	Moving      bool       `json:"moving"`
+
+	Checking      bool    `json:"checking"`
+	CheckProgress float64 `json:"checkProgress"`
+
+	DownloadedTotal int64 `json:"downloadedTotal"`
+	UploadedTotal   int64 `json:"uploadedTotal"`
+
+	Files    []FileStats    `json:"files"`
+	PeerList []PeerStats    `json:"peerList"`
+	Clients  map[string]int `json:"clients"`
 }
 
 func NewManager(myID [20]byte) *Manager {
-	return &Manager{
+	m := &Manager{
 		Torrents: make(map[string]*Torrent),
 		PeerID:   myID,
+		Config:   DefaultConfig(),
+		Bans:     NewBanList(),
+		Filter:   ipfilter.New(),
+		stop:     make(chan struct{}),
 	}
+	go m.watchBinding()
+	return m
 }
 
 func (t *Torrent) Download() error {
-	workQueue := make(chan *pieceWork, len(t.PieceHashes))
-	results := make(chan *pieceResult)
+	if t.picker == nil {
+		t.picker = newPiecePicker()
+	}
+	t.haveMu.Lock()
+	t.have = peer.NewBitfield(len(t.PieceHashes))
+	t.haveMu.Unlock()
 
-	doneCount := 0
-	fmt.Println("Verifying existing files...")
-	for index, hash := range t.PieceHashes {
-		length := t.calculatePieceSize(index)
+	if err := t.prepareStorage(); err != nil {
+		t.setError(err)
+	}
 
-		if t.checkPieceOnDisk(index, hash) {
+	var have peer.Bitfield
+	rd := t.loadResume()
+	if rd != nil {
+		fmt.Println("Loading resume data...")
+		have = peer.Bitfield(rd.Bitfield)
+		t.downloaded.Store(rd.Downloaded)
+		t.uploaded.Store(rd.Uploaded)
+		t.addPeers(rd.Peers...)
+	} else {
+		fmt.Println("Verifying existing files...")
+		all := make([]int, len(t.PieceHashes))
+		for i := range all {
+			all[i] = i
+		}
+		have = t.verifyPieces(all)
+	}
+
+	doneCount := 0
+	for index := range t.PieceHashes {
+		if have.HasPiece(index) {
+			t.markHave(index)
+			t.markComplete(index)
 			doneCount++
-			t.BytesDownloaded += length
+			t.BytesDownloaded.Add(int64(t.calculatePieceSize(index)))
 			continue
 		}
-		workQueue <- &pieceWork{index, hash, length}
+		if t.piecePriority(index) == PrioritySkip {
+			continue
+		}
+		pw := t.newPieceWork(index)
+		if rd != nil {
+			t.restorePartial(pw, rd)
+		}
+		t.picker.Push(pw)
 	}
 
 	if doneCount > 0 {
 		fmt.Printf("Resuming from %.2f%%...\n", float64(doneCount)/float64(len(t.PieceHashes))*100)
 	}
+	// This outlives run, which ends when the download does; the torrent
+	// goes on seeding until it is stopped.
+	go t.connectLoop()
+	return t.run()
+}
+
+// run fetches the queued pieces and stores them until the torrent is
+// complete. A recheck that finds pieces missing after that starts it again.
+func (t *Torrent) run() error {
+	defer t.picker.Close()
 
-	for _, address := range t.Peers {
-		go t.startDownloadWorker(address, workQueue, results)
+	t.addPeers(t.Peers...)
+	go t.resumeLoop()
+	for _, url := range t.WebSeeds {
+		go t.webSeedLoop(url)
+	}
+	for _, url := range t.HTTPSeeds {
+		go t.httpSeedLoop(url)
 	}
 
-	for doneCount < len(t.PieceHashes) {
-		res := <-results
-		err := storage.SavePiece(t.Name, res.index, t.PieceLength, res.data)
-		if err != nil {
-			fmt.Printf("Error saving piece %d: %v\n", res.index, err)
+	for !t.complete() {
+		var res *pieceResult
+		select {
+		case res = <-t.results:
+		case <-t.rechecked:
+			continue
+		case <-t.picker.Done():
+			return nil
+		}
+		// A piece that was queued twice only counts once.
+		if t.hasPiece(res.index) {
 			continue
 		}
-		t.BytesDownloaded += len(res.data)
-		doneCount++
+		t.markHave(res.index)
+		t.picker.Update(func(pw *pieceWork) bool { return pw.index == res.index })
+		t.disk.WritePiece(res.index, res.data)
+		t.broadcastHave(res.index)
+		t.BytesDownloaded.Add(int64(len(res.data)))
+		t.downloaded.Add(int64(len(res.data)))
+		doneCount := t.haveCount()
 		percent := float64(doneCount) / float64(len(t.PieceHashes)) * 100
 		fmt.Printf("\rDownloaded: %d/%d (%.2f%%)", doneCount, len(t.PieceHashes), percent)
 	}
+	if err := t.saveResume(); err != nil {
+		fmt.Printf("Could not save resume data for %s: %v\n", t.Name, err)
+	}
+	t.moveCompleted()
 	return nil
 }
 
+// queuePiece hands a piece to the picker, restarting the download if it
+// had already finished.
+func (t *Torrent) queuePiece(pw *pieceWork) {
+	restart := t.picker.reopen()
+	t.picker.Push(pw)
+	if restart {
+		go t.run()
+	}
+}
+
 func (t *Torrent) calculatePieceSize(index int) int {
 	begin := index * t.PieceLength
 	end := begin + t.PieceLength
@@ -114,146 +361,504 @@ func (t *Torrent) calculatePieceSize(index int) int {
 	return t.PieceLength
 }
 
-func (t *Torrent) startDownloadWorker(addr string, workQueue chan *pieceWork, results chan *pieceResult) {
+func (t *Torrent) startDownloadWorker(addr string) {
 
-	conn, err := t.establishPeer(addr)
+	delivered := 0
+	failed := true
+	defer func() {
+		t.candidates.disconnected(addr, delivered, failed, t.Config)
+		t.pool.release()
+	}()
+
+	if t.blocked(addr) {
+		return
+	}
+
+	t.pool.beginDial()
+	conn, hs, err := t.establishPeer(addr)
+	t.pool.endDial()
 	if err != nil {
 		return
 	}
-	defer conn.Close()
+
+	delivered, failed = t.runPeer(addr, conn, hs)
+}
+
+// acceptPeer takes over an incoming connection that already completed the
+// handshake, subject to the same limits as the peers we dial.
+func (t *Torrent) acceptPeer(addr string, conn net.Conn, hs *peer.Handshake) {
+	if t.blocked(addr) || t.Paused() || !t.pool.tryAcquire() {
+		conn.Close()
+		return
+	}
+	if !t.candidates.attach(addr, t.Config.MaxConnectionsPerTorrent) {
+		t.pool.release()
+		conn.Close()
+		return
+	}
+
+	delivered, failed := t.runPeer(addr, conn, hs)
+	t.candidates.disconnected(addr, delivered, failed, t.Config)
+	t.pool.release()
+}
+
+// runPeer drives an established connection until it ends. It reports how
+// many bytes of verified pieces the peer delivered and whether it failed.
+func (t *Torrent) runPeer(addr string, conn net.Conn, hs *peer.Handshake) (delivered int, failed bool) {
+	ip := peerIP(addr)
 
 	state := &peerState{
-		conn:   conn,
-		choked: true,
+		session:       peer.NewSession(conn, len(t.PieceHashes), t.Config.IdleTimeout),
+		addr:          addr,
+		ip:            ip,
+		choked:        true,
+		amChoking:     true,
+		requested:     make(map[blockRequest]bool),
+		snubbedOn:     make(map[int]time.Time),
+		fast:          hs.SupportsFast(),
+		allowedFast:   make(map[int]bool),
+		suggested:     make(map[int]bool),
+		allowedToPeer: make(map[int]bool),
+	}
+	defer state.session.Close()
+
+	t.trackPeer(addr, hs, state.session)
+	defer t.untrackPeer(addr)
+
+	if hs.SupportsExtensions() {
+		ext := &peer.ExtendedHandshake{Version: peer.ClientVersion}
+		if err := state.session.SendExtendedHandshake(ext); err != nil {
+			return delivered, false
+		}
+	}
+	if err := t.sendInitialState(state); err != nil {
+		return delivered, false
+	}
+	if err := t.updateInterest(state); err != nil {
+		return delivered, false
 	}
 
-	for pw := range workQueue {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	// The connection outlives the download: once the torrent is complete
+	// the peer is only served, until the torrent is stopped.
+	for !t.stopped() {
+		wake := t.picker.Wait()
+		if t.picker.Closed() {
+			// A closed picker's channel never blocks; a recheck that
+			// reopens it is noticed on the next tick.
+			wake = nil
+		}
+		if pw := state.pick(t.picker); pw != nil {
+			// A piece queued twice may have come in meanwhile.
+			if t.hasPiece(pw.index) {
+				continue
+			}
+			progress, sources, err := t.attemptDownload(state, pw)
+			if err == errObsolete {
+				continue
+			}
+			if err == errSnubbed {
+				fmt.Printf("   ~ Peer %s snubbed on piece %d, reassigning\n", addr, pw.index)
+				t.picker.Push(pw)
+				continue
+			}
+			if err == errRejected || err == errChoked {
+				t.picker.Push(pw)
+				continue
+			}
+			if err == errPaused {
+				t.picker.Push(pw)
+				return delivered, false
+			}
+			var perr *peer.ProtocolError
+			if errors.As(err, &perr) {
+				fmt.Printf("   X Peer %s broke the protocol: %v\n", addr, err)
+				t.picker.Push(pw)
+				return delivered, true
+			}
+			if err != nil {
+				fmt.Printf("   X Peer %s failed on piece %d: %v\n", addr, pw.index, err)
+				t.picker.Push(pw)
+				return delivered, true
+			}
 
-		if state.bitfield != nil && !state.bitfield.HasPiece(pw.index) {
-			workQueue <- pw
+			if err := progress.CheckHash(pw.hash); err != nil {
+				fmt.Printf("   X Peer %s failed on piece %d: %v\n", addr, pw.index, err)
+				t.handleHashFailure(pw, progress.Buffer, sources)
+				t.picker.Push(pw)
+				if t.bans.IsBanned(ip) {
+					return delivered, false
+				}
+				continue
+			}
+			if pw.suspect != nil {
+				t.attributeBadBlocks(pw, progress.Buffer)
+			}
+
+			delivered += pw.length
+			t.updatePeer(addr, func(p *PeerStats) { p.Downloaded += pw.length })
+			select {
+			case t.results <- &pieceResult{index: pw.index, data: progress.Buffer}:
+			case <-t.picker.Done():
+			}
 			continue
 		}
 
-		data, err := t.attemptDownload(state, pw)
-		if err != nil {
-			fmt.Printf("   X Peer %s failed on piece %d: %v\n", addr, pw.index, err)
-			workQueue <- pw
-			return
+		select {
+		case <-wake:
+		case ev, ok := <-state.session.Events():
+			if !ok {
+				var perr *peer.ProtocolError
+				if errors.As(state.session.Err(), &perr) {
+					fmt.Printf("   X Peer %s broke the protocol: %v\n", addr, perr)
+					return delivered, true
+				}
+				return delivered, false
+			}
+			err := t.handleEvent(state, ev)
+			ev.Release()
+			if err != nil {
+				fmt.Printf("   X Peer %s broke the protocol: %v\n", addr, err)
+				return delivered, true
+			}
+		case <-ticker.C:
+			if t.blocked(addr) || t.Paused() || t.bothSeeds(state) {
+				return delivered, false
+			}
+			if err := t.keepAlive(state); err != nil {
+				return delivered, false
+			}
+			if err := t.updateInterest(state); err != nil {
+				return delivered, false
+			}
+		case <-t.stop:
+		}
+	}
+	return delivered, false
+}
+
+// pick takes a piece the peer suggested if there is one, else any piece
+// it can serve.
+func (s *peerState) pick(p *piecePicker) *pieceWork {
+	if len(s.suggested) > 0 {
+		pw := p.Pick(func(pw *pieceWork) bool {
+			return s.suggested[pw.index] && s.canDownload(pw)
+		})
+		if pw != nil {
+			return pw
+		}
+	}
+	return p.Pick(s.canDownload)
+}
+
+func (s *peerState) canDownload(pw *pieceWork) bool {
+	if s.bitfield != nil && !s.bitfield.HasPiece(pw.index) {
+		return false
+	}
+	if s.choked && !s.allowedFast[pw.index] {
+		return false
+	}
+	if until, ok := s.snubbedOn[pw.index]; ok && time.Now().Before(until) {
+		return false
+	}
+	if time.Now().Before(pw.suspectUntil) {
+		for _, src := range pw.suspectSources {
+			if src == s.ip {
+				return false
+			}
 		}
+	}
+	return true
+}
+
+// handleEvent applies an event outside of a piece download. Blocks and
+// rejects still have to answer one of our requests.
+func (t *Torrent) handleEvent(s *peerState, ev peer.Event) error {
+	switch ev.Type {
+	case peer.EventUnchoke:
+		s.choked = false
+		t.updatePeer(s.addr, func(p *PeerStats) { p.Choked = false })
+	case peer.EventChoke:
+		s.choked = true
+		t.updatePeer(s.addr, func(p *PeerStats) { p.Choked = true })
+		// Without the fast extension a choke silently drops our requests.
+		if !s.fast {
+			s.requested = make(map[blockRequest]bool)
+		}
+	case peer.EventPiece, peer.EventReject:
+		return s.answered(ev)
+	case peer.EventInterested, peer.EventNotInterested:
+		s.interested = ev.Type == peer.EventInterested
+		t.updatePeer(s.addr, func(p *PeerStats) { p.Interested = s.interested })
+		return t.updateChoke(s)
+	case peer.EventHave:
+		s.bitfield.SetPiece(ev.Index)
+	case peer.EventBitfield:
+		s.bitfield = ev.Bitfield
+	case peer.EventHaveAll:
+		s.bitfield = peer.FullBitfield(len(t.PieceHashes))
+	case peer.EventHaveNone:
+		s.bitfield = peer.NewBitfield(len(t.PieceHashes))
+	case peer.EventAllowedFast:
+		s.allowedFast[ev.Index] = true
+	case peer.EventSuggest:
+		s.suggested[ev.Index] = true
+	case peer.EventRequest:
+		t.serveRequest(s, ev)
+	case peer.EventExtended:
+		return t.handleExtended(s, ev.Message.Payload)
+	}
+	return nil
+}
 
-		results <- &pieceResult{index: pw.index, data: data}
+// handleExtended only understands the BEP 10 handshake, which names the
+// peer's client more precisely than its peer ID.
+func (t *Torrent) handleExtended(s *peerState, payload []byte) error {
+	if payload[0] != 0 {
+		return nil
 	}
+	hs, err := peer.ParseExtendedHandshake(payload[1:])
+	if err != nil {
+		return &peer.ProtocolError{ID: peer.MsgExtended, Reason: err.Error()}
+	}
+	if hs.Version != "" {
+		t.updatePeer(s.addr, func(p *PeerStats) { p.Client = hs.Version })
+	}
+	return nil
 }
 
-func (t *Torrent) attemptDownload(s *peerState, pw *pieceWork) ([]byte, error) {
+// answered matches a block or reject against our outstanding requests.
+func (s *peerState) answered(ev peer.Event) error {
+	req := blockRequest{ev.Index, ev.Begin, ev.Length}
+	if !s.requested[req] {
+		msg := peer.MsgPiece
+		if ev.Type == peer.EventReject {
+			msg = peer.MsgRejectRequest
+		}
+		return &peer.ProtocolError{ID: msg, Reason: fmt.Sprintf("unrequested block %d/%d/%d", ev.Index, ev.Begin, ev.Length)}
+	}
+	delete(s.requested, req)
+	if ev.Type == peer.EventPiece {
+		s.lastBlock = time.Now()
+		s.snubbed = false
+		clear(s.snubbedOn)
+	}
+	return nil
+}
 
-	s.conn.SetDeadline(time.Now().Add(30 * time.Second))
-	defer s.conn.SetDeadline(time.Time{}) // Reset
+func (t *Torrent) keepAlive(s *peerState) error {
+	if time.Since(s.session.LastSend()) < t.Config.KeepAliveInterval {
+		return nil
+	}
+	return s.session.SendKeepAlive()
+}
+
+func (t *Torrent) attemptDownload(s *peerState, pw *pieceWork) (_ *peer.PieceProgress, _ []string, err error) {
 
 	progress := peer.NewPieceProgress(pw.index, pw.length)
+	numBlocks := (pw.length + MaxBlockSize - 1) / MaxBlockSize
+	received := make([]bool, numBlocks)
+	sources := make([]string, numBlocks)
+	if pw.blocks != nil {
+		pw.restore(progress, received, sources)
+	}
+	// Blocks already in hand survive a failed attempt for the next peer.
+	defer func() {
+		if err != nil {
+			pw.stash(progress.Buffer, received, sources)
+		}
+	}()
+	progress.Requested = progress.Downloaded
+	next := 0
+	waiting := time.Now()
+	deadline := t.streamDeadline(pw.index)
+
+	// Snubbed peers only get one block in flight until they deliver again.
+	backlog := 5
+	if s.snubbed {
+		backlog = 1
+	}
 
-	t.sendInterested(s.conn)
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
 
 	for progress.Downloaded < pw.length {
-		if !s.choked {
+		if !s.choked || s.allowedFast[pw.index] {
 
-			for progress.Requested-progress.Downloaded < 5*MaxBlockSize && progress.Requested < pw.length {
+			for progress.Requested-progress.Downloaded < backlog*MaxBlockSize && next < numBlocks {
+				if received[next] {
+					next++
+					continue
+				}
+				begin := next * MaxBlockSize
 				blockSize := MaxBlockSize
-				if pw.length-progress.Requested < blockSize {
-					blockSize = pw.length - progress.Requested
+				if pw.length-begin < blockSize {
+					blockSize = pw.length - begin
+				}
+				if err := s.session.SendRequest(pw.index, begin, blockSize); err != nil {
+					return nil, nil, err
 				}
-				t.sendRequest(s.conn, pw.index, progress.Requested, blockSize)
+				s.requested[blockRequest{pw.index, begin, blockSize}] = true
 				progress.Requested += blockSize
+				next++
 			}
 		}
 
-		msg, err := peer.ReadMessage(s.conn)
-		if err != nil {
-			return nil, err
-		}
-		if msg == nil {
-			continue
-		}
-
-		switch msg.ID {
-		case peer.MsgUnchoke:
-			s.choked = false
-		case peer.MsgChoke:
-			s.choked = true
-		case peer.MsgHave:
-			index := int(binary.BigEndian.Uint32(msg.Payload))
-			s.bitfield.SetPiece(index)
-		case peer.MsgPiece:
-
-			if err := progress.AddBlock(msg.Payload); err != nil {
-				return nil, err
+		select {
+		case ev, ok := <-s.session.Events():
+			if !ok {
+				return nil, nil, s.session.Err()
+			}
+			if err := t.handleEvent(s, ev); err != nil {
+				return nil, nil, err
+			}
+			if ev.Type == peer.EventPiece {
+				waiting = time.Now()
+			}
+			if ev.Type == peer.EventReject && ev.Index == pw.index {
+				return nil, nil, errRejected
+			}
+			if ev.Type == peer.EventChoke && !s.fast {
+				return nil, nil, errChoked
+			}
+			// Late blocks from a piece we gave up on belong to someone else now.
+			if ev.Type != peer.EventPiece || ev.Index != pw.index || ev.Begin%MaxBlockSize != 0 || received[ev.Begin/MaxBlockSize] {
+				ev.Release()
+				continue
+			}
+			err := progress.AddBlock(ev.Index, ev.Begin, ev.Block)
+			ev.Release()
+			if err != nil {
+				return nil, nil, err
+			}
+			received[ev.Begin/MaxBlockSize] = true
+			sources[ev.Begin/MaxBlockSize] = s.ip
+		case <-ticker.C:
+			if t.Paused() {
+				return nil, nil, errPaused
+			}
+			if err := t.keepAlive(s); err != nil {
+				return nil, nil, err
+			}
+			if time.Since(waiting) > t.Config.SnubTimeout {
+				s.snubbed = true
+				s.snubbedOn[pw.index] = time.Now().Add(t.Config.SnubTimeout)
+				return nil, nil, errSnubbed
+			}
+			if t.hasPiece(pw.index) {
+				return nil, nil, errObsolete
+			}
+			if !deadline.IsZero() && time.Now().After(deadline) {
+				deadline = time.Time{}
+				t.requestAgain(pw.index)
 			}
 		}
 	}
 
-	if err := progress.CheckHash(pw.hash); err != nil {
-		return nil, err
+	return progress, sources, nil
+}
+
+func (t *Torrent) establishPeer(addr string) (net.Conn, *peer.Handshake, error) {
+
+	// With the prefer policy a peer that hangs up on the encrypted
+	// handshake gets a second, plaintext attempt.
+	methods := []uint32{0}
+	switch t.Config.Encryption {
+	case mse.PolicyRequire:
+		methods = []uint32{mse.CryptoRC4}
+	case mse.PolicyPrefer:
+		methods = []uint32{mse.CryptoRC4 | mse.CryptoPlaintext, 0}
 	}
 
-	return progress.Buffer, nil
+	var lastErr error
+	for _, crypto := range methods {
+		conn, err := t.dial(addr)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		remote, wrapped, err := t.handshake(conn, crypto)
+		if err == nil {
+			return wrapped, remote, nil
+		}
+		conn.Close()
+		lastErr = err
+	}
+	return nil, nil, lastErr
 }
 
-func (t *Torrent) establishPeer(addr string) (net.Conn, error) {
+func (t *Torrent) handshake(conn net.Conn, crypto uint32) (*peer.Handshake, net.Conn, error) {
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	defer conn.SetDeadline(time.Time{})
 
-	conn, err := net.DialTimeout("tcp", addr, 5*time.Second)
-	if err != nil {
-		return nil, err
+	if crypto != 0 {
+		encrypted, err := mse.Initiate(conn, t.InfoHash, crypto)
+		if err != nil {
+			return nil, nil, err
+		}
+		conn = encrypted
 	}
 
 	hs := peer.NewHandshake(t.InfoHash, t.PeerID)
-	_, err = conn.Write(hs.Serialize())
+	_, err := conn.Write(hs.Serialize())
 	if err != nil {
-		conn.Close()
-		return nil, err
+		return nil, nil, err
 	}
 
-	_, err = peer.Read(conn)
+	remote, err := peer.Read(conn)
 	if err != nil {
-		conn.Close()
-		return nil, err
+		return nil, nil, err
+	}
+	if remote.InfoHash != t.InfoHash {
+		return nil, nil, fmt.Errorf("peer answered for a different torrent")
 	}
 
-	return conn, nil
-}
-
-func (t *Torrent) sendInterested(conn net.Conn) error {
-	msg := &peer.Message{ID: peer.MsgInterested}
-	_, err := conn.Write(msg.Serialize())
-	return err
+	return remote, conn, nil
 }
 
-func (t *Torrent) sendRequest(conn net.Conn, index, begin, length int) error {
-	payload := peer.FormatRequest(index, begin, length)
-	msg := &peer.Message{ID: peer.MsgRequest, Payload: payload}
-	_, err := conn.Write(msg.Serialize())
-	return err
+// AddOptions customises a single torrent. The zero value saves it as files
+// in Config.DownloadDir and downloads every file.
+type AddOptions struct {
+	SavePath string
+	Storage  storage.Opener
+	// FilePriorities is indexed like the torrent's files; files past its
+	// end get PriorityNormal.
+	FilePriorities []FilePriority
+	// CompletedDir overrides Config.CompletedDir.
+	CompletedDir string
 }
 
-func (t *Torrent) checkPieceOnDisk(index int, expectedHash [20]byte) bool {
-	data, err := storage.ReadPiece(t.Name, index, t.PieceLength)
-	if err != nil {
-		return false
-	}
-
-	hash := sha1.Sum(data)
-	return hash == expectedHash
+func (m *Manager) AddTorrent(torrentData []byte) error {
+	return m.AddTorrentWithOptions(torrentData, AddOptions{})
 }
 
-func (m *Manager) AddTorrent(torrentData []byte) error {
+func (m *Manager) AddTorrentWithOptions(torrentData []byte, opts AddOptions) error {
+	cfg := m.config()
 
 	meta, err := metainfo.ParseTorrent(torrentData)
 	if err != nil {
 		return fmt.Errorf("failed to parse torrent: %w", err)
 	}
 
-	peers, err := tracker.GetPeers(meta)
+	dir := opts.SavePath
+	if dir == "" {
+		dir = cfg.DownloadDir
+	}
+	// The name is checked whatever the backend, before the tracker hears of it.
+	savePath, err := storage.RootPath(dir, meta)
 	if err != nil {
-		return fmt.Errorf("failed to get peers: %w", err)
+		return fmt.Errorf("unsafe torrent path: %w", err)
+	}
+
+	peers, err := tracker.GetPeersVia(meta, cfg.network(), m.listenPort())
+	if err != nil {
+		// Web seeds can carry the download on their own.
+		if len(meta.URLList) == 0 && len(meta.HTTPSeeds) == 0 {
+			return fmt.Errorf("failed to get peers: %w", err)
+		}
+		fmt.Printf("Tracker failed, using web seeds only: %v\n", err)
 	}
 
 	myID, err := tracker.GeneratePeerID()
@@ -285,6 +890,30 @@ func (m *Manager) AddTorrent(torrentData []byte) error {
 	}
 	m.mu.RUnlock()
 
+	completedDir := opts.CompletedDir
+	if completedDir == "" {
+		completedDir = cfg.CompletedDir
+	}
+	open := opts.Storage
+	if open == nil {
+		if cfg.IncompleteDir != "" && completedDir == "" {
+			completedDir = dir
+		}
+		// A torrent that finished in an earlier run is already where it
+		// belongs.
+		if completedDir != "" && pathExists(filepath.Join(completedDir, filepath.Base(savePath))) {
+			dir, completedDir = completedDir, ""
+		} else if cfg.IncompleteDir != "" {
+			dir = cfg.IncompleteDir
+		}
+		savePath = filepath.Join(dir, filepath.Base(savePath))
+		open = storage.FileOpenerWithSuffix(dir, cfg.IncompleteSuffix)
+	}
+	store, err := open(meta)
+	if err != nil {
+		return fmt.Errorf("failed to open storage: %w", err)
+	}
+
 	t := &Torrent{
 		Peers:       peerAddresses,
 		PeerID:      myID,
@@ -293,9 +922,36 @@ func (m *Manager) AddTorrent(torrentData []byte) error {
 		PieceLength: int(meta.PieceLength),
 		Length:      int(meta.Length),
 		Name:        meta.Name,
+		savePath:    savePath,
+		Files:       meta.Files,
+		WebSeeds:    meta.URLList,
+		HTTPSeeds:   meta.HTTPSeeds,
+		Config:      cfg,
+		bans:        m.Bans,
+		filter:      m.Filter,
+		candidates:  newCandidateList(),
+		picker:      newPiecePicker(),
+		results:     make(chan *pieceResult),
+		rechecked:   make(chan struct{}, 1),
+		stop:        make(chan struct{}),
+		store:       store,
 	}
 
+	t.picker.order = t.pieceOrder
+	t.completedDir = completedDir
+	if err := t.setPriorities(opts.FilePriorities); err != nil {
+		store.Close()
+		return err
+	}
+	t.disk = newDiskIO(store, int64(t.PieceLength), int64(t.Length), cfg.DiskCacheSize, t.diskFailed)
+
 	m.mu.Lock()
+	if m.pool == nil {
+		m.pool = newConnPool(cfg.MaxConnections, cfg.MaxHalfOpen)
+	}
+	t.pool = m.pool
+	t.utp.Store(m.utp)
+	t.killed.Store(m.bindLost)
 	m.Torrents[infoHashHex] = t
 	m.mu.Unlock()
 
@@ -322,19 +978,38 @@ func (m *Manager) GetStats() []TorrentStats {
 }
 
 func (t *Torrent) GetStats() TorrentStats {
+	peerList, clients := t.peerStats()
 
+	// Progress only counts the files that are wanted.
+	wanted, done := t.wantedBytes()
 	var percent float64
-	if t.Length > 0 {
-
-		percent = (float64(t.BytesDownloaded) / float64(t.Length)) * 100
+	if wanted > 0 {
+		percent = (float64(done) / float64(wanted)) * 100
 	}
 
 	return TorrentStats{
 		Name:        t.Name,
 		Percent:     percent,
-		Downloaded:  t.BytesDownloaded,
+		Downloaded:  int(t.BytesDownloaded.Load()),
 		TotalLength: t.Length,
 		Peers:       len(t.Peers),
+		Connected:   t.candidates.Connected(),
 		InfoHash:    fmt.Sprintf("%x", t.InfoHash),
+		Paused:      t.Paused(),
+		SavePath:    t.SavePath(),
+		Error:       errString(t.Err()),
+		DiskCache:   t.disk.Stats(),
+		Wanted:      wanted,
+		Sequential:  t.sequential.Load(),
+		Moving:      t.moving.Load(),
+
+		Checking:      t.checking.Load(),
+		CheckProgress: t.checkProgress(),
+
+		DownloadedTotal: t.downloaded.Load(),
+		UploadedTotal:   t.uploaded.Load(),
+		Files:           t.fileStats(),
+		PeerList:        peerList,
+		Clients:         clients,
 	}
 }
@@ -0,0 +1,68 @@
+package p2p
+
+import (
+	"fmt"
+	"path/filepath"
+	"torrent-client/internal/storage"
+)
+
+// MoveStorage moves the torrent's data below dir. Peers stay connected and
+// are served from the old location the whole time; writes wait until the
+// files are in place, so pieces still in the disk cache land in the new
+// one.
+func (t *Torrent) MoveStorage(dir string) error {
+	mover, ok := t.store.(storage.Mover)
+	if !ok {
+		return fmt.Errorf("the storage of %s cannot be moved", t.Name)
+	}
+	if !t.moveMu.TryLock() {
+		return fmt.Errorf("%s is already being moved", t.Name)
+	}
+	defer t.moveMu.Unlock()
+
+	t.moving.Store(true)
+	defer t.moving.Store(false)
+
+	fmt.Printf("Moving %s to %s...\n", t.Name, dir)
+	t.disk.Flush()
+	if err := mover.Move(dir); err != nil {
+		return fmt.Errorf("moving %s: %w", t.Name, err)
+	}
+	t.pathMu.Lock()
+	t.savePath = filepath.Join(dir, filepath.Base(t.savePath))
+	t.pathMu.Unlock()
+	fmt.Printf("Moved %s to %s\n", t.Name, t.SavePath())
+
+	if err := t.saveResume(); err != nil {
+		fmt.Printf("Could not save resume data for %s: %v\n", t.Name, err)
+	}
+	return nil
+}
+
+// SavePath is where the torrent's data is: its file, or its directory for
+// a multi-file torrent.
+func (t *Torrent) SavePath() string {
+	t.pathMu.Lock()
+	defer t.pathMu.Unlock()
+	return t.savePath
+}
+
+func (m *Manager) MoveStorage(infoHash, dir string) error {
+	t := m.Torrent(infoHash)
+	if t == nil {
+		return fmt.Errorf("unknown torrent %s", infoHash)
+	}
+	return t.MoveStorage(dir)
+}
+
+// moveCompleted moves a finished torrent to its completed directory, once.
+func (t *Torrent) moveCompleted() {
+	if t.completedDir == "" {
+		return
+	}
+	if err := t.MoveStorage(t.completedDir); err != nil {
+		fmt.Printf("Could not move finished torrent: %v\n", err)
+		return
+	}
+	t.completedDir = ""
+}
@@ -0,0 +1,51 @@
+package p2p
+
+import (
+	"bytes"
+	"path/filepath"
+	"testing"
+
+	"torrent-client/internal/metainfo"
+)
+
+func TestMoveStorageKeepsServing(t *testing.T) {
+	data := bytes.Repeat([]byte("seeded while moving "), 100)
+	meta := testMeta("moved", data, 256, []metainfo.File{
+		{Path: []string{"one"}, Length: 1000},
+		{Path: []string{"two"}, Length: 1000},
+	})
+	cfg := DefaultConfig()
+	cfg.ResumeDir = ""
+	cfg.DiskCacheSize = 0
+	tor := newFileTorrent(t, t.TempDir(), meta, cfg)
+	if _, err := tor.store.WriteAt(data, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	dest := t.TempDir()
+	moved := make(chan error, 1)
+	go func() { moved <- tor.MoveStorage(dest) }()
+
+	// Peers' reads and the stats keep going while the files move.
+	for done := false; !done; {
+		select {
+		case err := <-moved:
+			if err != nil {
+				t.Fatal(err)
+			}
+			done = true
+		default:
+		}
+		for i := range tor.PieceHashes {
+			got := make([]byte, tor.calculatePieceSize(i))
+			if _, err := tor.disk.ReadAt(got, int64(i*256)); err != nil || !bytes.Equal(got, data[i*256:i*256+len(got)]) {
+				t.Fatalf("piece %d read %q, %v", i, got, err)
+			}
+		}
+		tor.GetStats()
+	}
+
+	if want := filepath.Join(dest, "moved"); tor.SavePath() != want {
+		t.Errorf("SavePath = %s, want %s", tor.SavePath(), want)
+	}
+}
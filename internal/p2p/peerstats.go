@@ -0,0 +1,70 @@
+package p2p
+
+import (
+	"sort"
+	"torrent-client/internal/peer"
+)
+
+// PeerStats describes one live connection.
+type PeerStats struct {
+	Addr       string `json:"addr"`
+	Client     string `json:"client"`
+	Downloaded int    `json:"downloaded"`
+	Choked     bool   `json:"choked"`
+
+	// Uploaded counts the bytes we served the peer. Unchoked is set while
+	// the peer may download from us, Interested while it wants to.
+	Uploaded   int  `json:"uploaded"`
+	Unchoked   bool `json:"unchoked"`
+	Interested bool `json:"interested"`
+}
+
+// trackPeer registers a connection for the stats API, naming the client
+// from its peer ID until the extended handshake says otherwise.
+func (t *Torrent) trackPeer(addr string, hs *peer.Handshake, session *peer.Session) {
+	client := peer.ClientName(hs.PeerID)
+	if client == "" {
+		client = "Unknown"
+	}
+	t.liveMu.Lock()
+	defer t.liveMu.Unlock()
+	if t.live == nil {
+		t.live = make(map[string]*PeerStats)
+	}
+	t.live[addr] = &PeerStats{Addr: addr, Client: client, Choked: true}
+	if t.sessions == nil {
+		t.sessions = make(map[string]*peer.Session)
+	}
+	t.sessions[addr] = session
+}
+
+func (t *Torrent) untrackPeer(addr string) {
+	t.liveMu.Lock()
+	defer t.liveMu.Unlock()
+	delete(t.live, addr)
+	delete(t.sessions, addr)
+}
+
+func (t *Torrent) updatePeer(addr string, update func(p *PeerStats)) {
+	t.liveMu.Lock()
+	defer t.liveMu.Unlock()
+	if p, ok := t.live[addr]; ok {
+		update(p)
+	}
+}
+
+// peerStats returns the live connections sorted by address along with a
+// count of peers per client.
+func (t *Torrent) peerStats() ([]PeerStats, map[string]int) {
+	t.liveMu.Lock()
+	defer t.liveMu.Unlock()
+
+	list := make([]PeerStats, 0, len(t.live))
+	clients := make(map[string]int)
+	for _, p := range t.live {
+		list = append(list, *p)
+		clients[p.Client]++
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Addr < list[j].Addr })
+	return list, clients
+}
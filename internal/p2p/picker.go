@@ -0,0 +1,138 @@
+package p2p
+
+import (
+	"slices"
+	"sync"
+)
+
+// piecePicker holds the pieces that still need downloading. Workers pick the
+// first piece they can serve and wait on Wait when nothing suits them.
+type piecePicker struct {
+	// order is asked once per Pick for the ranking to use, so it can
+	// snapshot whatever it ranks by; by default higher priorities come
+	// first.
+	order func() func(a, b *pieceWork) bool
+
+	mu      sync.Mutex
+	pending []*pieceWork
+	wake    chan struct{}
+	done    chan struct{}
+	closed  bool
+}
+
+func newPiecePicker() *piecePicker {
+	return &piecePicker{wake: make(chan struct{}), done: make(chan struct{})}
+}
+
+func (p *piecePicker) Push(pw *pieceWork) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return
+	}
+	p.pending = append(p.pending, pw)
+	close(p.wake)
+	p.wake = make(chan struct{})
+}
+
+// Pick takes the best piece that accept agrees to, oldest first among
+// equals.
+func (p *piecePicker) Pick(accept func(*pieceWork) bool) *pieceWork {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	less := byPriority
+	if p.order != nil {
+		less = p.order()
+	}
+	best := -1
+	for i, pw := range p.pending {
+		if (best < 0 || less(pw, p.pending[best])) && accept(pw) {
+			best = i
+		}
+	}
+	if best < 0 {
+		return nil
+	}
+	pw := p.pending[best]
+	p.pending = append(p.pending[:best], p.pending[best+1:]...)
+	return pw
+}
+
+func byPriority(a, b *pieceWork) bool {
+	return a.priority > b.priority
+}
+
+// Update runs fn on every pending piece under the lock and drops those it
+// returns true for.
+func (p *piecePicker) Update(fn func(*pieceWork) bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.pending = slices.DeleteFunc(p.pending, fn)
+}
+
+// reopen makes a closed picker usable again and reports whether it was
+// closed.
+func (p *piecePicker) reopen() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.closed {
+		return false
+	}
+	p.closed = false
+	p.wake = make(chan struct{})
+	p.done = make(chan struct{})
+	return true
+}
+
+// partials copies the pending pieces that hold blocks from an earlier
+// attempt.
+func (p *piecePicker) partials() []*pieceWork {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var out []*pieceWork
+	for _, pw := range p.pending {
+		if !slices.Contains(pw.blocks, true) {
+			continue
+		}
+		out = append(out, &pieceWork{
+			index:   pw.index,
+			length:  pw.length,
+			blocks:  append([]bool(nil), pw.blocks...),
+			partial: append([]byte(nil), pw.partial...),
+		})
+	}
+	return out
+}
+
+// Wait returns a channel that is closed on the next Push or on Close. Grab
+// it before calling Pick so a push in between is not missed.
+func (p *piecePicker) Wait() <-chan struct{} {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.wake
+}
+
+func (p *piecePicker) Close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return
+	}
+	p.closed = true
+	p.pending = nil
+	close(p.wake)
+	close(p.done)
+}
+
+// Done is closed once the torrent has every piece or is stopped.
+func (p *piecePicker) Done() <-chan struct{} {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.done
+}
+
+func (p *piecePicker) Closed() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.closed
+}
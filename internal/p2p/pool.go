@@ -0,0 +1,214 @@
+package p2p
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// connPool enforces the Manager-wide connection limits shared by all torrents.
+type connPool struct {
+	mu       sync.Mutex
+	active   int
+	max      int
+	halfOpen chan struct{}
+}
+
+func newConnPool(maxConns, maxHalfOpen int) *connPool {
+	return &connPool{
+		max:      maxConns,
+		halfOpen: make(chan struct{}, maxHalfOpen),
+	}
+}
+
+func (p *connPool) tryAcquire() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.active >= p.max {
+		return false
+	}
+	p.active++
+	return true
+}
+
+func (p *connPool) release() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.active--
+}
+
+func (p *connPool) beginDial() {
+	p.halfOpen <- struct{}{}
+}
+
+func (p *connPool) endDial() {
+	<-p.halfOpen
+}
+
+type peerCandidate struct {
+	addr        string
+	failures    int
+	nextAttempt time.Time
+	delivered   int
+	connected   bool
+	incoming    bool
+}
+
+// candidateList tracks every address we know for a torrent, connected or
+// not, so failed peers can be retried with backoff instead of forgotten.
+type candidateList struct {
+	mu    sync.Mutex
+	peers map[string]*peerCandidate
+}
+
+func newCandidateList() *candidateList {
+	return &candidateList{peers: make(map[string]*peerCandidate)}
+}
+
+func (c *candidateList) Add(addrs ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, addr := range addrs {
+		if _, ok := c.peers[addr]; !ok {
+			c.peers[addr] = &peerCandidate{addr: addr}
+		}
+	}
+}
+
+// attach records an incoming connection, refusing it when the torrent is
+// full or already connected to that address.
+func (c *candidateList) attach(addr string, max int) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	n := 0
+	for _, p := range c.peers {
+		if p.connected {
+			n++
+		}
+	}
+	if n >= max {
+		return false
+	}
+	if p, ok := c.peers[addr]; ok {
+		if p.connected {
+			return false
+		}
+		p.connected = true
+		return true
+	}
+	c.peers[addr] = &peerCandidate{addr: addr, connected: true, incoming: true}
+	return true
+}
+
+func (c *candidateList) addrs() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	addrs := make([]string, 0, len(c.peers))
+	for addr := range c.peers {
+		addrs = append(addrs, addr)
+	}
+	return addrs
+}
+
+func (c *candidateList) Connected() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := 0
+	for _, p := range c.peers {
+		if p.connected {
+			n++
+		}
+	}
+	return n
+}
+
+// next returns the best address that is due for a connection attempt and
+// marks it connected. Peers that delivered data before go first, then the
+// ones that failed least.
+func (c *candidateList) next() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	var ready []*peerCandidate
+	for _, p := range c.peers {
+		if !p.connected && !now.Before(p.nextAttempt) {
+			ready = append(ready, p)
+		}
+	}
+	if len(ready) == 0 {
+		return ""
+	}
+
+	sort.Slice(ready, func(i, j int) bool {
+		if ready[i].delivered != ready[j].delivered {
+			return ready[i].delivered > ready[j].delivered
+		}
+		return ready[i].failures < ready[j].failures
+	})
+	ready[0].connected = true
+	return ready[0].addr
+}
+
+func (c *candidateList) disconnected(addr string, delivered int, failed bool, cfg Config) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	p, ok := c.peers[addr]
+	if !ok {
+		return
+	}
+	p.connected = false
+	p.delivered += delivered
+
+	// Incoming peers connect from ephemeral ports we could never dial back.
+	if p.incoming {
+		delete(c.peers, addr)
+		return
+	}
+
+	if !failed || delivered > 0 {
+		p.failures = 0
+		p.nextAttempt = time.Now().Add(cfg.RetryBackoff)
+		return
+	}
+
+	p.failures++
+	p.nextAttempt = time.Now().Add(retryBackoff(p.failures, cfg))
+}
+
+// retryBackoff doubles RetryBackoff for each consecutive failure, capped
+// at MaxRetryBackoff.
+func retryBackoff(failures int, cfg Config) time.Duration {
+	backoff := cfg.RetryBackoff << (failures - 1)
+	if backoff > cfg.MaxRetryBackoff || backoff <= 0 {
+		backoff = cfg.MaxRetryBackoff
+	}
+	return backoff
+}
+
+// connectLoop keeps the torrent's connections topped up while it
+// downloads, until it is stopped. Seeds wait for peers to come to them.
+func (t *Torrent) connectLoop() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for !t.stopped() {
+		for !t.Paused() && !t.picker.Closed() && t.candidates.Connected() < t.Config.MaxConnectionsPerTorrent {
+			if !t.pool.tryAcquire() {
+				break
+			}
+			addr := t.candidates.next()
+			if addr == "" {
+				t.pool.release()
+				break
+			}
+			go t.startDownloadWorker(addr)
+		}
+		select {
+		case <-ticker.C:
+		case <-t.stop:
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package p2p
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRetryBackoffDoublesUpToCap(t *testing.T) {
+	cfg := Config{RetryBackoff: time.Second, MaxRetryBackoff: 10 * time.Second}
+	tests := []struct {
+		failures int
+		want     time.Duration
+	}{
+		{1, time.Second},
+		{2, 2 * time.Second},
+		{3, 4 * time.Second},
+		{4, 8 * time.Second},
+		{5, 10 * time.Second},
+		{40, 10 * time.Second},
+		// Shifts this far overflow and must still land on the cap.
+		{64, 10 * time.Second},
+		{200, 10 * time.Second},
+	}
+	for _, tt := range tests {
+		if got := retryBackoff(tt.failures, cfg); got != tt.want {
+			t.Errorf("retryBackoff(%d) = %s, want %s", tt.failures, got, tt.want)
+		}
+	}
+}
+
+func TestAttachRefusesWhenFull(t *testing.T) {
+	c := newCandidateList()
+	if !c.attach("10.0.0.1:1000", 2) || !c.attach("10.0.0.2:1000", 2) {
+		t.Fatal("refused a connection below the limit")
+	}
+	if c.attach("10.0.0.3:1000", 2) {
+		t.Error("accepted a connection above the limit")
+	}
+
+	c.disconnected("10.0.0.1:1000", 0, false, DefaultConfig())
+	if c.attach("10.0.0.2:1000", 2) {
+		t.Error("accepted a second connection from the same address")
+	}
+	if !c.attach("10.0.0.3:1000", 2) {
+		t.Error("refused a connection after a slot was freed")
+	}
+	// Incoming peers are forgotten once they leave.
+	for _, addr := range c.addrs() {
+		if addr == "10.0.0.1:1000" {
+			t.Error("kept an incoming address to dial back")
+		}
+	}
+}
+
+func TestCandidatesBackOffAfterFailure(t *testing.T) {
+	cfg := Config{RetryBackoff: time.Hour, MaxRetryBackoff: 4 * time.Hour}
+	c := newCandidateList()
+	c.Add("10.0.0.1:1000", "10.0.0.2:1000")
+
+	first := c.next()
+	second := c.next()
+	if first == "" || second == "" || first == second {
+		t.Fatalf("next gave %q and %q", first, second)
+	}
+	if c.next() != "" {
+		t.Error("handed out a connected address")
+	}
+	if c.Connected() != 2 {
+		t.Errorf("Connected = %d, want 2", c.Connected())
+	}
+
+	c.disconnected(first, 0, true, cfg)
+	if c.next() != "" {
+		t.Error("retried a failed address before its backoff")
+	}
+
+	// A peer that delivered comes first once both are due.
+	c.disconnected(second, 1000, false, cfg)
+	for _, p := range c.peers {
+		p.nextAttempt = time.Time{}
+	}
+	if got := c.next(); got != second {
+		t.Errorf("next = %s, want the peer that delivered", got)
+	}
+	if f := c.peers[first].failures; f != 1 {
+		t.Errorf("failures = %d, want 1", f)
+	}
+}
+
+func TestConnPoolLimit(t *testing.T) {
+	p := newConnPool(2, 1)
+	if !p.tryAcquire() || !p.tryAcquire() {
+		t.Fatal("refused a connection below the limit")
+	}
+	if p.tryAcquire() {
+		t.Error("went over the limit")
+	}
+	p.release()
+	if !p.tryAcquire() {
+		t.Error("a released slot was not reused")
+	}
+
+	p.beginDial()
+	dialled := make(chan struct{})
+	go func() {
+		p.beginDial()
+		close(dialled)
+	}()
+	select {
+	case <-dialled:
+		t.Fatal("a second half-open dial went ahead")
+	case <-time.After(20 * time.Millisecond):
+	}
+	p.endDial()
+	<-dialled
+}
@@ -0,0 +1,187 @@
+package p2p
+
+import (
+	"fmt"
+	"strings"
+	"torrent-client/internal/metainfo"
+	"torrent-client/internal/storage"
+)
+
+// FilePriority says how much a file is wanted. Pieces take the highest
+// priority of the files they touch and the picker hands out higher ones
+// first; pieces touching only skipped files are not downloaded at all.
+type FilePriority int
+
+const (
+	PrioritySkip FilePriority = iota
+	PriorityLow
+	PriorityNormal
+	PriorityHigh
+)
+
+// FileStats is the progress of one file, counted in verified pieces.
+type FileStats struct {
+	Path       string       `json:"path"`
+	Length     int64        `json:"length"`
+	Downloaded int64        `json:"downloaded"`
+	Priority   FilePriority `json:"priority"`
+}
+
+func (t *Torrent) numFiles() int {
+	if len(t.Files) == 0 {
+		return 1
+	}
+	return len(t.Files)
+}
+
+// setPriorities stores prios, filling files it does not cover with
+// PriorityNormal, and tells the storage which files are skipped.
+func (t *Torrent) setPriorities(prios []FilePriority) error {
+	for _, p := range prios {
+		if p < PrioritySkip || p > PriorityHigh {
+			return fmt.Errorf("invalid file priority %d", p)
+		}
+	}
+	if len(prios) > t.numFiles() {
+		return fmt.Errorf("%d priorities for %d files", len(prios), t.numFiles())
+	}
+
+	all := make([]FilePriority, t.numFiles())
+	skip := make([]bool, len(all))
+	for i := range all {
+		all[i] = PriorityNormal
+		if i < len(prios) {
+			all[i] = prios[i]
+		}
+		skip[i] = all[i] == PrioritySkip
+	}
+
+	pieces := make([]FilePriority, len(t.PieceHashes))
+	for index := range pieces {
+		begin := int64(index) * int64(t.PieceLength)
+		for _, span := range t.pieceSpans(begin, int64(t.calculatePieceSize(index))) {
+			pieces[index] = max(pieces[index], all[span.file])
+		}
+	}
+
+	t.prioMu.Lock()
+	t.priorities = all
+	t.piecePriorities = pieces
+	t.prioMu.Unlock()
+
+	if s, ok := t.store.(storage.Skipper); ok {
+		return s.SetSkipped(skip)
+	}
+	return nil
+}
+
+func (t *Torrent) newPieceWork(index int) *pieceWork {
+	return &pieceWork{
+		index:    index,
+		hash:     t.PieceHashes[index],
+		length:   t.calculatePieceSize(index),
+		priority: t.piecePriority(index),
+	}
+}
+
+func (t *Torrent) piecePriority(index int) FilePriority {
+	t.prioMu.Lock()
+	defer t.prioMu.Unlock()
+	return t.piecePriorities[index]
+}
+
+// complete reports whether every piece that is not skipped is in.
+func (t *Torrent) complete() bool {
+	have := t.haveSnapshot()
+	t.prioMu.Lock()
+	defer t.prioMu.Unlock()
+	for index, prio := range t.piecePriorities {
+		if prio != PrioritySkip && !have.HasPiece(index) {
+			return false
+		}
+	}
+	return true
+}
+
+// wantedBytes sums the pieces that are not skipped, and those of them
+// already in.
+func (t *Torrent) wantedBytes() (wanted, done int64) {
+	have := t.haveSnapshot()
+	t.prioMu.Lock()
+	defer t.prioMu.Unlock()
+	for index, prio := range t.piecePriorities {
+		if prio == PrioritySkip {
+			continue
+		}
+		length := int64(t.calculatePieceSize(index))
+		wanted += length
+		if have.HasPiece(index) {
+			done += length
+		}
+	}
+	return wanted, done
+}
+
+// SetFilePriorities changes what is downloaded while the torrent runs.
+// Newly skipped pieces leave the picker, newly wanted ones join it.
+func (t *Torrent) SetFilePriorities(prios []FilePriority) error {
+	t.prioMu.Lock()
+	old := t.piecePriorities
+	t.prioMu.Unlock()
+	if err := t.setPriorities(prios); err != nil {
+		return err
+	}
+
+	t.picker.Update(func(pw *pieceWork) bool {
+		pw.priority = t.piecePriority(pw.index)
+		return pw.priority == PrioritySkip
+	})
+	// Only pieces that were skipped can be missing from the picker without
+	// being in flight.
+	for index := range t.PieceHashes {
+		if old[index] == PrioritySkip && t.piecePriority(index) != PrioritySkip && !t.hasPiece(index) {
+			t.queuePiece(t.newPieceWork(index))
+		}
+	}
+
+	select {
+	case t.rechecked <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+func (m *Manager) SetFilePriorities(infoHash string, prios []FilePriority) error {
+	t := m.Torrent(infoHash)
+	if t == nil {
+		return fmt.Errorf("unknown torrent %s", infoHash)
+	}
+	return t.SetFilePriorities(prios)
+}
+
+// fileStats walks files and pieces together to count the verified bytes of
+// each file.
+func (t *Torrent) fileStats() []FileStats {
+	t.prioMu.Lock()
+	prios := append([]FilePriority(nil), t.priorities...)
+	t.prioMu.Unlock()
+
+	files := t.Files
+	if len(files) == 0 {
+		files = []metainfo.File{{Path: []string{t.Name}, Length: int64(t.Length)}}
+	}
+	stats := make([]FileStats, len(files))
+	for i, f := range files {
+		stats[i] = FileStats{Path: strings.Join(f.Path, "/"), Length: f.Length, Priority: prios[i]}
+	}
+	for index := range t.PieceHashes {
+		if !t.hasPiece(index) {
+			continue
+		}
+		begin := int64(index) * int64(t.PieceLength)
+		for _, span := range t.pieceSpans(begin, int64(t.calculatePieceSize(index))) {
+			stats[span.file].Downloaded += span.length
+		}
+	}
+	return stats
+}
@@ -0,0 +1,246 @@
+package p2p
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+	"torrent-client/internal/peer"
+	"torrent-client/internal/storage"
+)
+
+// resumeData is what a torrent remembers between runs so a restart does not
+// have to hash everything again. It is only trusted while every file still
+// has the size and modification time recorded for it.
+type resumeData struct {
+	InfoHash   string          `json:"infoHash"`
+	Bitfield   []byte          `json:"bitfield"`
+	Files      []resumeFile    `json:"files"`
+	Partial    []resumePartial `json:"partial,omitempty"`
+	Peers      []string        `json:"peers,omitempty"`
+	Downloaded int64           `json:"downloaded"`
+	Uploaded   int64           `json:"uploaded"`
+}
+
+type resumeFile struct {
+	// Size is -1 for a file that did not exist yet.
+	Size    int64 `json:"size"`
+	ModTime int64 `json:"modTime"`
+}
+
+// resumePartial lists the blocks of an unfinished piece that were written
+// to storage alongside the resume file.
+type resumePartial struct {
+	Index  int    `json:"index"`
+	Blocks []bool `json:"blocks"`
+}
+
+func (t *Torrent) resumePath() string {
+	if t.Config.ResumeDir == "" {
+		return ""
+	}
+	return filepath.Join(t.Config.ResumeDir, fmt.Sprintf("%x.resume", t.InfoHash))
+}
+
+// statFiles records the current size and mtime of every file of a
+// file-backed torrent. Other backends have nothing to compare, so their
+// resume data is never used.
+func (t *Torrent) statFiles() ([]resumeFile, bool) {
+	fb, ok := t.store.(storage.FileBacked)
+	if !ok {
+		return nil, false
+	}
+
+	var files []resumeFile
+	for _, path := range fb.Paths() {
+		info, err := os.Stat(path)
+		if os.IsNotExist(err) {
+			files = append(files, resumeFile{Size: -1})
+			continue
+		}
+		if err != nil {
+			return nil, false
+		}
+		files = append(files, resumeFile{Size: info.Size(), ModTime: info.ModTime().UnixNano()})
+	}
+	return files, true
+}
+
+// saveResume writes the resume file. Blocks of unfinished pieces go to
+// storage first, and the files are stat'ed last so anything written in
+// between only makes the next start more cautious.
+func (t *Torrent) saveResume() error {
+	path := t.resumePath()
+	if path == "" {
+		return nil
+	}
+	t.resumeMu.Lock()
+	defer t.resumeMu.Unlock()
+
+	if _, ok := t.store.(storage.FileBacked); !ok {
+		return nil
+	}
+	have := t.haveSnapshot()
+	if have == nil {
+		return nil
+	}
+	// Everything in the snapshot has to be on disk before it is recorded.
+	t.disk.Flush()
+
+	rd := resumeData{
+		InfoHash:   fmt.Sprintf("%x", t.InfoHash),
+		Bitfield:   have,
+		Peers:      t.candidates.addrs(),
+		Downloaded: t.downloaded.Load(),
+		Uploaded:   t.uploaded.Load(),
+	}
+	for _, pw := range t.picker.partials() {
+		if t.writePartial(pw) == nil {
+			rd.Partial = append(rd.Partial, resumePartial{Index: pw.index, Blocks: pw.blocks})
+		}
+	}
+	files, ok := t.statFiles()
+	if !ok {
+		return nil
+	}
+	rd.Files = files
+
+	data, err := json.Marshal(rd)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func (t *Torrent) writePartial(pw *pieceWork) error {
+	offset := int64(pw.index) * int64(t.PieceLength)
+	for i, ok := range pw.blocks {
+		if !ok {
+			continue
+		}
+		begin := i * MaxBlockSize
+		end := min(begin+MaxBlockSize, pw.length)
+		if _, err := t.store.WriteAt(pw.partial[begin:end], offset+int64(begin)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loadResume returns the saved state if it still describes the files on
+// disk, or nil when every piece has to be checked.
+func (t *Torrent) loadResume() *resumeData {
+	path := t.resumePath()
+	if path == "" {
+		return nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+
+	var rd resumeData
+	if err := json.Unmarshal(data, &rd); err != nil {
+		fmt.Printf("Ignoring corrupt resume file %s: %v\n", path, err)
+		return nil
+	}
+	if rd.InfoHash != fmt.Sprintf("%x", t.InfoHash) || len(rd.Bitfield) != len(peer.NewBitfield(len(t.PieceHashes))) {
+		fmt.Printf("Ignoring resume file %s: it belongs to another torrent\n", path)
+		return nil
+	}
+
+	files, ok := t.statFiles()
+	if !ok || len(files) != len(rd.Files) {
+		return nil
+	}
+	for i := range files {
+		if files[i] != rd.Files[i] {
+			fmt.Println("Files changed since the last run, rechecking everything")
+			return nil
+		}
+	}
+	return &rd
+}
+
+// restorePartial reloads the blocks of an unfinished piece saved with the
+// resume data. Their senders are unknown, so a bad block read back here is
+// never blamed on a peer.
+func (t *Torrent) restorePartial(pw *pieceWork, rd *resumeData) {
+	for _, p := range rd.Partial {
+		if p.Index != pw.index || len(p.Blocks) != (pw.length+MaxBlockSize-1)/MaxBlockSize {
+			continue
+		}
+		buf := make([]byte, pw.length)
+		offset := int64(pw.index) * int64(t.PieceLength)
+		for i, ok := range p.Blocks {
+			if !ok {
+				continue
+			}
+			begin := i * MaxBlockSize
+			end := min(begin+MaxBlockSize, pw.length)
+			if _, err := t.store.ReadAt(buf[begin:end], offset+int64(begin)); err != nil {
+				return
+			}
+		}
+		pw.stash(buf, p.Blocks, make([]string, len(p.Blocks)))
+		return
+	}
+}
+
+// resumeLoop saves the resume file every Config.ResumeInterval until the
+// download finishes; Download writes the final one.
+func (t *Torrent) resumeLoop() {
+	if t.resumePath() == "" || t.Config.ResumeInterval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(t.Config.ResumeInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := t.saveResume(); err != nil {
+				fmt.Printf("Could not save resume data for %s: %v\n", t.Name, err)
+			}
+		case <-t.picker.Done():
+			return
+		}
+	}
+}
+
+// Close saves resume data for every torrent, stops them and releases their
+// storage and the listening sockets. The manager must not be used
+// afterwards.
+func (m *Manager) Close() error {
+	m.stopOnce.Do(func() { close(m.stop) })
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var firstErr error
+	for _, t := range m.Torrents {
+		if err := t.saveResume(); err != nil {
+			fmt.Printf("Could not save resume data for %s: %v\n", t.Name, err)
+		}
+		t.halt()
+		t.picker.Close()
+		t.disk.Close()
+		if err := t.store.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	if m.listener != nil {
+		m.listener.Close()
+	}
+	if m.utp != nil {
+		m.utp.Close()
+	}
+	return firstErr
+}
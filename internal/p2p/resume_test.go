@@ -0,0 +1,156 @@
+package p2p
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func resumeConfig(dir string) Config {
+	cfg := DefaultConfig()
+	cfg.ResumeDir = filepath.Join(dir, ".resume")
+	return cfg
+}
+
+func TestResumeRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	data := bytes.Repeat([]byte("0123456789abcdef"), 4*MaxBlockSize/16*3)
+	meta := testMeta("movie.bin", data, 4*MaxBlockSize, nil)
+
+	first := newFileTorrent(t, dir, meta, resumeConfig(dir))
+	pl := first.PieceLength
+	if _, err := first.store.WriteAt(data[:pl], 0); err != nil {
+		t.Fatal(err)
+	}
+	first.markHave(0)
+	first.downloaded.Store(1234)
+	first.addPeers("10.0.0.1:6881")
+
+	// Two blocks of piece 1 arrived before the save.
+	pw := first.newPieceWork(1)
+	pw.stash(append([]byte(nil), data[pl:2*pl]...), []bool{true, false, true, false}, make([]string, 4))
+	first.picker.Push(pw)
+
+	if err := first.saveResume(); err != nil {
+		t.Fatal(err)
+	}
+	first.disk.Close()
+	first.store.Close()
+
+	second := newFileTorrent(t, dir, meta, resumeConfig(dir))
+	rd := second.loadResume()
+	if rd == nil {
+		t.Fatal("resume data was not accepted")
+	}
+	if !bytes.Equal(rd.Bitfield, first.haveSnapshot()) {
+		t.Errorf("bitfield %08b, want %08b", rd.Bitfield, first.haveSnapshot())
+	}
+	if rd.Downloaded != 1234 {
+		t.Errorf("downloaded %d, want 1234", rd.Downloaded)
+	}
+	if len(rd.Peers) != 1 || rd.Peers[0] != "10.0.0.1:6881" {
+		t.Errorf("peers %v", rd.Peers)
+	}
+
+	restored := second.newPieceWork(1)
+	second.restorePartial(restored, rd)
+	if len(restored.blocks) != 4 || !restored.blocks[0] || restored.blocks[1] || !restored.blocks[2] {
+		t.Fatalf("restored blocks %v", restored.blocks)
+	}
+	if !bytes.Equal(restored.partial[:MaxBlockSize], data[pl:pl+MaxBlockSize]) {
+		t.Error("restored block differs from the one saved")
+	}
+}
+
+func TestResumeInvalidation(t *testing.T) {
+	dir := t.TempDir()
+	data := bytes.Repeat([]byte{1}, 2*MaxBlockSize)
+	meta := testMeta("file.bin", data, MaxBlockSize, nil)
+
+	save := func() {
+		tor := newFileTorrent(t, dir, meta, resumeConfig(dir))
+		tor.store.WriteAt(data, 0)
+		tor.markHave(0)
+		tor.markHave(1)
+		if err := tor.saveResume(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	load := func() *resumeData {
+		return newFileTorrent(t, dir, meta, resumeConfig(dir)).loadResume()
+	}
+
+	save()
+	if load() == nil {
+		t.Fatal("unchanged files were rejected")
+	}
+
+	path := filepath.Join(dir, "file.bin")
+	later := time.Now().Add(time.Hour)
+	if err := os.Chtimes(path, later, later); err != nil {
+		t.Fatal(err)
+	}
+	if load() != nil {
+		t.Error("a file modified since the save was trusted")
+	}
+
+	save()
+	if err := os.Truncate(path, MaxBlockSize); err != nil {
+		t.Fatal(err)
+	}
+	if load() != nil {
+		t.Error("a truncated file was trusted")
+	}
+
+	save()
+	other := *meta
+	other.InfoHash[0] ^= 0xff
+	tor := newFileTorrent(t, dir, &other, resumeConfig(dir))
+	os.Rename(
+		filepath.Join(dir, ".resume", fmt.Sprintf("%x.resume", meta.InfoHash)),
+		tor.resumePath(),
+	)
+	if tor.loadResume() != nil {
+		t.Error("resume data of another torrent was trusted")
+	}
+
+	os.WriteFile(tor.resumePath(), []byte("{not json"), 0644)
+	if tor.loadResume() != nil {
+		t.Error("a corrupt resume file was trusted")
+	}
+}
+
+func TestCloseReleasesSockets(t *testing.T) {
+	m := NewManager([20]byte{})
+	cfg := m.Config
+	cfg.ResumeDir = ""
+	cfg.EnableUTP = true
+	m.SetConfig(cfg)
+	if err := m.Listen("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	m.mu.RLock()
+	tcpAddr, us := m.listener.Addr().String(), m.utp
+	m.mu.RUnlock()
+	if us == nil {
+		t.Fatal("uTP socket was not opened")
+	}
+	udpAddr := us.Addr().String()
+
+	m.Close()
+
+	ln, err := net.Listen("tcp", tcpAddr)
+	if err != nil {
+		t.Fatalf("TCP port still held after Close: %v", err)
+	}
+	ln.Close()
+	pc, err := net.ListenPacket("udp", udpAddr)
+	if err != nil {
+		t.Fatalf("uTP port still held after Close: %v", err)
+	}
+	pc.Close()
+}
@@ -0,0 +1,49 @@
+package p2p
+
+// updateChoke unchokes the peer while it is interested, so it can download
+// from us whether or not the torrent is complete, and chokes it again once
+// it is not.
+func (t *Torrent) updateChoke(s *peerState) error {
+	choke := !s.interested
+	if choke == s.amChoking {
+		return nil
+	}
+	s.amChoking = choke
+	t.updatePeer(s.addr, func(p *PeerStats) { p.Unchoked = !choke })
+	if choke {
+		return s.session.SendChoke()
+	}
+	return s.session.SendUnchoke()
+}
+
+// updateInterest tells the peer whether we want pieces, which is the case
+// for as long as the torrent downloads.
+func (t *Torrent) updateInterest(s *peerState) error {
+	want := !t.picker.Closed()
+	if want == s.amInterested {
+		return nil
+	}
+	s.amInterested = want
+	if want {
+		return s.session.SendInterested()
+	}
+	return s.session.SendNotInterested()
+}
+
+// broadcastHave announces a newly verified piece to every connected peer.
+func (t *Torrent) broadcastHave(index int) {
+	t.liveMu.Lock()
+	defer t.liveMu.Unlock()
+	for _, s := range t.sessions {
+		s.SendHave(index)
+	}
+}
+
+// bothSeeds reports whether neither side wants anything from the other,
+// which makes the connection pointless.
+func (t *Torrent) bothSeeds(s *peerState) bool {
+	if !t.picker.Closed() || s.bitfield == nil {
+		return false
+	}
+	return s.bitfield.Count() == len(t.PieceHashes)
+}
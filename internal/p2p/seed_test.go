@@ -0,0 +1,150 @@
+package p2p
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/binary"
+	"math/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"torrent-client/internal/bencode"
+)
+
+// fakeTracker answers UDP announces with a fixed list of peers.
+func fakeTracker(t *testing.T, peers ...*net.TCPAddr) string {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			if n < 16 {
+				continue
+			}
+			action := binary.BigEndian.Uint32(buf[8:12])
+			resp := binary.BigEndian.AppendUint32(nil, action)
+			resp = append(resp, buf[12:16]...)
+			if action == 0 {
+				resp = binary.BigEndian.AppendUint64(resp, 1)
+			} else {
+				resp = append(resp, make([]byte, 12)...)
+				for _, p := range peers {
+					resp = append(resp, p.IP.To4()...)
+					resp = binary.BigEndian.AppendUint16(resp, uint16(p.Port))
+				}
+			}
+			pc.WriteTo(resp, addr)
+		}
+	}()
+	return "udp://" + pc.LocalAddr().String()
+}
+
+// testTorrentFile encodes a single-file torrent of data.
+func testTorrentFile(t *testing.T, announce, name string, data []byte, pieceLength int) []byte {
+	t.Helper()
+	var pieces []byte
+	for off := 0; off < len(data); off += pieceLength {
+		sum := sha1.Sum(data[off:min(off+pieceLength, len(data))])
+		pieces = append(pieces, sum[:]...)
+	}
+	torrent, err := bencode.Encode(bencode.BDict{
+		"announce": bencode.BString(announce),
+		"info": bencode.BDict{
+			"name":         bencode.BString(name),
+			"piece length": bencode.BInt(pieceLength),
+			"length":       bencode.BInt(len(data)),
+			"pieces":       bencode.BString(pieces),
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return torrent
+}
+
+// testManager listens on loopback and keeps its files below dir.
+func testManager(t *testing.T, dir string) *Manager {
+	t.Helper()
+	m := NewManager([20]byte{})
+	cfg := m.Config
+	cfg.ListenAddr = "127.0.0.1:0"
+	cfg.DownloadDir = dir
+	cfg.ResumeDir = ""
+	cfg.EnableUTP = false
+	m.SetConfig(cfg)
+	if err := m.Listen(cfg.ListenAddr); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { m.Close() })
+	return m
+}
+
+func waitFor(t *testing.T, what string, timeout time.Duration, done func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for !done() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestCompleteTorrentSeeds(t *testing.T) {
+	data := make([]byte, 5*MaxBlockSize+123)
+	rand.New(rand.NewSource(3)).Read(data)
+
+	seedDir, leechDir := t.TempDir(), t.TempDir()
+	if err := os.WriteFile(filepath.Join(seedDir, "seeded.bin"), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	seeder, leecher := testManager(t, seedDir), testManager(t, leechDir)
+
+	announce := fakeTracker(t, seeder.listener.Addr().(*net.TCPAddr))
+	torrent := testTorrentFile(t, announce, "seeded.bin", data, 2*MaxBlockSize)
+	if err := seeder.AddTorrent(torrent); err != nil {
+		t.Fatal(err)
+	}
+	var hash string
+	waitFor(t, "the seeder to verify its data", 5*time.Second, func() bool {
+		stats := seeder.GetStats()
+		if len(stats) == 1 && stats[0].Percent == 100 {
+			hash = stats[0].InfoHash
+			return true
+		}
+		return false
+	})
+	seed := seeder.Torrent(hash)
+	if !seed.picker.Closed() {
+		t.Fatal("the seeder's download did not finish")
+	}
+
+	// The seeder is complete before the leecher even shows up.
+	if err := leecher.AddTorrent(torrent); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the leecher to download from the seeder", 20*time.Second, func() bool {
+		stats := leecher.GetStats()
+		return len(stats) == 1 && stats[0].Percent == 100
+	})
+	leecher.Torrent(hash).disk.Flush()
+	got, err := os.ReadFile(filepath.Join(leechDir, "seeded.bin"))
+	if err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("leecher's copy differs: %v", err)
+	}
+	if up := seed.uploaded.Load(); up < int64(len(data)) {
+		t.Errorf("seeder counted %d bytes uploaded, want at least %d", up, len(data))
+	}
+}
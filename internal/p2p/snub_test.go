@@ -0,0 +1,54 @@
+package p2p
+
+import (
+	"testing"
+	"time"
+	"torrent-client/internal/peer"
+)
+
+func TestSnubbedPeerSkipsStalledPiece(t *testing.T) {
+	s := &peerState{
+		snubbed:   true,
+		snubbedOn: map[int]time.Time{1: time.Now().Add(time.Minute)},
+	}
+	if s.canDownload(&pieceWork{index: 1}) {
+		t.Error("snubbed peer was given the piece it stalled on")
+	}
+	if !s.canDownload(&pieceWork{index: 2}) {
+		t.Error("snubbed peer was refused another piece")
+	}
+
+	s.snubbedOn[2] = time.Now().Add(-time.Second)
+	if !s.canDownload(&pieceWork{index: 2}) {
+		t.Error("expired snub still holds the piece back")
+	}
+}
+
+func TestBlockClearsSnub(t *testing.T) {
+	s := &peerState{
+		requested: make(map[blockRequest]bool),
+		snubbed:   true,
+		snubbedOn: map[int]time.Time{1: time.Now().Add(time.Minute)},
+	}
+
+	reject := peer.Event{Type: peer.EventReject, Index: 3, Begin: 0, Length: MaxBlockSize}
+	s.requested[blockRequest{3, 0, MaxBlockSize}] = true
+	if err := s.answered(reject); err != nil {
+		t.Fatal(err)
+	}
+	if !s.snubbed {
+		t.Fatal("a reject lifted the snub")
+	}
+
+	s.requested[blockRequest{3, 0, MaxBlockSize}] = true
+	block := peer.Event{Type: peer.EventPiece, Index: 3, Begin: 0, Length: MaxBlockSize}
+	if err := s.answered(block); err != nil {
+		t.Fatal(err)
+	}
+	if s.snubbed || len(s.snubbedOn) != 0 {
+		t.Error("a delivered block did not lift the snub")
+	}
+	if s.lastBlock.IsZero() {
+		t.Error("lastBlock not updated")
+	}
+}
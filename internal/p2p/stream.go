@@ -0,0 +1,217 @@
+package p2p
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// Reader streams one file of a torrent. Reads block until the pieces they
+// need are verified, and while a Reader is open the pieces just ahead of
+// it jump the queue.
+type Reader struct {
+	t      *Torrent
+	ctx    context.Context
+	file   int
+	offset int64
+	length int64
+	pos    int64
+}
+
+// NewReader opens file of the torrent; single-file torrents have file 0.
+// Reads give up when ctx is done.
+func (t *Torrent) NewReader(ctx context.Context, file int) (*Reader, error) {
+	if file < 0 || file >= t.numFiles() {
+		return nil, fmt.Errorf("torrent has no file %d", file)
+	}
+	t.prioMu.Lock()
+	skipped := t.priorities[file] == PrioritySkip
+	t.prioMu.Unlock()
+	if skipped {
+		return nil, fmt.Errorf("file %d is skipped", file)
+	}
+
+	r := &Reader{t: t, ctx: ctx, file: file, length: int64(t.Length)}
+	if len(t.Files) > 0 {
+		for _, f := range t.Files[:file] {
+			r.offset += f.Length
+		}
+		r.length = t.Files[file].Length
+	}
+	t.setCursor(r, r.offset)
+	return r, nil
+}
+
+// Name is the file's path inside the torrent.
+func (r *Reader) Name() string {
+	if len(r.t.Files) == 0 {
+		return r.t.Name
+	}
+	return strings.Join(r.t.Files[r.file].Path, "/")
+}
+
+func (r *Reader) Read(p []byte) (int, error) {
+	if r.pos >= r.length {
+		return 0, io.EOF
+	}
+	off := r.offset + r.pos
+	pieceLength := int64(r.t.PieceLength)
+	index := int(off / pieceLength)
+	r.t.setCursor(r, off)
+
+	// Stay inside one piece and inside the file.
+	n := min(int64(len(p)), r.length-r.pos, (int64(index)+1)*pieceLength-off)
+	if err := r.t.waitPiece(r.ctx, index); err != nil {
+		return 0, err
+	}
+	read, err := r.t.disk.ReadAt(p[:n], off)
+	r.pos += int64(read)
+	return read, err
+}
+
+func (r *Reader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.pos
+	case io.SeekEnd:
+		offset += r.length
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	r.pos = offset
+	return offset, nil
+}
+
+func (r *Reader) Close() error {
+	r.t.streamMu.Lock()
+	delete(r.t.streams, r)
+	r.t.streamMu.Unlock()
+	return nil
+}
+
+func (t *Torrent) setCursor(r *Reader, off int64) {
+	t.streamMu.Lock()
+	defer t.streamMu.Unlock()
+	if t.streams == nil {
+		t.streams = make(map[*Reader]int)
+	}
+	t.streams[r] = int(off / int64(t.PieceLength))
+}
+
+// waitPiece blocks until piece index is verified.
+func (t *Torrent) waitPiece(ctx context.Context, index int) error {
+	for {
+		t.haveMu.Lock()
+		if t.have.HasPiece(index) {
+			t.haveMu.Unlock()
+			return nil
+		}
+		if t.haveWake == nil {
+			t.haveWake = make(chan struct{})
+		}
+		wake := t.haveWake
+		t.haveMu.Unlock()
+
+		select {
+		case <-wake:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// cursors lists the piece each open stream reads next.
+func (t *Torrent) cursors() []int {
+	t.streamMu.Lock()
+	defer t.streamMu.Unlock()
+	out := make([]int, 0, len(t.streams))
+	for _, cursor := range t.streams {
+		out = append(out, cursor)
+	}
+	return out
+}
+
+// inWindow reports whether a stream at one of cursors will need piece index
+// within the next window pieces.
+func inWindow(cursors []int, window, index int) bool {
+	for _, cursor := range cursors {
+		if index >= cursor && index < cursor+window {
+			return true
+		}
+	}
+	return false
+}
+
+func (t *Torrent) urgent(index int) bool {
+	return inWindow(t.cursors(), t.Config.StreamWindow, index)
+}
+
+// pieceOrder is the picker's order: pieces a stream is about to read first,
+// nearest first, then by file priority, then in sequential mode by index.
+// The streams are looked at once per pick, not per comparison.
+func (t *Torrent) pieceOrder() func(a, b *pieceWork) bool {
+	cursors := t.cursors()
+	window := t.Config.StreamWindow
+	sequential := t.sequential.Load()
+	return func(a, b *pieceWork) bool {
+		ua, ub := inWindow(cursors, window, a.index), inWindow(cursors, window, b.index)
+		if ua != ub {
+			return ua
+		}
+		if ua {
+			return a.index < b.index
+		}
+		if a.priority != b.priority {
+			return a.priority > b.priority
+		}
+		return sequential && a.index < b.index
+	}
+}
+
+// streamDeadline is when an urgent piece taken up now should be in. Past
+// it the piece is also offered to a second peer.
+func (t *Torrent) streamDeadline(index int) time.Time {
+	if t.Config.StreamDeadline <= 0 || !t.urgent(index) {
+		return time.Time{}
+	}
+	return time.Now().Add(t.Config.StreamDeadline)
+}
+
+// requestAgain queues another copy of a late urgent piece so a second peer
+// fetches it alongside the first; whichever finishes first counts.
+func (t *Torrent) requestAgain(index int) {
+	if t.hasPiece(index) || !t.urgent(index) {
+		return
+	}
+	fmt.Printf("   ~ Piece %d missed its stream deadline, asking another peer\n", index)
+	t.picker.Push(t.newPieceWork(index))
+}
+
+// SetSequential makes the torrent download pieces in order, for playing
+// media while it downloads.
+func (t *Torrent) SetSequential(on bool) {
+	t.sequential.Store(on)
+}
+
+func (m *Manager) SetSequential(infoHash string, on bool) error {
+	t := m.Torrent(infoHash)
+	if t == nil {
+		return fmt.Errorf("unknown torrent %s", infoHash)
+	}
+	t.SetSequential(on)
+	return nil
+}
+
+// Torrent looks a torrent up by its hex info hash.
+func (m *Manager) Torrent(infoHash string) *Torrent {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.Torrents[infoHash]
+}
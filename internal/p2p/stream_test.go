@@ -0,0 +1,64 @@
+package p2p
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestStreamPiecesComeFirst(t *testing.T) {
+	data := bytes.Repeat([]byte{1}, 8*MaxBlockSize)
+	meta := testMeta("video.bin", data, MaxBlockSize, nil)
+	cfg := DefaultConfig()
+	cfg.StreamWindow = 2
+	tor := newFileTorrent(t, t.TempDir(), meta, cfg)
+	for i := range tor.PieceHashes {
+		tor.picker.Push(tor.newPieceWork(i))
+	}
+
+	r := &Reader{t: tor}
+	tor.setCursor(r, 5*MaxBlockSize)
+	tor.SetSequential(true)
+
+	var order []int
+	for pw := tor.picker.Pick(func(*pieceWork) bool { return true }); pw != nil; pw = tor.picker.Pick(func(*pieceWork) bool { return true }) {
+		order = append(order, pw.index)
+	}
+	want := []int{5, 6, 0, 1, 2, 3, 4, 7}
+	for i := range want {
+		if order[i] != want[i] {
+			t.Fatalf("picked %v, want %v", order, want)
+		}
+	}
+}
+
+func TestLateStreamPieceIsRequestedAgain(t *testing.T) {
+	data := bytes.Repeat([]byte{2}, 4*MaxBlockSize)
+	meta := testMeta("late.bin", data, MaxBlockSize, nil)
+	cfg := DefaultConfig()
+	cfg.StreamDeadline = time.Second
+	tor := newFileTorrent(t, t.TempDir(), meta, cfg)
+
+	if !tor.streamDeadline(1).IsZero() {
+		t.Error("a piece nobody streams got a deadline")
+	}
+	r := &Reader{t: tor}
+	tor.setCursor(r, 0)
+	if d := tor.streamDeadline(1); d.IsZero() || time.Until(d) > time.Second {
+		t.Errorf("deadline %v for a streamed piece", d)
+	}
+
+	tor.requestAgain(1)
+	if pending := pendingPieces(tor.picker); len(pending) != 1 || pending[0] != 1 {
+		t.Fatalf("pending %v after the deadline, want [1]", pending)
+	}
+
+	// Nothing more once the piece is in or the stream moved on.
+	tor.markHave(1)
+	tor.requestAgain(1)
+	r.Close()
+	tor.requestAgain(2)
+	if pending := pendingPieces(tor.picker); len(pending) != 1 {
+		t.Errorf("pending %v, want only the first copy", pending)
+	}
+}
@@ -0,0 +1,182 @@
+package p2p
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"runtime"
+	"sync"
+	"time"
+	"torrent-client/internal/peer"
+)
+
+// ioThrottle spaces out reads so hashing does not saturate the disk. It is
+// shared by all verification workers of a torrent.
+type ioThrottle struct {
+	mu   sync.Mutex
+	rate int64
+	next time.Time
+}
+
+func newIOThrottle(bytesPerSecond int64) *ioThrottle {
+	return &ioThrottle{rate: bytesPerSecond}
+}
+
+func (l *ioThrottle) wait(n int) {
+	if l.rate <= 0 {
+		return
+	}
+	l.mu.Lock()
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	delay := l.next.Sub(now)
+	l.next = l.next.Add(time.Duration(int64(n) * int64(time.Second) / l.rate))
+	l.mu.Unlock()
+
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+}
+
+// verifyPieces hashes the given pieces from storage on a pool of workers
+// and returns the ones that match. Progress shows up in TorrentStats while
+// it runs.
+func (t *Torrent) verifyPieces(indexes []int) peer.Bitfield {
+	good := peer.NewBitfield(len(t.PieceHashes))
+	if len(indexes) == 0 {
+		return good
+	}
+
+	t.checkTotal.Store(int64(len(indexes)))
+	t.checkDone.Store(0)
+	t.checking.Store(true)
+	defer t.checking.Store(false)
+
+	workers := t.Config.VerifyWorkers
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+	throttle := newIOThrottle(t.Config.VerifyRate)
+
+	jobs := make(chan int)
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			buf := make([]byte, t.PieceLength)
+			for index := range jobs {
+				length := t.calculatePieceSize(index)
+				throttle.wait(length)
+				ok := t.checkPieceOnDisk(index, buf[:length])
+				if ok {
+					mu.Lock()
+					good.SetPiece(index)
+					mu.Unlock()
+				}
+				t.checkDone.Add(1)
+			}
+		}()
+	}
+	for _, index := range indexes {
+		jobs <- index
+	}
+	close(jobs)
+	wg.Wait()
+	return good
+}
+
+// checkPieceOnDisk reads piece index into buf, which must be exactly the
+// piece's length, and compares its hash.
+func (t *Torrent) checkPieceOnDisk(index int, buf []byte) bool {
+	_, err := t.store.ReadAt(buf, int64(index)*int64(t.PieceLength))
+	if err != nil {
+		return false
+	}
+	return sha1.Sum(buf) == t.PieceHashes[index]
+}
+
+func (t *Torrent) checkProgress() float64 {
+	total := t.checkTotal.Load()
+	if total == 0 {
+		return 0
+	}
+	return float64(t.checkDone.Load()) / float64(total) * 100
+}
+
+// Recheck hashes every piece again while the torrent keeps running. Peers
+// are dropped for the duration; pieces that turn out bad are downloaded
+// again and pieces found complete are no longer requested.
+func (t *Torrent) Recheck() error {
+	if !t.recheckMu.TryLock() {
+		return fmt.Errorf("%s is already being checked", t.Name)
+	}
+	defer t.recheckMu.Unlock()
+
+	if t.haveSnapshot() == nil {
+		return fmt.Errorf("%s has not started yet", t.Name)
+	}
+
+	// Only the user's pause is borrowed; an error or the kill switch stay
+	// as they are.
+	wasPaused := t.paused.Swap(true)
+	defer t.paused.Store(wasPaused)
+
+	all := make([]int, len(t.PieceHashes))
+	for i := range all {
+		all[i] = i
+	}
+	fmt.Printf("Rechecking %s...\n", t.Name)
+	t.disk.Flush()
+	good := t.verifyPieces(all)
+
+	t.haveMu.Lock()
+	old := t.have
+	t.have = good
+	t.wakeHave()
+	t.haveMu.Unlock()
+
+	t.picker.Update(func(pw *pieceWork) bool { return good.HasPiece(pw.index) })
+	bytes, missing := 0, 0
+	for index := range t.PieceHashes {
+		length := t.calculatePieceSize(index)
+		if good.HasPiece(index) {
+			t.markComplete(index)
+			bytes += length
+			continue
+		}
+		missing++
+		if old.HasPiece(index) && t.piecePriority(index) != PrioritySkip {
+			t.queuePiece(t.newPieceWork(index))
+		}
+	}
+	t.BytesDownloaded.Store(int64(bytes))
+	fmt.Printf("Recheck of %s done: %d pieces missing\n", t.Name, missing)
+
+	select {
+	case t.rechecked <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Recheck runs Torrent.Recheck on the torrent with the given hex info hash
+// in the background.
+func (m *Manager) Recheck(infoHash string) error {
+	t := m.Torrent(infoHash)
+	if t == nil {
+		return fmt.Errorf("unknown torrent %s", infoHash)
+	}
+	if t.checking.Load() {
+		return fmt.Errorf("%s is already being checked", t.Name)
+	}
+
+	go func() {
+		if err := t.Recheck(); err != nil {
+			fmt.Printf("Recheck failed: %v\n", err)
+		}
+	}()
+	return nil
+}
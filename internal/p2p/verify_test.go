@@ -0,0 +1,87 @@
+package p2p
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func pendingPieces(p *piecePicker) []int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var out []int
+	for _, pw := range p.pending {
+		out = append(out, pw.index)
+	}
+	return out
+}
+
+func TestRecheckShortLastPiece(t *testing.T) {
+	// Three full pieces and a last one of 100 bytes.
+	data := bytes.Repeat([]byte("recheck!"), (3*MaxBlockSize+100)/8)
+	data = append(data, "tail"...)
+	meta := testMeta("short.bin", data, MaxBlockSize, nil)
+	tor := newFileTorrent(t, t.TempDir(), meta, DefaultConfig())
+	if _, err := tor.store.WriteAt(data, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := tor.Recheck(); err != nil {
+		t.Fatal(err)
+	}
+	if got := tor.haveSnapshot().Count(); got != 4 {
+		t.Fatalf("recheck found %d of 4 pieces", got)
+	}
+	if tor.BytesDownloaded.Load() != int64(len(data)) {
+		t.Errorf("BytesDownloaded = %d, want %d", tor.BytesDownloaded.Load(), len(data))
+	}
+
+	// Damage the last byte of the short piece.
+	if _, err := tor.store.WriteAt([]byte{0}, int64(len(data)-1)); err != nil {
+		t.Fatal(err)
+	}
+	if err := tor.Recheck(); err != nil {
+		t.Fatal(err)
+	}
+	have := tor.haveSnapshot()
+	if have.HasPiece(3) || !have.HasPiece(2) {
+		t.Errorf("have %08b after damaging the last piece", have)
+	}
+	if tor.BytesDownloaded.Load() != 3*MaxBlockSize {
+		t.Errorf("BytesDownloaded = %d, want %d", tor.BytesDownloaded.Load(), 3*MaxBlockSize)
+	}
+	if pending := pendingPieces(tor.picker); len(pending) != 1 || pending[0] != 3 {
+		t.Errorf("queued %v for download, want [3]", pending)
+	}
+}
+
+func TestRecheckKeepsPauseState(t *testing.T) {
+	data := bytes.Repeat([]byte{9}, 2*MaxBlockSize)
+	meta := testMeta("paused.bin", data, MaxBlockSize, nil)
+	tor := newFileTorrent(t, t.TempDir(), meta, DefaultConfig())
+
+	tor.Pause()
+	if err := tor.Recheck(); err != nil {
+		t.Fatal(err)
+	}
+	if !tor.Paused() {
+		t.Error("recheck resumed a paused torrent")
+	}
+
+	tor.Resume()
+	tor.setError(errors.New("disk full"))
+	if err := tor.Recheck(); err != nil {
+		t.Fatal(err)
+	}
+	if tor.Err() == nil {
+		t.Error("recheck cleared the torrent's error")
+	}
+
+	tor.Resume()
+	if err := tor.Recheck(); err != nil {
+		t.Fatal(err)
+	}
+	if tor.Paused() {
+		t.Error("recheck left a running torrent paused")
+	}
+}
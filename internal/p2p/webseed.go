@@ -0,0 +1,191 @@
+package p2p
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+	"torrent-client/internal/peer"
+)
+
+const webSeedTimeout = 60 * time.Second
+
+// fileSpan is the part of one file that a piece covers.
+type fileSpan struct {
+	file   int
+	offset int64
+	length int64
+}
+
+// pieceSpans maps the byte range [begin, begin+length) of the torrent onto
+// its files. Single-file torrents have one implicit file.
+func (t *Torrent) pieceSpans(begin, length int64) []fileSpan {
+	if len(t.Files) == 0 {
+		return []fileSpan{{file: 0, offset: begin, length: length}}
+	}
+
+	var spans []fileSpan
+	var fileStart int64
+	for i, f := range t.Files {
+		fileEnd := fileStart + f.Length
+		if begin < fileEnd && begin+length > fileStart && f.Length > 0 {
+			from := max(begin, fileStart)
+			to := min(begin+length, fileEnd)
+			spans = append(spans, fileSpan{file: i, offset: from - fileStart, length: to - from})
+		}
+		fileStart = fileEnd
+	}
+	return spans
+}
+
+// webSeedURL follows BEP 19: a base ending in a slash gets the torrent name
+// (and for multi-file torrents the file path) appended, otherwise a
+// single-file URL is used as is.
+func (t *Torrent) webSeedURL(base string, file int) string {
+	if len(t.Files) == 0 {
+		if strings.HasSuffix(base, "/") {
+			return base + url.PathEscape(t.Name)
+		}
+		return base
+	}
+
+	if !strings.HasSuffix(base, "/") {
+		base += "/"
+	}
+	parts := []string{url.PathEscape(t.Name)}
+	for _, p := range t.Files[file].Path {
+		parts = append(parts, url.PathEscape(p))
+	}
+	return base + strings.Join(parts, "/")
+}
+
+func (t *Torrent) webSeedLoop(base string) {
+	t.seedLoop(base, "Web seed", t.fetchPiece)
+}
+
+// seedLoop downloads whole pieces from one HTTP server, sharing the picker
+// with the peers. Failures, including pieces that fail the hash check,
+// back the server off exponentially unless it said how long to wait.
+func (t *Torrent) seedLoop(base, kind string, fetch func(*http.Client, string, *pieceWork) ([]byte, error)) {
+	client := t.Config.network().HTTPClient(webSeedTimeout)
+	t.trackWebSeed(base, kind)
+	defer t.untrackPeer(base)
+
+	failures := 0
+	for !t.picker.Closed() {
+		if t.Paused() {
+			t.waitOrDone(time.Second)
+			continue
+		}
+
+		wake := t.picker.Wait()
+		pw := t.picker.Pick(func(pw *pieceWork) bool { return true })
+		if pw == nil {
+			<-wake
+			continue
+		}
+
+		data, err := fetch(client, base, pw)
+		if err == nil {
+			progress := peer.PieceProgress{Index: pw.index, Buffer: data}
+			err = progress.CheckHash(pw.hash)
+		}
+		if err != nil {
+			t.picker.Push(pw)
+			var busy *retryAfterError
+			delay := time.Duration(0)
+			if errors.As(err, &busy) {
+				delay = busy.wait
+			} else {
+				failures++
+				delay = retryBackoff(failures, t.Config)
+			}
+			fmt.Printf("   X %s %s failed on piece %d: %v (retry in %s)\n", kind, base, pw.index, err, delay)
+			t.waitOrDone(delay)
+			continue
+		}
+
+		failures = 0
+		if pw.suspect != nil {
+			t.attributeBadBlocks(pw, data)
+		}
+		t.updatePeer(base, func(p *PeerStats) { p.Downloaded += pw.length })
+		select {
+		case t.results <- &pieceResult{index: pw.index, data: data}:
+		case <-t.picker.Done():
+		}
+	}
+}
+
+func (t *Torrent) fetchPiece(client *http.Client, base string, pw *pieceWork) ([]byte, error) {
+	data := make([]byte, 0, pw.length)
+	begin := int64(pw.index) * int64(t.PieceLength)
+	for _, span := range t.pieceSpans(begin, int64(pw.length)) {
+		var err error
+		data, err = fetchRange(client, t.webSeedURL(base, span.file), span.offset, span.length, data)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(data) != pw.length {
+		return nil, fmt.Errorf("got %d bytes, want %d", len(data), pw.length)
+	}
+	return data, nil
+}
+
+// fetchRange appends length bytes of the resource at rawURL, starting at
+// offset, to buf.
+func fetchRange(client *http.Client, rawURL string, offset, length int64, buf []byte) ([]byte, error) {
+	req, err := http.NewRequest("GET", rawURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+length-1))
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body := io.Reader(resp.Body)
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+	case http.StatusOK:
+		// The server ignored the range and sent the whole file.
+		if _, err := io.CopyN(io.Discard, body, offset); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("%s: %s", rawURL, resp.Status)
+	}
+
+	start := len(buf)
+	buf = append(buf, make([]byte, length)...)
+	if _, err := io.ReadFull(body, buf[start:]); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+func (t *Torrent) trackWebSeed(base, kind string) {
+	t.liveMu.Lock()
+	defer t.liveMu.Unlock()
+	if t.live == nil {
+		t.live = make(map[string]*PeerStats)
+	}
+	t.live[base] = &PeerStats{Addr: base, Client: kind}
+}
+
+// waitOrDone sleeps for d unless the download finishes first.
+func (t *Torrent) waitOrDone(d time.Duration) {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-t.picker.Done():
+	}
+}
@@ -0,0 +1,227 @@
+package p2p
+
+import (
+	"bytes"
+	"errors"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"torrent-client/internal/metainfo"
+)
+
+func TestWebSeedURL(t *testing.T) {
+	single := &Torrent{Name: "my file.iso"}
+	multi := &Torrent{Name: "album", Files: []metainfo.File{
+		{Path: []string{"cover.jpg"}, Length: 1},
+		{Path: []string{"disc 1", "track#1.flac"}, Length: 1},
+	}}
+
+	tests := []struct {
+		tor  *Torrent
+		base string
+		file int
+		want string
+	}{
+		{single, "http://example.org/mirror/file.iso", 0, "http://example.org/mirror/file.iso"},
+		{single, "http://example.org/mirror/", 0, "http://example.org/mirror/my%20file.iso"},
+		{multi, "http://example.org/mirror/", 0, "http://example.org/mirror/album/cover.jpg"},
+		{multi, "http://example.org/mirror", 1, "http://example.org/mirror/album/disc%201/track%231.flac"},
+	}
+	for _, tt := range tests {
+		if got := tt.tor.webSeedURL(tt.base, tt.file); got != tt.want {
+			t.Errorf("webSeedURL(%q, %d) = %q, want %q", tt.base, tt.file, got, tt.want)
+		}
+	}
+}
+
+func TestPieceSpans(t *testing.T) {
+	tor := &Torrent{Files: []metainfo.File{
+		{Path: []string{"a"}, Length: 100},
+		{Path: []string{"empty"}, Length: 0},
+		{Path: []string{"b"}, Length: 50},
+		{Path: []string{"c"}, Length: 200},
+	}}
+
+	got := tor.pieceSpans(90, 100)
+	want := []fileSpan{{0, 90, 10}, {2, 0, 50}, {3, 0, 40}}
+	if len(got) != len(want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("got %v, want %v", got, want)
+		}
+	}
+}
+
+// webSeedTorrent is a multi-file torrent whose pieces straddle its files,
+// one of them empty, with the data a server would hold for it.
+func webSeedTorrent(t *testing.T) (*Torrent, map[string][]byte, []byte) {
+	t.Helper()
+	files := []metainfo.File{
+		{Path: []string{"a.bin"}, Length: 3000},
+		{Path: []string{"sub dir", "empty"}, Length: 0},
+		{Path: []string{"sub dir", "b.bin"}, Length: 5000},
+		{Path: []string{"c.bin"}, Length: 700},
+	}
+	data := make([]byte, 8700)
+	rand.New(rand.NewSource(7)).Read(data)
+
+	content := make(map[string][]byte)
+	off := 0
+	for _, f := range files {
+		content["/seed/pack/"+strings.Join(f.Path, "/")] = data[off : off+int(f.Length)]
+		off += int(f.Length)
+	}
+	meta := testMeta("pack", data, 4096, files)
+	return newFileTorrent(t, t.TempDir(), meta, DefaultConfig()), content, data
+}
+
+// fileServer serves content with range support; ignoreRange makes it send
+// whole files instead.
+func fileServer(t *testing.T, content map[string][]byte, ignoreRange bool) *httptest.Server {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, ok := content[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		if ignoreRange {
+			w.Write(body)
+			return
+		}
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(body))
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestWebSeedFetchesAcrossFiles(t *testing.T) {
+	for _, ignoreRange := range []bool{false, true} {
+		tor, content, data := webSeedTorrent(t)
+		srv := fileServer(t, content, ignoreRange)
+		client := srv.Client()
+
+		for i := range tor.PieceHashes {
+			pw := tor.newPieceWork(i)
+			got, err := tor.fetchPiece(client, srv.URL+"/seed/", pw)
+			if err != nil {
+				t.Fatalf("ignoreRange %v, piece %d: %v", ignoreRange, i, err)
+			}
+			begin := i * tor.PieceLength
+			if !bytes.Equal(got, data[begin:begin+pw.length]) {
+				t.Fatalf("ignoreRange %v, piece %d: wrong data", ignoreRange, i)
+			}
+		}
+	}
+}
+
+func TestWebSeedSingleFile(t *testing.T) {
+	data := make([]byte, 5000)
+	rand.New(rand.NewSource(8)).Read(data)
+	tor := newFileTorrent(t, t.TempDir(), testMeta("single file.bin", data, 4096, nil), DefaultConfig())
+	srv := fileServer(t, map[string][]byte{
+		"/dir/single file.bin": data,
+		"/exact.bin":           data,
+	}, false)
+
+	for _, base := range []string{srv.URL + "/dir/", srv.URL + "/exact.bin"} {
+		pw := tor.newPieceWork(1)
+		got, err := tor.fetchPiece(srv.Client(), base, pw)
+		if err != nil {
+			t.Fatalf("%s: %v", base, err)
+		}
+		if !bytes.Equal(got, data[4096:]) {
+			t.Fatalf("%s: wrong data", base)
+		}
+	}
+}
+
+func TestWebSeedBadResponses(t *testing.T) {
+	tor, content, _ := webSeedTorrent(t)
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+	}{
+		{"missing file", func(w http.ResponseWriter, r *http.Request) {
+			http.NotFound(w, r)
+		}},
+		{"server error", func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, "broken", http.StatusInternalServerError)
+		}},
+		{"short range", func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusPartialContent)
+			w.Write(content[r.URL.Path][:10])
+		}},
+		{"short file", func(w http.ResponseWriter, r *http.Request) {
+			w.Write(content[r.URL.Path][:10])
+		}},
+	}
+	for _, tt := range tests {
+		srv := httptest.NewServer(tt.handler)
+		_, err := tor.fetchPiece(srv.Client(), srv.URL+"/seed/", tor.newPieceWork(0))
+		srv.Close()
+		if err == nil {
+			t.Errorf("%s: no error", tt.name)
+		}
+	}
+}
+
+func TestSeedLoopBacksOff(t *testing.T) {
+	data := make([]byte, 4096)
+	rand.New(rand.NewSource(9)).Read(data)
+	cfg := DefaultConfig()
+	cfg.RetryBackoff = 100 * time.Millisecond
+	cfg.MaxRetryBackoff = time.Second
+	tor := newFileTorrent(t, t.TempDir(), testMeta("backoff.bin", data, 4096, nil), cfg)
+	tor.picker.Push(tor.newPieceWork(0))
+
+	// A failed request, then a corrupt piece, then the real one.
+	var mu sync.Mutex
+	var times []time.Time
+	fetch := func(_ *http.Client, _ string, pw *pieceWork) ([]byte, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		times = append(times, time.Now())
+		switch len(times) {
+		case 1:
+			return nil, errors.New("connection reset")
+		case 2:
+			return make([]byte, pw.length), nil
+		}
+		return data, nil
+	}
+	done := make(chan struct{})
+	go func() {
+		tor.seedLoop("http://seed.example/", "Web seed", fetch)
+		close(done)
+	}()
+
+	select {
+	case res := <-tor.results:
+		if res.index != 0 || !bytes.Equal(res.data, data) {
+			t.Fatal("wrong piece delivered")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("piece never arrived")
+	}
+	tor.picker.Close()
+	<-done
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(times) != 3 {
+		t.Fatalf("%d requests, want 3", len(times))
+	}
+	if gap := times[1].Sub(times[0]); gap < cfg.RetryBackoff {
+		t.Errorf("retried after %s, want at least %s", gap, cfg.RetryBackoff)
+	}
+	if gap := times[2].Sub(times[1]); gap < 2*cfg.RetryBackoff {
+		t.Errorf("retried a bad piece after %s, want at least %s", gap, 2*cfg.RetryBackoff)
+	}
+}
@@ -2,6 +2,30 @@ package peer
 
 type Bitfield []byte
 
+func NewBitfield(numPieces int) Bitfield {
+	return make(Bitfield, (numPieces+7)/8)
+}
+
+// FullBitfield has every piece set, with the spare bits of the last byte
+// left clear as the wire format requires.
+func FullBitfield(numPieces int) Bitfield {
+	bf := NewBitfield(numPieces)
+	for i := 0; i < numPieces; i++ {
+		bf.SetPiece(i)
+	}
+	return bf
+}
+
+func (bf Bitfield) Count() int {
+	n := 0
+	for _, b := range bf {
+		for ; b != 0; b &= b - 1 {
+			n++
+		}
+	}
+	return n
+}
+
 func (bf Bitfield) HasPiece(index int) bool {
 	byteIndex := index / 8
 	offset := index % 8
@@ -19,3 +43,12 @@ func (bf Bitfield) SetPiece(index int) {
 	}
 	bf[byteIndex] |= 1 << (7 - offset)
 }
+
+func (bf Bitfield) ClearPiece(index int) {
+	byteIndex := index / 8
+	offset := index % 8
+	if byteIndex < 0 || byteIndex >= len(bf) {
+		return
+	}
+	bf[byteIndex] &^= 1 << (7 - offset)
+}
@@ -2,13 +2,11 @@ package peer
 
 import (
 	"crypto/sha1"
-	"encoding/binary"
 	"fmt"
-	"net"
 )
 
 type PeerConnection struct {
-	Conn     net.Conn
+	Session  *Session
 	Choked   bool
 	Bitfield Bitfield
 	PeerID   [20]byte
@@ -38,32 +36,23 @@ func (p *PieceProgress) CheckHash(expected [20]byte) error {
 }
 
 func (pc *PeerConnection) SendRequest(index, begin, length int) error {
-	reqPayload := FormatRequest(index, begin, length)
-	msg := &Message{ID: MsgRequest, Payload: reqPayload}
-	_, err := pc.Conn.Write(msg.Serialize())
-	return err
+	return pc.Session.SendRequest(index, begin, length)
 }
 
 func (pc *PeerConnection) SendInterested() error {
-	msg := &Message{ID: MsgInterested}
-	_, err := pc.Conn.Write(msg.Serialize())
-	return err
+	return pc.Session.SendInterested()
 }
 
-// AddBlock parses the MsgPiece payload and copies the data into the buffer
-func (p *PieceProgress) AddBlock(payload []byte) error {
-	if len(payload) < 8 {
-		return fmt.Errorf("payload too short")
+// AddBlock copies a received block into the piece buffer.
+func (p *PieceProgress) AddBlock(index, begin int, block []byte) error {
+	if index != p.Index {
+		return fmt.Errorf("block for piece %d, expected piece %d", index, p.Index)
 	}
-	// First 4 bytes: index, Second 4 bytes: begin (offset)
-	begin := int(binary.BigEndian.Uint32(payload[4:8]))
-	data := payload[8:]
-
-	if begin+len(data) > len(p.Buffer) {
+	if begin < 0 || begin+len(block) > len(p.Buffer) {
 		return fmt.Errorf("data out of bounds")
 	}
 
-	copy(p.Buffer[begin:], data)
-	p.Downloaded += len(data)
+	copy(p.Buffer[begin:], block)
+	p.Downloaded += len(block)
 	return nil
 }
@@ -0,0 +1,161 @@
+package peer
+
+import (
+	"fmt"
+	"strings"
+)
+
+// azureusClients maps the two-letter codes of -XX1234- style peer IDs.
+var azureusClients = map[string]string{
+	"7T": "aTorrent",
+	"AG": "Ares",
+	"AZ": "Azureus",
+	"BC": "BitComet",
+	"BI": "BiglyBT",
+	"BT": "BitTorrent",
+	"DE": "Deluge",
+	"FD": "Free Download Manager",
+	"GT": "Simple Torrent",
+	"KT": "KTorrent",
+	"LT": "libtorrent",
+	"lt": "libTorrent",
+	"PI": "PicoTorrent",
+	"qB": "qBittorrent",
+	"RT": "rTorrent",
+	"SD": "Thunder",
+	"TL": "Tribler",
+	"TR": "Transmission",
+	"UM": "µTorrent Mac",
+	"UT": "µTorrent",
+	"UW": "µTorrent Web",
+	"VG": "Vagaa",
+	"WW": "WebTorrent",
+	"XL": "Xunlei",
+}
+
+// shadowClients maps the leading letter of Shadow style IDs.
+var shadowClients = map[byte]string{
+	'A': "ABC",
+	'O': "Osprey Permaseed",
+	'Q': "BTQueue",
+	'R': "Tribler",
+	'S': "Shadow",
+	'T': "BitTornado",
+	'U': "UPnP NAT Bit Torrent",
+}
+
+const shadowDigits = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz.-"
+
+// ClientName describes the client behind a peer ID, e.g. "qBittorrent
+// 4.5.0". It returns "" when the ID follows no known convention.
+func ClientName(id [20]byte) string {
+	if name := azureusName(id); name != "" {
+		return name
+	}
+	if name := mainlineName(id); name != "" {
+		return name
+	}
+	return shadowName(id)
+}
+
+func azureusName(id [20]byte) string {
+	if id[0] != '-' || id[7] != '-' {
+		return ""
+	}
+	code, ver := string(id[1:3]), id[3:7]
+	for _, c := range ver {
+		if !isAlnum(c) {
+			return ""
+		}
+	}
+
+	name, ok := azureusClients[code]
+	if !ok {
+		name = code
+	}
+
+	if code == "TR" {
+		return name + " " + transmissionVersion(ver)
+	}
+	parts := []string{versionDigit(ver[0]), versionDigit(ver[1]), versionDigit(ver[2])}
+	if ver[3] != '0' {
+		parts = append(parts, versionDigit(ver[3]))
+	}
+	return name + " " + strings.Join(parts, ".")
+}
+
+// transmissionVersion follows libtransmission's own decoder. Before 4.0
+// the ID held a major digit and a two-digit minor (-TR294Z- is 2.94+,
+// -TR3000- is 3.00, with 0.x spelled -TR0072- or -TR0006-); from 4.0 on
+// every field gets one digit, so -TR4050- is 4.0.5.
+func transmissionVersion(ver []byte) string {
+	suffix := ""
+	if ver[3] == 'Z' || ver[3] == 'X' {
+		suffix = "+"
+	}
+	switch {
+	case string(ver[0:3]) == "000":
+		return fmt.Sprintf("0.%c", ver[3])
+	case string(ver[0:2]) == "00":
+		return fmt.Sprintf("0.%s", ver[2:4])
+	case ver[0] <= '3':
+		return fmt.Sprintf("%c.%s%s", ver[0], ver[1:3], suffix)
+	}
+	return fmt.Sprintf("%s.%s.%s%s", versionDigit(ver[0]), versionDigit(ver[1]), versionDigit(ver[2]), suffix)
+}
+
+// mainlineName decodes the BitTorrent mainline form M4-3-6--.
+func mainlineName(id [20]byte) string {
+	if id[0] != 'M' {
+		return ""
+	}
+	fields := strings.SplitN(string(id[1:8]), "-", 4)
+	if len(fields) < 3 {
+		return ""
+	}
+	for _, f := range fields[:3] {
+		if f == "" || strings.Trim(f, "0123456789") != "" {
+			return ""
+		}
+	}
+	return "Mainline " + strings.Join(fields[:3], ".")
+}
+
+// shadowName decodes IDs like S58B----- where each version character is
+// an index into shadowDigits.
+func shadowName(id [20]byte) string {
+	name, ok := shadowClients[id[0]]
+	if !ok {
+		return ""
+	}
+	var parts []string
+	for _, c := range id[1:6] {
+		if c == '-' {
+			break
+		}
+		n := strings.IndexByte(shadowDigits, c)
+		if n < 0 {
+			return ""
+		}
+		parts = append(parts, fmt.Sprint(n))
+	}
+	if len(parts) == 0 || !strings.HasPrefix(string(id[1+len(parts):]), "--") {
+		return ""
+	}
+	return name + " " + strings.Join(parts, ".")
+}
+
+func versionDigit(c byte) string {
+	if c >= '0' && c <= '9' {
+		return string(c)
+	}
+	// Some clients continue past 9 with letters.
+	if c >= 'A' && c <= 'Z' {
+		return fmt.Sprint(int(c-'A') + 10)
+	}
+	return fmt.Sprint(int(c-'a') + 36)
+}
+
+func isAlnum(c byte) bool {
+	return c >= '0' && c <= '9' || c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z'
+}
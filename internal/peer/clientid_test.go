@@ -0,0 +1,49 @@
+package peer
+
+import "testing"
+
+func peerID(prefix string) [20]byte {
+	var id [20]byte
+	copy(id[:], prefix+"abcdefghijklmnopqrst")
+	return id
+}
+
+func TestClientName(t *testing.T) {
+	tests := []struct {
+		prefix string
+		want   string
+	}{
+		{"-qB4500-", "qBittorrent 4.5.0"},
+		{"-LT2090-", "libtorrent 2.0.9"},
+		{"-lt0D80-", "libTorrent 0.13.8"},
+		{"-UT3550-", "µTorrent 3.5.5"},
+		{"-DE2110-", "Deluge 2.1.1"},
+		{"-AZ5781-", "Azureus 5.7.8.1"},
+		{"-BI3600-", "BiglyBT 3.6.0"},
+		{"-GT0001-", "Simple Torrent 0.0.0.1"},
+		{"-XX1200-", "XX 1.2.0"},
+		{"-TR4050-", "Transmission 4.0.5"},
+		{"-TR4060-", "Transmission 4.0.6"},
+		{"-TR410Z-", "Transmission 4.1.0+"},
+		{"-TR3000-", "Transmission 3.00"},
+		{"-TR2940-", "Transmission 2.94"},
+		{"-TR133Z-", "Transmission 1.33+"},
+		{"-TR0072-", "Transmission 0.72"},
+		{"-TR0006-", "Transmission 0.6"},
+		{"M4-3-6--", "Mainline 4.3.6"},
+		{"M7-10-3-", "Mainline 7.10.3"},
+		{"S58B-----", "Shadow 5.8.11"},
+		{"T03I-----", "BitTornado 0.3.18"},
+		{"A123-----", "ABC 1.2.3"},
+		{"-qB45!0-", ""},
+		{"-qB4500", ""},
+		{"Mabc----", ""},
+		{"Z123-----", ""},
+		{"\x00\x00\x00\x00\x00\x00\x00\x00", ""},
+	}
+	for _, tt := range tests {
+		if got := ClientName(peerID(tt.prefix)); got != tt.want {
+			t.Errorf("ClientName(%q) = %q, want %q", tt.prefix, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package peer
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"sync"
+)
+
+// Piece payloads of a standard 16 KiB block come from blockPool so a busy
+// download does not allocate per block. Larger blocks fall back to the heap.
+const pooledPayloadSize = 8 + 16*1024
+
+var blockPool = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, pooledPayloadSize)
+		return &b
+	},
+}
+
+func getPayload(n int) *[]byte {
+	if n > pooledPayloadSize {
+		b := make([]byte, n)
+		return &b
+	}
+	b := blockPool.Get().(*[]byte)
+	*b = (*b)[:n]
+	return b
+}
+
+func putPayload(b *[]byte) {
+	if cap(*b) == pooledPayloadSize {
+		blockPool.Put(b)
+	}
+}
+
+// Reader decodes frames from a buffered stream. Control messages are read
+// into a scratch buffer that is reused on every call, while piece payloads
+// are taken from a pool and handed to the caller.
+type Reader struct {
+	br      *bufio.Reader
+	max     uint32
+	hdr     [5]byte
+	scratch []byte
+	msg     Message
+	pooled  *[]byte
+}
+
+func NewReader(r io.Reader, maxLength uint32) *Reader {
+	return &Reader{br: bufio.NewReaderSize(r, 64*1024), max: maxLength}
+}
+
+// Next reads one frame, returning nil for keep-alives. The message is only
+// valid until the following call, except for piece payloads claimed with
+// TakePayload.
+func (r *Reader) Next() (*Message, error) {
+	if r.pooled != nil {
+		putPayload(r.pooled)
+		r.pooled = nil
+	}
+
+	if _, err := io.ReadFull(r.br, r.hdr[:4]); err != nil {
+		return nil, err
+	}
+	length := binary.BigEndian.Uint32(r.hdr[:4])
+	if length == 0 {
+		return nil, nil
+	}
+	if _, err := io.ReadFull(r.br, r.hdr[4:]); err != nil {
+		return nil, err
+	}
+	id := messageID(r.hdr[4])
+	if length > r.max {
+		return nil, protocolErrorf(id, "frame of %d bytes exceeds the %d byte limit", length, r.max)
+	}
+
+	n := int(length - 1)
+	var payload []byte
+	if id == MsgPiece {
+		r.pooled = getPayload(n)
+		payload = *r.pooled
+	} else {
+		if cap(r.scratch) < n {
+			r.scratch = make([]byte, n)
+		}
+		payload = r.scratch[:n]
+	}
+	if _, err := io.ReadFull(r.br, payload); err != nil {
+		return nil, err
+	}
+
+	r.msg = Message{ID: id, Payload: payload}
+	return &r.msg, nil
+}
+
+// TakePayload hands ownership of the current piece payload to the caller,
+// who returns it with Event.Release.
+func (r *Reader) TakePayload() *[]byte {
+	b := r.pooled
+	r.pooled = nil
+	return b
+}
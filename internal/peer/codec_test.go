@@ -0,0 +1,107 @@
+package peer
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+const blockSize = 16 * 1024
+
+func pieceFrame(index, begin int, block []byte) []byte {
+	payload := binary.BigEndian.AppendUint32(nil, uint32(index))
+	payload = binary.BigEndian.AppendUint32(payload, uint32(begin))
+	payload = append(payload, block...)
+	return (&Message{ID: MsgPiece, Payload: payload}).Serialize()
+}
+
+// loopReader replays the same bytes forever without allocating.
+type loopReader struct {
+	data []byte
+	off  int
+}
+
+func (r *loopReader) Read(p []byte) (int, error) {
+	n := copy(p, r.data[r.off:])
+	r.off = (r.off + n) % len(r.data)
+	return n, nil
+}
+
+func TestReaderDecodesFrames(t *testing.T) {
+	block := bytes.Repeat([]byte{7}, blockSize)
+	var stream []byte
+	stream = append(stream, 0, 0, 0, 0)
+	stream = append(stream, (&Message{ID: MsgHave, Payload: []byte{0, 0, 0, 3}}).Serialize()...)
+	stream = append(stream, pieceFrame(3, 0, block)...)
+
+	r := NewReader(bytes.NewReader(stream), MaxFrameLength(10))
+	if msg, err := r.Next(); msg != nil || err != nil {
+		t.Fatalf("keep-alive: got %v, %v", msg, err)
+	}
+	msg, err := r.Next()
+	if err != nil || msg.ID != MsgHave || !bytes.Equal(msg.Payload, []byte{0, 0, 0, 3}) {
+		t.Fatalf("have: got %+v, %v", msg, err)
+	}
+	msg, err = r.Next()
+	if err != nil || msg.ID != MsgPiece || !bytes.Equal(msg.Payload[8:], block) {
+		t.Fatalf("piece: got id %v, %v", msg.ID, err)
+	}
+}
+
+func TestReaderRejectsOversizedFrame(t *testing.T) {
+	frame := pieceFrame(0, 0, make([]byte, blockSize))
+	r := NewReader(bytes.NewReader(frame), 100)
+	_, err := r.Next()
+	if _, ok := err.(*ProtocolError); !ok {
+		t.Fatalf("got %v, want a *ProtocolError", err)
+	}
+}
+
+func TestReleasedBlockIsReused(t *testing.T) {
+	frame := pieceFrame(1, 0, make([]byte, blockSize))
+
+	// sync.Pool may drop any single Put, so allow a few rounds.
+	for i := 0; i < 20; i++ {
+		r := NewReader(&loopReader{data: frame}, MaxFrameLength(10))
+		if _, err := r.Next(); err != nil {
+			t.Fatal(err)
+		}
+		ev := Event{Type: EventPiece, payload: r.TakePayload()}
+		first := &(*ev.payload)[0]
+		ev.Release()
+		if ev.payload != nil || ev.Block != nil {
+			t.Fatal("Release left the buffer on the event")
+		}
+
+		if _, err := r.Next(); err != nil {
+			t.Fatal(err)
+		}
+		if &(*r.pooled)[0] == first {
+			return
+		}
+	}
+	t.Fatal("a released block buffer was never handed out again")
+}
+
+func BenchmarkReaderNext(b *testing.B) {
+	r := NewReader(&loopReader{data: pieceFrame(1, 0, make([]byte, blockSize))}, MaxFrameLength(10))
+	b.SetBytes(blockSize)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := r.Next(); err != nil {
+			b.Fatal(err)
+		}
+		ev := Event{payload: r.TakePayload()}
+		ev.Release()
+	}
+}
+
+func BenchmarkAppendTo(b *testing.B) {
+	msg := &Message{ID: MsgPiece, Payload: make([]byte, 8+blockSize)}
+	buf := make([]byte, 0, 5+len(msg.Payload))
+	b.SetBytes(blockSize)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		buf = msg.AppendTo(buf[:0])
+	}
+}
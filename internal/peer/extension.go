@@ -0,0 +1,57 @@
+package peer
+
+import (
+	"fmt"
+	"torrent-client/internal/bencode"
+)
+
+// ClientVersion is the "v" string we announce in the extended handshake.
+const ClientVersion = "Simple Torrent 0.0.0.1"
+
+// ExtendedHandshake is the BEP 10 handshake payload (extended message 0).
+type ExtendedHandshake struct {
+	Version    string
+	Extensions map[string]int
+}
+
+func (s *Session) SendExtendedHandshake(h *ExtendedHandshake) error {
+	m := bencode.BDict{}
+	for name, id := range h.Extensions {
+		m[name] = id
+	}
+	dict := bencode.BDict{"m": m}
+	if h.Version != "" {
+		dict["v"] = h.Version
+	}
+	data, err := bencode.Encode(dict)
+	if err != nil {
+		return err
+	}
+	return s.Send(&Message{ID: MsgExtended, Payload: append([]byte{0}, data...)})
+}
+
+// ParseExtendedHandshake decodes the dictionary that follows the extended
+// message ID. Unknown keys are ignored.
+func ParseExtendedHandshake(payload []byte) (*ExtendedHandshake, error) {
+	val, err := bencode.NewDecoder(payload).Decode()
+	if err != nil {
+		return nil, fmt.Errorf("bad extended handshake: %w", err)
+	}
+	dict, ok := val.(bencode.BDict)
+	if !ok {
+		return nil, fmt.Errorf("bad extended handshake: not a dictionary")
+	}
+
+	h := &ExtendedHandshake{Extensions: make(map[string]int)}
+	if v, ok := dict["v"].(bencode.BString); ok {
+		h.Version = string(v)
+	}
+	if m, ok := dict["m"].(bencode.BDict); ok {
+		for name, id := range m {
+			if n, ok := id.(bencode.BInt); ok {
+				h.Extensions[name] = int(n)
+			}
+		}
+	}
+	return h, nil
+}
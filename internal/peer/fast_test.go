@@ -0,0 +1,52 @@
+package peer
+
+import (
+	"net"
+	"slices"
+	"testing"
+)
+
+// TestAllowedFastSetReference checks the example given in BEP 6.
+func TestAllowedFastSetReference(t *testing.T) {
+	var infoHash [20]byte
+	for i := range infoHash {
+		infoHash[i] = 0xaa
+	}
+	ip := net.ParseIP("80.4.4.200")
+
+	want7 := []int{1059, 431, 808, 1217, 287, 376, 1188}
+	if got := AllowedFastSet(ip, infoHash, 1313, 7); !slices.Equal(got, want7) {
+		t.Errorf("k=7: got %v, want %v", got, want7)
+	}
+	want9 := append(want7, 353, 508)
+	if got := AllowedFastSet(ip, infoHash, 1313, 9); !slices.Equal(got, want9) {
+		t.Errorf("k=9: got %v, want %v", got, want9)
+	}
+
+	// Only the first three octets count.
+	if got := AllowedFastSet(net.ParseIP("80.4.4.1"), infoHash, 1313, 7); !slices.Equal(got, want7) {
+		t.Errorf("same /24: got %v, want %v", got, want7)
+	}
+}
+
+func TestAllowedFastSetLimits(t *testing.T) {
+	var infoHash [20]byte
+	got := AllowedFastSet(net.ParseIP("10.1.2.3"), infoHash, 5, 10)
+	if len(got) != 5 {
+		t.Errorf("a 5-piece torrent gave %d pieces: %v", len(got), got)
+	}
+	seen := make(map[int]bool)
+	for _, index := range got {
+		if index < 0 || index >= 5 || seen[index] {
+			t.Errorf("bad or repeated index %d in %v", index, got)
+		}
+		seen[index] = true
+	}
+
+	if got := AllowedFastSet(net.ParseIP("2001:db8::1"), infoHash, 100, 10); got != nil {
+		t.Errorf("IPv6 peer got %v", got)
+	}
+	if got := AllowedFastSet(net.ParseIP("10.1.2.3"), infoHash, 0, 10); got != nil {
+		t.Errorf("empty torrent gave %v", got)
+	}
+}
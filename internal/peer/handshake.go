@@ -16,16 +16,28 @@ const (
 
 type Handshake struct {
 	Pstr     string
+	Reserved [8]byte
 	InfoHash [20]byte
 	PeerID   [20]byte
 }
 
 func NewHandshake(infoHash, peerID [20]byte) *Handshake {
-	return &Handshake{
+	h := &Handshake{
 		Pstr:     ProtocolStr,
 		InfoHash: infoHash,
 		PeerID:   peerID,
 	}
+	h.Reserved[5] |= 0x10 // BEP 10 extension protocol
+	h.Reserved[7] |= 0x04 // BEP 6 fast extension
+	return h
+}
+
+func (h *Handshake) SupportsFast() bool {
+	return h.Reserved[7]&0x04 != 0
+}
+
+func (h *Handshake) SupportsExtensions() bool {
+	return h.Reserved[5]&0x10 != 0
 }
 
 func (h *Handshake) Serialize() []byte {
@@ -34,7 +46,7 @@ func (h *Handshake) Serialize() []byte {
 
 	curr := 1
 	curr += copy(buf[curr:], h.Pstr)
-	curr += copy(buf[curr:], make([]byte, 8))
+	curr += copy(buf[curr:], h.Reserved[:])
 	curr += copy(buf[curr:], h.InfoHash[:])
 	curr += copy(buf[curr:], h.PeerID[:])
 
@@ -55,6 +67,7 @@ func Read(r io.Reader) (*Handshake, error) {
 
 	res := &Handshake{
 		Pstr:     string(buf[1 : pstrlen+1]),
+		Reserved: [8]byte(buf[ReservedOffset:InfoHashOffset]),
 		InfoHash: [20]byte(buf[InfoHashOffset:PeerIDOffset]),
 		PeerID:   [20]byte(buf[PeerIDOffset:HandshakeSize]),
 	}
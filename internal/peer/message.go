@@ -17,6 +17,13 @@ const (
 	MsgRequest       messageID = 6
 	MsgPiece         messageID = 7
 	MsgCancel        messageID = 8
+
+	// BEP 6 fast extension
+	MsgSuggestPiece  messageID = 13
+	MsgHaveAll       messageID = 14
+	MsgHaveNone      messageID = 15
+	MsgRejectRequest messageID = 16
+	MsgAllowedFast   messageID = 17
 )
 
 type Message struct {
@@ -25,18 +32,31 @@ type Message struct {
 }
 
 func (m *Message) Serialize() []byte {
+	return m.AppendTo(nil)
+}
+
+// AppendTo appends the framed message to buf and returns the extended
+// slice. A nil message is a keep-alive.
+func (m *Message) AppendTo(buf []byte) []byte {
 	if m == nil {
-		return make([]byte, 4)
+		return append(buf, 0, 0, 0, 0)
 	}
-	length := uint32(len(m.Payload) + 1)
-	buf := make([]byte, 4+length)
-	binary.BigEndian.PutUint32(buf[0:4], length)
-	buf[4] = byte(m.ID)
-	copy(buf[5:], m.Payload)
-	return buf
+	buf = appendHeader(buf, m.ID, len(m.Payload))
+	return append(buf, m.Payload...)
+}
+
+func appendHeader(buf []byte, id messageID, payloadLen int) []byte {
+	buf = binary.BigEndian.AppendUint32(buf, uint32(payloadLen+1))
+	return append(buf, byte(id))
 }
 
 func ReadMessage(r io.Reader) (*Message, error) {
+	return ReadMessageLimit(r, MaxMessageLength)
+}
+
+// ReadMessageLimit reads one frame, refusing to allocate for frames longer
+// than maxLength. Keep-alives yield a nil message.
+func ReadMessageLimit(r io.Reader, maxLength uint32) (*Message, error) {
 
 	lengthBuf := make([]byte, 4)
 	_, err := io.ReadFull(r, lengthBuf)
@@ -48,6 +68,14 @@ func ReadMessage(r io.Reader) (*Message, error) {
 	if length == 0 {
 		return nil, nil
 	}
+	if length > maxLength {
+		// Read just the ID so the error says what the peer tried to send.
+		var id [1]byte
+		if _, err := io.ReadFull(r, id[:]); err != nil {
+			return nil, err
+		}
+		return nil, protocolErrorf(messageID(id[0]), "frame of %d bytes exceeds the %d byte limit", length, maxLength)
+	}
 
 	messageBuf := make([]byte, length)
 	_, err = io.ReadFull(r, messageBuf)
@@ -0,0 +1,364 @@
+package peer
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+type EventType int
+
+const (
+	EventChoke EventType = iota
+	EventUnchoke
+	EventInterested
+	EventNotInterested
+	EventHave
+	EventBitfield
+	EventRequest
+	EventPiece
+	EventCancel
+	EventSuggest
+	EventHaveAll
+	EventHaveNone
+	EventReject
+	EventAllowedFast
+	EventExtended
+	EventOther
+)
+
+// Event is a decoded incoming message. Only the fields relevant to Type are
+// set; Message carries the raw frame for EventExtended and EventOther. Block is borrowed from
+// a pool and should be handed back with Release once it has been copied.
+type Event struct {
+	Type     EventType
+	Index    int
+	Begin    int
+	Length   int
+	Bitfield Bitfield
+	Block    []byte
+	Message  *Message
+
+	payload *[]byte
+}
+
+func (ev *Event) Release() {
+	if ev.payload != nil {
+		putPayload(ev.payload)
+		ev.payload = nil
+		ev.Block = nil
+	}
+}
+
+// Session owns a peer connection after the handshake. A single goroutine
+// reads and decodes messages into Events, while outgoing messages are
+// buffered and flushed by a writer goroutine so that bursts of requests
+// leave in as few writes as possible.
+type Session struct {
+	conn        net.Conn
+	r           *Reader
+	numPieces   int
+	idleTimeout time.Duration
+	events      chan Event
+
+	wmu      sync.Mutex
+	w        *bufio.Writer
+	werr     error
+	lastSend time.Time
+	flush    chan struct{}
+
+	closeOnce sync.Once
+	closed    chan struct{}
+	errMu     sync.Mutex
+	err       error
+}
+
+// NewSession starts the session goroutines. Incoming messages are checked
+// against a torrent of numPieces pieces and any violation ends the session
+// with a *ProtocolError.
+func NewSession(conn net.Conn, numPieces int, idleTimeout time.Duration) *Session {
+	s := &Session{
+		conn:        conn,
+		r:           NewReader(conn, MaxFrameLength(numPieces)),
+		numPieces:   numPieces,
+		idleTimeout: idleTimeout,
+		events:      make(chan Event, 16),
+		w:           bufio.NewWriterSize(conn, 64*1024),
+		lastSend:    time.Now(),
+		flush:       make(chan struct{}, 1),
+		closed:      make(chan struct{}),
+	}
+	go s.readLoop()
+	go s.writeLoop()
+	return s
+}
+
+// Events is closed when the connection fails or the session is closed; Err
+// then reports why.
+func (s *Session) Events() <-chan Event {
+	return s.events
+}
+
+func (s *Session) Err() error {
+	s.errMu.Lock()
+	defer s.errMu.Unlock()
+	return s.err
+}
+
+func (s *Session) RemoteAddr() net.Addr {
+	return s.conn.RemoteAddr()
+}
+
+func (s *Session) LastSend() time.Time {
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+	return s.lastSend
+}
+
+func (s *Session) Close() error {
+	s.fail(fmt.Errorf("session closed"))
+	return nil
+}
+
+func (s *Session) fail(err error) {
+	s.closeOnce.Do(func() {
+		s.errMu.Lock()
+		s.err = err
+		s.errMu.Unlock()
+		close(s.closed)
+		s.conn.Close()
+	})
+}
+
+func (s *Session) readLoop() {
+	defer close(s.events)
+	for {
+		if s.idleTimeout > 0 {
+			s.conn.SetReadDeadline(time.Now().Add(s.idleTimeout))
+		}
+		msg, err := s.r.Next()
+		if err != nil {
+			s.fail(err)
+			return
+		}
+		if msg == nil {
+			continue
+		}
+		if err := msg.Validate(s.numPieces); err != nil {
+			s.fail(err)
+			return
+		}
+
+		ev := decodeEvent(msg)
+		if ev.Type == EventPiece {
+			ev.payload = s.r.TakePayload()
+		}
+
+		select {
+		case s.events <- ev:
+		case <-s.closed:
+			ev.Release()
+			return
+		}
+	}
+}
+
+// decodeEvent expects a message that passed Validate. msg belongs to the
+// Reader, so anything kept beyond the next read is copied.
+func decodeEvent(msg *Message) Event {
+	var ev Event
+	switch msg.ID {
+	case MsgChoke:
+		ev.Type = EventChoke
+	case MsgUnchoke:
+		ev.Type = EventUnchoke
+	case MsgInterested:
+		ev.Type = EventInterested
+	case MsgNotInterested:
+		ev.Type = EventNotInterested
+	case MsgHave, MsgSuggestPiece, MsgAllowedFast:
+		switch msg.ID {
+		case MsgHave:
+			ev.Type = EventHave
+		case MsgSuggestPiece:
+			ev.Type = EventSuggest
+		default:
+			ev.Type = EventAllowedFast
+		}
+		ev.Index = int(binary.BigEndian.Uint32(msg.Payload[0:4]))
+	case MsgHaveAll:
+		ev.Type = EventHaveAll
+	case MsgHaveNone:
+		ev.Type = EventHaveNone
+	case MsgBitfield:
+		ev.Type = EventBitfield
+		ev.Bitfield = Bitfield(append([]byte(nil), msg.Payload...))
+	case MsgRequest, MsgCancel, MsgRejectRequest:
+		switch msg.ID {
+		case MsgRequest:
+			ev.Type = EventRequest
+		case MsgCancel:
+			ev.Type = EventCancel
+		default:
+			ev.Type = EventReject
+		}
+		ev.Index = int(binary.BigEndian.Uint32(msg.Payload[0:4]))
+		ev.Begin = int(binary.BigEndian.Uint32(msg.Payload[4:8]))
+		ev.Length = int(binary.BigEndian.Uint32(msg.Payload[8:12]))
+	case MsgPiece:
+		ev.Type = EventPiece
+		ev.Index = int(binary.BigEndian.Uint32(msg.Payload[0:4]))
+		ev.Begin = int(binary.BigEndian.Uint32(msg.Payload[4:8]))
+		ev.Block = msg.Payload[8:]
+		ev.Length = len(ev.Block)
+	case MsgExtended:
+		ev.Type = EventExtended
+		ev.Message = &Message{ID: msg.ID, Payload: append([]byte(nil), msg.Payload...)}
+	default:
+		ev.Type = EventOther
+		ev.Message = &Message{ID: msg.ID, Payload: append([]byte(nil), msg.Payload...)}
+	}
+	return ev
+}
+
+func (s *Session) writeLoop() {
+	for {
+		select {
+		case <-s.flush:
+		case <-s.closed:
+			return
+		}
+
+		s.wmu.Lock()
+		if s.werr == nil {
+			s.werr = s.w.Flush()
+		}
+		err := s.werr
+		s.wmu.Unlock()
+
+		if err != nil {
+			s.fail(err)
+			return
+		}
+	}
+}
+
+// Send queues msg for the writer goroutine. A nil msg is a keep-alive.
+func (s *Session) Send(msg *Message) error {
+	s.wmu.Lock()
+	if s.werr == nil {
+		_, s.werr = s.w.Write(msg.AppendTo(s.w.AvailableBuffer()))
+	}
+	return s.queued()
+}
+
+// sendFields queues a message whose payload is a list of 32-bit integers,
+// serialized straight into the write buffer.
+func (s *Session) sendFields(id messageID, fields ...int) error {
+	s.wmu.Lock()
+	if s.werr == nil {
+		b := appendHeader(s.w.AvailableBuffer(), id, 4*len(fields))
+		for _, f := range fields {
+			b = binary.BigEndian.AppendUint32(b, uint32(f))
+		}
+		_, s.werr = s.w.Write(b)
+	}
+	return s.queued()
+}
+
+// queued finishes a send started with wmu held: it releases the lock and
+// wakes the writer.
+func (s *Session) queued() error {
+	s.lastSend = time.Now()
+	err := s.werr
+	s.wmu.Unlock()
+
+	if err != nil {
+		return err
+	}
+	select {
+	case <-s.closed:
+		return s.Err()
+	default:
+	}
+
+	select {
+	case s.flush <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+func (s *Session) SendKeepAlive() error {
+	return s.Send(nil)
+}
+
+func (s *Session) SendChoke() error {
+	return s.sendFields(MsgChoke)
+}
+
+func (s *Session) SendUnchoke() error {
+	return s.sendFields(MsgUnchoke)
+}
+
+func (s *Session) SendInterested() error {
+	return s.sendFields(MsgInterested)
+}
+
+func (s *Session) SendNotInterested() error {
+	return s.sendFields(MsgNotInterested)
+}
+
+func (s *Session) SendRequest(index, begin, length int) error {
+	return s.sendFields(MsgRequest, index, begin, length)
+}
+
+func (s *Session) SendCancel(index, begin, length int) error {
+	return s.sendFields(MsgCancel, index, begin, length)
+}
+
+func (s *Session) SendHave(index int) error {
+	return s.sendFields(MsgHave, index)
+}
+
+func (s *Session) SendBitfield(bf Bitfield) error {
+	return s.Send(&Message{ID: MsgBitfield, Payload: bf})
+}
+
+// SendPiece writes the block behind its header without building a
+// separate payload.
+func (s *Session) SendPiece(index, begin int, block []byte) error {
+	s.wmu.Lock()
+	if s.werr == nil {
+		b := appendHeader(s.w.AvailableBuffer(), MsgPiece, 8+len(block))
+		b = binary.BigEndian.AppendUint32(b, uint32(index))
+		b = binary.BigEndian.AppendUint32(b, uint32(begin))
+		if _, s.werr = s.w.Write(b); s.werr == nil {
+			_, s.werr = s.w.Write(block)
+		}
+	}
+	return s.queued()
+}
+
+func (s *Session) SendSuggest(index int) error {
+	return s.sendFields(MsgSuggestPiece, index)
+}
+
+func (s *Session) SendHaveAll() error {
+	return s.sendFields(MsgHaveAll)
+}
+
+func (s *Session) SendHaveNone() error {
+	return s.sendFields(MsgHaveNone)
+}
+
+func (s *Session) SendReject(index, begin, length int) error {
+	return s.sendFields(MsgRejectRequest, index, begin, length)
+}
+
+func (s *Session) SendAllowedFast(index int) error {
+	return s.sendFields(MsgAllowedFast, index)
+}
@@ -0,0 +1,230 @@
+package peer
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// sessionPair connects two sessions over an in-memory pipe.
+func sessionPair(t *testing.T, numPieces int) (*Session, *Session) {
+	t.Helper()
+	a, b := net.Pipe()
+	sa, sb := NewSession(a, numPieces, 0), NewSession(b, numPieces, 0)
+	t.Cleanup(func() {
+		sa.Close()
+		sb.Close()
+	})
+	return sa, sb
+}
+
+func nextEvent(t *testing.T, s *Session) Event {
+	t.Helper()
+	select {
+	case ev, ok := <-s.Events():
+		if !ok {
+			t.Fatalf("session ended: %v", s.Err())
+		}
+		return ev
+	case <-time.After(5 * time.Second):
+		t.Fatal("no event")
+	}
+	return Event{}
+}
+
+func TestSessionDecodesMessages(t *testing.T) {
+	a, b := sessionPair(t, 10)
+
+	bf := NewBitfield(10)
+	bf.SetPiece(4)
+	block := bytes.Repeat([]byte{7}, 100)
+	a.SendBitfield(bf)
+	a.SendInterested()
+	a.SendHave(3)
+	a.SendRequest(1, 16384, 16384)
+	a.SendCancel(1, 16384, 16384)
+	a.SendPiece(2, 32, block)
+	a.SendKeepAlive()
+	a.SendNotInterested()
+
+	if ev := nextEvent(t, b); ev.Type != EventBitfield || !ev.Bitfield.HasPiece(4) || ev.Bitfield.HasPiece(3) {
+		t.Errorf("bitfield: got %+v", ev)
+	}
+	if ev := nextEvent(t, b); ev.Type != EventInterested {
+		t.Errorf("interested: got %+v", ev)
+	}
+	if ev := nextEvent(t, b); ev.Type != EventHave || ev.Index != 3 {
+		t.Errorf("have: got %+v", ev)
+	}
+	if ev := nextEvent(t, b); ev.Type != EventRequest || ev.Index != 1 || ev.Begin != 16384 || ev.Length != 16384 {
+		t.Errorf("request: got %+v", ev)
+	}
+	if ev := nextEvent(t, b); ev.Type != EventCancel || ev.Index != 1 {
+		t.Errorf("cancel: got %+v", ev)
+	}
+	ev := nextEvent(t, b)
+	if ev.Type != EventPiece || ev.Index != 2 || ev.Begin != 32 || !bytes.Equal(ev.Block, block) {
+		t.Errorf("piece: got type %d index %d begin %d, %d bytes", ev.Type, ev.Index, ev.Begin, len(ev.Block))
+	}
+	ev.Release()
+	// The keep-alive produces no event.
+	if ev := nextEvent(t, b); ev.Type != EventNotInterested {
+		t.Errorf("not interested: got %+v", ev)
+	}
+}
+
+// Both sides sending at once must not deadlock, which is what blocking on
+// reads between writes used to risk.
+func TestSessionFullDuplex(t *testing.T) {
+	a, b := sessionPair(t, 1000)
+
+	const n = 500
+	var wg sync.WaitGroup
+	for _, pair := range [][2]*Session{{a, b}, {b, a}} {
+		from, to := pair[0], pair[1]
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < n; i++ {
+				if err := from.SendHave(i); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for i := 0; i < n; i++ {
+				select {
+				case ev := <-to.Events():
+					if ev.Type != EventHave || ev.Index != i {
+						t.Errorf("event %d: got %+v", i, ev)
+						return
+					}
+				case <-time.After(5 * time.Second):
+					t.Errorf("stuck after %d events", i)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// countingConn counts the writes that reach the connection.
+type countingConn struct {
+	net.Conn
+	mu     sync.Mutex
+	writes int
+}
+
+func (c *countingConn) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	c.writes++
+	c.mu.Unlock()
+	return c.Conn.Write(p)
+}
+
+func TestSessionCoalescesWrites(t *testing.T) {
+	a, b := net.Pipe()
+	conn := &countingConn{Conn: a}
+	s := NewSession(conn, 1000, 0)
+	defer s.Close()
+	r := NewSession(b, 1000, 0)
+	defer r.Close()
+
+	const n = 1000
+	for i := 0; i < n; i++ {
+		if err := s.SendRequest(i, 0, 16384); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < n; i++ {
+		if ev := nextEvent(t, r); ev.Index != i {
+			t.Fatalf("request %d arrived as %d", i, ev.Index)
+		}
+	}
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	if conn.writes >= n {
+		t.Errorf("%d requests took %d writes", n, conn.writes)
+	}
+}
+
+func TestSessionEnds(t *testing.T) {
+	a, b := net.Pipe()
+	s := NewSession(a, 10, 0)
+	b.Close()
+	for range s.Events() {
+	}
+	if s.Err() == nil {
+		t.Error("session ended without an error")
+	}
+	if err := s.SendHave(1); err == nil {
+		t.Error("send on a dead session succeeded")
+	}
+
+	// A peer that stays silent past the idle timeout is dropped.
+	a, b = net.Pipe()
+	defer b.Close()
+	s = NewSession(a, 10, 50*time.Millisecond)
+	select {
+	case _, ok := <-s.Events():
+		if ok {
+			t.Fatal("unexpected event")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("idle session was not dropped")
+	}
+	if s.Err() == nil {
+		t.Error("idle session ended without an error")
+	}
+}
+
+// discardConn swallows writes; reads block until it is closed.
+type discardConn struct {
+	closed chan struct{}
+}
+
+func newDiscardConn() *discardConn {
+	return &discardConn{closed: make(chan struct{})}
+}
+
+func (c *discardConn) Read(p []byte) (int, error) {
+	<-c.closed
+	return 0, io.EOF
+}
+
+func (c *discardConn) Write(p []byte) (int, error) { return len(p), nil }
+
+func (c *discardConn) Close() error {
+	select {
+	case <-c.closed:
+	default:
+		close(c.closed)
+	}
+	return nil
+}
+
+func (c *discardConn) LocalAddr() net.Addr                { return &net.TCPAddr{} }
+func (c *discardConn) RemoteAddr() net.Addr               { return &net.TCPAddr{} }
+func (c *discardConn) SetDeadline(t time.Time) error      { return nil }
+func (c *discardConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *discardConn) SetWriteDeadline(t time.Time) error { return nil }
+
+func BenchmarkSessionSendPiece(b *testing.B) {
+	s := NewSession(newDiscardConn(), 10, 0)
+	defer s.Close()
+	block := make([]byte, blockSize)
+
+	b.SetBytes(blockSize)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if err := s.SendPiece(1, 0, block); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package peer
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+const (
+	// MaxBlockLength is the largest block we request, serve or accept.
+	MaxBlockLength = 1 << 17
+	// MaxMessageLength caps frames read without knowing the torrent.
+	MaxMessageLength = 1 << 20
+
+	MsgPort     messageID = 9
+	MsgExtended messageID = 20
+)
+
+// ProtocolError reports a peer breaking the wire protocol. Sessions end
+// with one so callers can tell misbehaving peers from network failures.
+type ProtocolError struct {
+	ID     messageID
+	Reason string
+}
+
+func (e *ProtocolError) Error() string {
+	return fmt.Sprintf("protocol violation in message %d: %s", e.ID, e.Reason)
+}
+
+func protocolErrorf(id messageID, format string, args ...interface{}) error {
+	return &ProtocolError{ID: id, Reason: fmt.Sprintf(format, args...)}
+}
+
+// MaxFrameLength is the largest frame a well-behaved peer can send for a
+// torrent with numPieces pieces: a full bitfield or a maximum-size block.
+func MaxFrameLength(numPieces int) uint32 {
+	n := 9 + MaxBlockLength
+	if bf := 1 + (numPieces+7)/8; bf > n {
+		n = bf
+	}
+	return uint32(n)
+}
+
+// Validate checks the payload length of every known message and, when
+// numPieces is positive, that piece indexes and bitfields fit the torrent.
+// Unknown message IDs are left to the caller.
+func (m *Message) Validate(numPieces int) error {
+	n := len(m.Payload)
+	switch m.ID {
+	case MsgChoke, MsgUnchoke, MsgInterested, MsgNotInterested, MsgHaveAll, MsgHaveNone:
+		if n != 0 {
+			return protocolErrorf(m.ID, "expected empty payload, got %d bytes", n)
+		}
+	case MsgHave, MsgSuggestPiece, MsgAllowedFast:
+		if n != 4 {
+			return protocolErrorf(m.ID, "expected 4-byte payload, got %d bytes", n)
+		}
+		return checkIndex(m.ID, m.Payload, numPieces)
+	case MsgBitfield:
+		if numPieces <= 0 {
+			return nil
+		}
+		if n != (numPieces+7)/8 {
+			return protocolErrorf(m.ID, "bitfield is %d bytes, want %d", n, (numPieces+7)/8)
+		}
+		if spare := numPieces % 8; spare != 0 && m.Payload[n-1]&(0xff>>spare) != 0 {
+			return protocolErrorf(m.ID, "spare bitfield bits are set")
+		}
+	case MsgRequest, MsgCancel, MsgRejectRequest:
+		if n != 12 {
+			return protocolErrorf(m.ID, "expected 12-byte payload, got %d bytes", n)
+		}
+		length := binary.BigEndian.Uint32(m.Payload[8:12])
+		if length == 0 || length > MaxBlockLength {
+			return protocolErrorf(m.ID, "invalid block length %d", length)
+		}
+		return checkIndex(m.ID, m.Payload, numPieces)
+	case MsgPiece:
+		if n < 8 || n-8 > MaxBlockLength {
+			return protocolErrorf(m.ID, "invalid piece payload length %d", n)
+		}
+		return checkIndex(m.ID, m.Payload, numPieces)
+	case MsgPort:
+		if n != 2 {
+			return protocolErrorf(m.ID, "expected 2-byte payload, got %d bytes", n)
+		}
+	case MsgExtended:
+		if n < 1 {
+			return protocolErrorf(m.ID, "missing extended message id")
+		}
+	}
+	return nil
+}
+
+func checkIndex(id messageID, payload []byte, numPieces int) error {
+	if numPieces <= 0 {
+		return nil
+	}
+	if index := binary.BigEndian.Uint32(payload[0:4]); index >= uint32(numPieces) {
+		return protocolErrorf(id, "piece index %d out of range", index)
+	}
+	return nil
+}
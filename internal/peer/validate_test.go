@@ -0,0 +1,102 @@
+package peer
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func fields(values ...uint32) []byte {
+	var b []byte
+	for _, v := range values {
+		b = binary.BigEndian.AppendUint32(b, v)
+	}
+	return b
+}
+
+func TestValidate(t *testing.T) {
+	const numPieces = 10
+	tests := []struct {
+		name string
+		msg  Message
+		ok   bool
+	}{
+		{"choke", Message{ID: MsgChoke}, true},
+		{"choke with payload", Message{ID: MsgChoke, Payload: []byte{0}}, false},
+		{"have all with payload", Message{ID: MsgHaveAll, Payload: []byte{0}}, false},
+		{"have", Message{ID: MsgHave, Payload: fields(9)}, true},
+		{"have out of range", Message{ID: MsgHave, Payload: fields(10)}, false},
+		{"have short", Message{ID: MsgHave, Payload: []byte{0, 0, 1}}, false},
+		{"suggest out of range", Message{ID: MsgSuggestPiece, Payload: fields(99)}, false},
+		{"allowed fast", Message{ID: MsgAllowedFast, Payload: fields(0)}, true},
+		{"bitfield", Message{ID: MsgBitfield, Payload: []byte{0xff, 0xc0}}, true},
+		{"bitfield too long", Message{ID: MsgBitfield, Payload: []byte{0xff, 0xc0, 0}}, false},
+		{"bitfield spare bits", Message{ID: MsgBitfield, Payload: []byte{0xff, 0xe0}}, false},
+		{"request", Message{ID: MsgRequest, Payload: fields(1, 0, 16384)}, true},
+		{"request too big", Message{ID: MsgRequest, Payload: fields(1, 0, MaxBlockLength+1)}, false},
+		{"request empty", Message{ID: MsgRequest, Payload: fields(1, 0, 0)}, false},
+		{"request short", Message{ID: MsgRequest, Payload: fields(1, 0)}, false},
+		{"cancel out of range", Message{ID: MsgCancel, Payload: fields(10, 0, 16384)}, false},
+		{"reject", Message{ID: MsgRejectRequest, Payload: fields(2, 0, 16384)}, true},
+		{"piece", Message{ID: MsgPiece, Payload: append(fields(3, 0), make([]byte, 16384)...)}, true},
+		{"piece too big", Message{ID: MsgPiece, Payload: append(fields(3, 0), make([]byte, MaxBlockLength+1)...)}, false},
+		{"piece header only", Message{ID: MsgPiece, Payload: []byte{0, 0, 0, 3}}, false},
+		{"port", Message{ID: MsgPort, Payload: []byte{0x1a, 0xe1}}, true},
+		{"port long", Message{ID: MsgPort, Payload: []byte{0, 0, 0}}, false},
+		{"extended", Message{ID: MsgExtended, Payload: []byte{0}}, true},
+		{"extended empty", Message{ID: MsgExtended}, false},
+		{"unknown", Message{ID: 99, Payload: []byte{1, 2, 3}}, true},
+	}
+	for _, tt := range tests {
+		err := tt.msg.Validate(numPieces)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: got %v", tt.name, err)
+		}
+		var perr *ProtocolError
+		if err != nil && !errors.As(err, &perr) {
+			t.Errorf("%s: %v is not a *ProtocolError", tt.name, err)
+		}
+	}
+
+	// Without a torrent size only the shape of the message is checked.
+	if err := (&Message{ID: MsgHave, Payload: fields(1 << 30)}).Validate(0); err != nil {
+		t.Errorf("index checked without a piece count: %v", err)
+	}
+}
+
+func TestMaxFrameLength(t *testing.T) {
+	if got := MaxFrameLength(10); got != 9+MaxBlockLength {
+		t.Errorf("small torrent: %d", got)
+	}
+	// A huge torrent's bitfield outgrows the largest block.
+	if got := MaxFrameLength(8 * MaxBlockLength * 2); got != 1+2*MaxBlockLength {
+		t.Errorf("huge torrent: %d", got)
+	}
+}
+
+func TestSessionEndsOnMalformedMessage(t *testing.T) {
+	for name, frame := range map[string][]byte{
+		"malformed": (&Message{ID: MsgHave, Payload: fields(42)}).Serialize(),
+		"oversized": append(binary.BigEndian.AppendUint32(nil, MaxFrameLength(10)+1), byte(MsgPiece)),
+	} {
+		a, b := net.Pipe()
+		s := NewSession(a, 10, 0)
+		go b.Write(frame)
+
+		select {
+		case _, ok := <-s.Events():
+			if ok {
+				t.Errorf("%s: delivered an event", name)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s: session kept going", name)
+		}
+		var perr *ProtocolError
+		if !errors.As(s.Err(), &perr) {
+			t.Errorf("%s: session ended with %v, want a *ProtocolError", name, s.Err())
+		}
+		b.Close()
+	}
+}
@@ -0,0 +1,463 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeSOCKS5 is a minimal SOCKS5 server: it negotiates auth, relays
+// CONNECT to the real target and runs a UDP relay for UDP ASSOCIATE.
+type fakeSOCKS5 struct {
+	ln       net.Listener
+	username string
+	password string
+	// reply, when non-zero, is the error code sent for every request.
+	reply byte
+
+	mu      sync.Mutex
+	methods []byte
+	targets []string
+}
+
+func newFakeSOCKS5(t *testing.T) *fakeSOCKS5 {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &fakeSOCKS5{ln: ln}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(t, conn)
+		}
+	}()
+	return s
+}
+
+func (s *fakeSOCKS5) config() Config {
+	return Config{Type: SOCKS5, Addr: s.ln.Addr().String()}
+}
+
+func (s *fakeSOCKS5) serve(t *testing.T, conn net.Conn) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	head := make([]byte, 2)
+	if _, err := io.ReadFull(conn, head); err != nil {
+		return
+	}
+	methods := make([]byte, head[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return
+	}
+	s.mu.Lock()
+	s.methods = methods
+	s.mu.Unlock()
+
+	want := byte(methodNone)
+	if s.username != "" {
+		want = methodPassword
+	}
+	if !bytes.Contains(methods, []byte{want}) {
+		conn.Write([]byte{socksVersion, methodNoAccept})
+		return
+	}
+	conn.Write([]byte{socksVersion, want})
+	if want == methodPassword {
+		user, pass := readAuth(conn)
+		if user != s.username || pass != s.password {
+			conn.Write([]byte{1, 1})
+			return
+		}
+		conn.Write([]byte{1, 0})
+	}
+
+	req := make([]byte, 3)
+	if _, err := io.ReadFull(conn, req); err != nil {
+		return
+	}
+	target, err := readSocksAddr(conn)
+	if err != nil {
+		return
+	}
+	s.mu.Lock()
+	s.targets = append(s.targets, target)
+	s.mu.Unlock()
+
+	if s.reply != 0 {
+		conn.Write([]byte{socksVersion, s.reply, 0, atypIPv4, 0, 0, 0, 0, 0, 0})
+		return
+	}
+	switch req[1] {
+	case cmdConnect:
+		upstream, err := net.Dial("tcp", target)
+		if err != nil {
+			conn.Write([]byte{socksVersion, 5, 0, atypIPv4, 0, 0, 0, 0, 0, 0})
+			return
+		}
+		defer upstream.Close()
+		// Report the bound address as a domain, which clients must
+		// also be able to read.
+		reply := []byte{socksVersion, 0, 0, atypDomain, 9}
+		reply = append(reply, "localhost"...)
+		conn.Write(binary.BigEndian.AppendUint16(reply, 1080))
+		conn.SetDeadline(time.Time{})
+		go io.Copy(upstream, conn)
+		io.Copy(conn, upstream)
+
+	case cmdUDPAssociate:
+		relay, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			return
+		}
+		defer relay.Close()
+		// Answer with the unspecified address, as many proxies do.
+		port := relay.LocalAddr().(*net.UDPAddr).Port
+		conn.Write(binary.BigEndian.AppendUint16([]byte{socksVersion, 0, 0, atypIPv4, 0, 0, 0, 0}, uint16(port)))
+		conn.SetDeadline(time.Time{})
+		go relayUDP(t, relay)
+		io.Copy(io.Discard, conn)
+	}
+}
+
+// readAuth reads an RFC 1929 username/password request.
+func readAuth(r io.Reader) (user, pass string) {
+	field := func() string {
+		var n [1]byte
+		if _, err := io.ReadFull(r, n[:]); err != nil {
+			return ""
+		}
+		b := make([]byte, n[0])
+		io.ReadFull(r, b)
+		return string(b)
+	}
+	var version [1]byte
+	io.ReadFull(r, version[:])
+	return field(), field()
+}
+
+// relayUDP forwards datagrams between the one client and whoever it
+// addresses, with the SOCKS5 UDP header on the client side.
+func relayUDP(t *testing.T, relay net.PacketConn) {
+	var client net.Addr
+	buf := make([]byte, 64*1024)
+	for {
+		n, from, err := relay.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		if client == nil || from.String() == client.String() {
+			client = from
+			r := bytes.NewReader(buf[3:n])
+			dst, err := readSocksAddr(r)
+			if err != nil {
+				t.Errorf("relay: %v", err)
+				return
+			}
+			addr, _ := net.ResolveUDPAddr("udp", dst)
+			relay.WriteTo(buf[n-r.Len():n], addr)
+			continue
+		}
+		wrapped, _ := appendSocksAddr([]byte{0, 0, 0}, from.String())
+		relay.WriteTo(append(wrapped, buf[:n]...), client)
+	}
+}
+
+func echoServer(t *testing.T) net.Listener {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return ln
+}
+
+func checkEcho(t *testing.T, conn net.Conn) {
+	t.Helper()
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	msg := []byte("through the proxy")
+	if _, err := conn.Write(msg); err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, len(msg))
+	if _, err := io.ReadFull(conn, got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, msg) {
+		t.Fatalf("got %q, want %q", got, msg)
+	}
+}
+
+func TestSOCKS5Connect(t *testing.T) {
+	target := echoServer(t)
+	_, port, _ := net.SplitHostPort(target.Addr().String())
+	s := newFakeSOCKS5(t)
+
+	for _, addr := range []string{target.Addr().String(), "localhost:" + port} {
+		conn, err := s.config().Dial(addr, 5*time.Second)
+		if err != nil {
+			t.Fatalf("%s: %v", addr, err)
+		}
+		checkEcho(t, conn)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !bytes.Equal(s.methods, []byte{methodNone}) {
+		t.Errorf("offered methods %v without credentials", s.methods)
+	}
+	// Host names go to the proxy unresolved.
+	want := []string{target.Addr().String(), "localhost:" + port}
+	if strings.Join(s.targets, " ") != strings.Join(want, " ") {
+		t.Errorf("proxy was asked for %v, want %v", s.targets, want)
+	}
+}
+
+func TestSOCKS5Auth(t *testing.T) {
+	target := echoServer(t).Addr().String()
+	s := newFakeSOCKS5(t)
+	s.username, s.password = "user", "secret"
+
+	cfg := s.config()
+	if _, err := cfg.Dial(target, 5*time.Second); err == nil || !strings.Contains(err.Error(), "no acceptable authentication") {
+		t.Fatalf("without credentials: got %v", err)
+	}
+
+	cfg.Username, cfg.Password = "user", "wrong"
+	if _, err := cfg.Dial(target, 5*time.Second); err == nil || !strings.Contains(err.Error(), "authentication failed") {
+		t.Fatalf("with a wrong password: got %v", err)
+	}
+
+	cfg.Password = "secret"
+	conn, err := cfg.Dial(target, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkEcho(t, conn)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !bytes.Equal(s.methods, []byte{methodNone, methodPassword}) {
+		t.Errorf("offered methods %v with credentials", s.methods)
+	}
+}
+
+func TestSOCKS5ReplyErrors(t *testing.T) {
+	tests := []struct {
+		code byte
+		want string
+	}{
+		{2, "connection not allowed by ruleset"},
+		{5, "connection refused"},
+		{42, "error 42"},
+	}
+	for _, tt := range tests {
+		s := newFakeSOCKS5(t)
+		s.reply = tt.code
+		_, err := s.config().Dial("127.0.0.1:1", 5*time.Second)
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("reply %d: got %v, want %q", tt.code, err, tt.want)
+		}
+	}
+}
+
+func TestReadSocksAddr(t *testing.T) {
+	tests := []struct {
+		name string
+		raw  []byte
+		want string
+		err  bool
+	}{
+		{"ipv4", []byte{atypIPv4, 10, 0, 0, 1, 0x1a, 0xe1}, "10.0.0.1:6881", false},
+		{"ipv6", append(append([]byte{atypIPv6}, net.ParseIP("2001:db8::1")...), 0, 80), "[2001:db8::1]:80", false},
+		{"domain", append(append([]byte{atypDomain, 11}, "example.org"...), 1, 187), "example.org:443", false},
+		{"bad type", []byte{9, 0, 0}, "", true},
+		{"short", []byte{atypIPv4, 10, 0}, "", true},
+	}
+	for _, tt := range tests {
+		got, err := readSocksAddr(bytes.NewReader(tt.raw))
+		if (err != nil) != tt.err || got != tt.want {
+			t.Errorf("%s: got %q, %v; want %q", tt.name, got, err, tt.want)
+		}
+		if tt.err {
+			continue
+		}
+		// What we read we must be able to write back identically.
+		back, err := appendSocksAddr(nil, got)
+		if err != nil || !bytes.Equal(back, tt.raw) {
+			t.Errorf("%s: encoded back as %v, %v", tt.name, back, err)
+		}
+	}
+}
+
+func TestSOCKS5UDPAssociate(t *testing.T) {
+	echo, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, from, err := echo.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			echo.WriteTo(buf[:n], from)
+		}
+	}()
+
+	s := newFakeSOCKS5(t)
+	pc, err := s.config().ListenPacket()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	pc.SetDeadline(time.Now().Add(5 * time.Second))
+
+	if _, err := pc.WriteTo([]byte("datagram"), echo.LocalAddr()); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 100)
+	n, from, err := pc.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:n]) != "datagram" {
+		t.Errorf("got %q back", buf[:n])
+	}
+	if from.String() != echo.LocalAddr().String() {
+		t.Errorf("reply from %s, want %s", from, echo.LocalAddr())
+	}
+}
+
+// fakeHTTPProxy answers CONNECT and splices the connection to the target.
+func fakeHTTPProxy(t *testing.T, auth string) net.Listener {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				req, err := http.ReadRequest(bufio.NewReader(conn))
+				if err != nil {
+					return
+				}
+				if req.Method != "CONNECT" {
+					io.WriteString(conn, "HTTP/1.1 405 Method Not Allowed\r\n\r\n")
+					return
+				}
+				if auth != "" && req.Header.Get("Proxy-Authorization") != auth {
+					io.WriteString(conn, "HTTP/1.1 407 Proxy Authentication Required\r\n\r\n")
+					return
+				}
+				upstream, err := net.Dial("tcp", req.Host)
+				if err != nil {
+					io.WriteString(conn, "HTTP/1.1 502 Bad Gateway\r\n\r\n")
+					return
+				}
+				defer upstream.Close()
+				io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+				go io.Copy(upstream, conn)
+				io.Copy(conn, upstream)
+			}()
+		}
+	}()
+	return ln
+}
+
+func TestHTTPConnect(t *testing.T) {
+	target := echoServer(t).Addr().String()
+	auth := "Basic " + base64.StdEncoding.EncodeToString([]byte("user:secret"))
+	px := fakeHTTPProxy(t, auth)
+
+	cfg := Config{Type: HTTP, Addr: px.Addr().String()}
+	_, err := cfg.Dial(target, 5*time.Second)
+	if err == nil || !strings.Contains(err.Error(), "407") {
+		t.Fatalf("without credentials: got %v", err)
+	}
+
+	cfg.Username, cfg.Password = "user", "secret"
+	conn, err := cfg.Dial(target, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkEcho(t, conn)
+
+	if _, err := cfg.Dial("127.0.0.1:1", 5*time.Second); err == nil || !strings.Contains(err.Error(), "502") {
+		t.Fatalf("unreachable target: got %v", err)
+	}
+}
+
+func TestProxyOnlyNeverGoesDirect(t *testing.T) {
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+	direct := make(chan struct{}, 1)
+	go func() {
+		if conn, err := target.Accept(); err == nil {
+			conn.Close()
+			direct <- struct{}{}
+		}
+	}()
+
+	// A proxy that is down must make the dial fail, not go around it.
+	dead, _ := net.Listen("tcp", "127.0.0.1:0")
+	deadAddr := dead.Addr().String()
+	dead.Close()
+	for _, typ := range []Type{SOCKS5, HTTP} {
+		cfg := Config{Type: typ, Addr: deadAddr, Only: true}
+		if _, err := cfg.Dial(target.Addr().String(), 2*time.Second); err == nil {
+			t.Errorf("type %d: dial succeeded with the proxy down", typ)
+		}
+	}
+	select {
+	case <-direct:
+		t.Fatal("the target was reached directly")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// HTTP proxies cannot carry UDP, and there is no direct fallback.
+	cfg := Config{Type: HTTP, Addr: deadAddr, Only: true}
+	if _, err := cfg.ListenPacket(); !errors.Is(err, ErrNoUDP) {
+		t.Fatalf("ListenPacket through an HTTP proxy: got %v, want ErrNoUDP", err)
+	}
+}
@@ -0,0 +1,283 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	socksVersion = 5
+
+	methodNone     = 0x00
+	methodPassword = 0x02
+	methodNoAccept = 0xff
+
+	cmdConnect      = 0x01
+	cmdUDPAssociate = 0x03
+
+	atypIPv4   = 0x01
+	atypDomain = 0x03
+	atypIPv6   = 0x04
+)
+
+var socksReplies = map[byte]string{
+	1: "general failure",
+	2: "connection not allowed by ruleset",
+	3: "network unreachable",
+	4: "host unreachable",
+	5: "connection refused",
+	6: "TTL expired",
+	7: "command not supported",
+	8: "address type not supported",
+}
+
+// socksRequest negotiates authentication on conn and issues cmd for addr,
+// returning the address the proxy bound.
+func (c Config) socksRequest(conn net.Conn, cmd byte, addr string) (string, error) {
+	methods := []byte{methodNone}
+	if c.Username != "" {
+		methods = append(methods, methodPassword)
+	}
+	greeting := append([]byte{socksVersion, byte(len(methods))}, methods...)
+	if _, err := conn.Write(greeting); err != nil {
+		return "", err
+	}
+
+	var choice [2]byte
+	if _, err := io.ReadFull(conn, choice[:]); err != nil {
+		return "", err
+	}
+	if choice[0] != socksVersion {
+		return "", fmt.Errorf("socks5: bad version %d", choice[0])
+	}
+	switch choice[1] {
+	case methodNone:
+	case methodPassword:
+		if err := c.socksAuth(conn); err != nil {
+			return "", err
+		}
+	default:
+		return "", errors.New("socks5: no acceptable authentication method")
+	}
+
+	req := []byte{socksVersion, cmd, 0}
+	req, err := appendSocksAddr(req, addr)
+	if err != nil {
+		return "", err
+	}
+	if _, err := conn.Write(req); err != nil {
+		return "", err
+	}
+
+	var head [3]byte
+	if _, err := io.ReadFull(conn, head[:]); err != nil {
+		return "", err
+	}
+	if head[1] != 0 {
+		reason, ok := socksReplies[head[1]]
+		if !ok {
+			reason = fmt.Sprintf("error %d", head[1])
+		}
+		return "", fmt.Errorf("socks5: %s", reason)
+	}
+	return readSocksAddr(conn)
+}
+
+// socksAuth runs the RFC 1929 username/password exchange.
+func (c Config) socksAuth(conn net.Conn) error {
+	if len(c.Username) > 255 || len(c.Password) > 255 {
+		return errors.New("socks5: credentials too long")
+	}
+	msg := []byte{1, byte(len(c.Username))}
+	msg = append(msg, c.Username...)
+	msg = append(msg, byte(len(c.Password)))
+	msg = append(msg, c.Password...)
+	if _, err := conn.Write(msg); err != nil {
+		return err
+	}
+
+	var reply [2]byte
+	if _, err := io.ReadFull(conn, reply[:]); err != nil {
+		return err
+	}
+	if reply[1] != 0 {
+		return errors.New("socks5: authentication failed")
+	}
+	return nil
+}
+
+func appendSocksAddr(b []byte, addr string) ([]byte, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("socks5: bad port %q", portStr)
+	}
+
+	if ip := net.ParseIP(host); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			b = append(b, atypIPv4)
+			b = append(b, ip4...)
+		} else {
+			b = append(b, atypIPv6)
+			b = append(b, ip.To16()...)
+		}
+	} else {
+		if len(host) > 255 {
+			return nil, errors.New("socks5: host name too long")
+		}
+		b = append(b, atypDomain, byte(len(host)))
+		b = append(b, host...)
+	}
+	return binary.BigEndian.AppendUint16(b, uint16(port)), nil
+}
+
+func readSocksAddr(r io.Reader) (string, error) {
+	var atyp [1]byte
+	if _, err := io.ReadFull(r, atyp[:]); err != nil {
+		return "", err
+	}
+
+	var host string
+	switch atyp[0] {
+	case atypIPv4, atypIPv6:
+		ip := make(net.IP, 4)
+		if atyp[0] == atypIPv6 {
+			ip = make(net.IP, 16)
+		}
+		if _, err := io.ReadFull(r, ip); err != nil {
+			return "", err
+		}
+		host = ip.String()
+	case atypDomain:
+		var n [1]byte
+		if _, err := io.ReadFull(r, n[:]); err != nil {
+			return "", err
+		}
+		name := make([]byte, n[0])
+		if _, err := io.ReadFull(r, name); err != nil {
+			return "", err
+		}
+		host = string(name)
+	default:
+		return "", fmt.Errorf("socks5: bad address type %d", atyp[0])
+	}
+
+	var port [2]byte
+	if _, err := io.ReadFull(r, port[:]); err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port[:])))), nil
+}
+
+// udpAssociate asks the proxy to relay UDP for us. The relay lives as long
+// as the TCP control connection, which the returned PacketConn owns.
+func (c Config) udpAssociate() (net.PacketConn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	ctrl, err := c.Bind.DialContext(ctx, "tcp", c.Addr)
+	if err != nil {
+		return nil, fmt.Errorf("proxy: %w", err)
+	}
+	ctrl.SetDeadline(time.Now().Add(10 * time.Second))
+
+	pc, err := c.Bind.ListenPacket()
+	if err != nil {
+		ctrl.Close()
+		return nil, err
+	}
+
+	// Announce the local address we will send from; unspecified is allowed.
+	bound, err := c.socksRequest(ctrl, cmdUDPAssociate, "0.0.0.0:0")
+	if err != nil {
+		pc.Close()
+		ctrl.Close()
+		return nil, err
+	}
+	ctrl.SetDeadline(time.Time{})
+
+	// Proxies often report 0.0.0.0, meaning "the address you reached me on".
+	relayHost, relayPort, _ := net.SplitHostPort(bound)
+	if ip := net.ParseIP(relayHost); ip == nil || ip.IsUnspecified() {
+		relayHost, _, _ = net.SplitHostPort(c.Addr)
+	}
+	relay, err := net.ResolveUDPAddr("udp", net.JoinHostPort(relayHost, relayPort))
+	if err != nil {
+		pc.Close()
+		ctrl.Close()
+		return nil, err
+	}
+
+	u := &udpConn{PacketConn: pc, ctrl: ctrl, relay: relay}
+	go u.watchControl()
+	return u, nil
+}
+
+// udpConn wraps datagrams in the SOCKS5 UDP request header.
+type udpConn struct {
+	net.PacketConn
+	ctrl      net.Conn
+	relay     *net.UDPAddr
+	closeOnce sync.Once
+}
+
+func (u *udpConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	buf, err := appendSocksAddr([]byte{0, 0, 0}, addr.String())
+	if err != nil {
+		return 0, err
+	}
+	if _, err := u.PacketConn.WriteTo(append(buf, p...), u.relay); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (u *udpConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	buf := make([]byte, 64*1024)
+	for {
+		n, from, err := u.PacketConn.ReadFrom(buf)
+		if err != nil {
+			return 0, nil, err
+		}
+		// Drop anything not coming from the relay, and fragments, which
+		// we do not reassemble.
+		if from.String() != u.relay.String() || n < 4 || buf[2] != 0 {
+			continue
+		}
+		r := bytes.NewReader(buf[3:n])
+		src, err := readSocksAddr(r)
+		if err != nil {
+			continue
+		}
+		addr, err := net.ResolveUDPAddr("udp", src)
+		if err != nil {
+			continue
+		}
+		return copy(p, buf[n-r.Len():n]), addr, nil
+	}
+}
+
+func (u *udpConn) Close() error {
+	u.closeOnce.Do(func() {
+		u.ctrl.Close()
+		u.PacketConn.Close()
+	})
+	return nil
+}
+
+// watchControl closes the socket when the proxy drops the control
+// connection, since the relay stops working at that point.
+func (u *udpConn) watchControl() {
+	io.Copy(io.Discard, u.ctrl)
+	u.Close()
+}
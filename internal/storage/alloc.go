@@ -0,0 +1,132 @@
+package storage
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+)
+
+// Allocation decides how files get their disk space.
+type Allocation int
+
+const (
+	// AllocateNone lets files grow as pieces arrive.
+	AllocateNone Allocation = iota
+	// AllocateSparse sets every file to its final size without reserving
+	// blocks.
+	AllocateSparse
+	// AllocateFull reserves every block before downloading, with
+	// fallocate where the platform has it.
+	AllocateFull
+)
+
+var ErrNoSpace = errors.New("not enough disk space")
+
+// Allocator is implemented by backends that can size their files up front.
+type Allocator interface {
+	// Needed reports how many more bytes of disk the torrent will take.
+	Needed() (int64, error)
+	Allocate(mode Allocation) error
+}
+
+func (s *FileStorage) Needed() (int64, error) {
+	s.moving.RLock()
+	defer s.moving.RUnlock()
+	s.io.RLock()
+	defer s.io.RUnlock()
+
+	s.mu.Lock()
+	skipped := append([]bool(nil), s.skipped...)
+	paths := s.pathsLocked()
+	s.mu.Unlock()
+
+	var needed int64
+	for i, fe := range s.files {
+		if skipped[i] {
+			continue
+		}
+		info, err := os.Stat(paths[i])
+		if os.IsNotExist(err) {
+			needed += fe.length
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+		if used := allocatedSize(info); used < fe.length {
+			needed += fe.length - used
+		}
+	}
+	return needed, nil
+}
+
+// Allocate sizes the wanted files for mode. Empty files are created in
+// every mode, as no write would ever bring them into being.
+func (s *FileStorage) Allocate(mode Allocation) error {
+	s.moving.RLock()
+	defer s.moving.RUnlock()
+	s.io.RLock()
+	defer s.io.RUnlock()
+
+	s.mu.Lock()
+	skipped := append([]bool(nil), s.skipped...)
+	s.mu.Unlock()
+
+	for i, fe := range s.files {
+		if skipped[i] || (mode == AllocateNone && fe.length > 0) {
+			continue
+		}
+		f, err := s.open(i, true)
+		if err != nil {
+			return err
+		}
+		info, err := f.Stat()
+		if err != nil {
+			return err
+		}
+		// A file already at its size may still be sparse, from an
+		// earlier sparse allocation, so full mode always reserves it.
+		switch {
+		case mode == AllocateFull && fe.length > 0:
+			err = fallocate(f, info.Size(), fe.length)
+		case info.Size() < fe.length:
+			err = f.Truncate(fe.length)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeZeros is the portable way to reserve [from, to) of f. It can only be
+// used beyond the data f already holds.
+func writeZeros(f *os.File, from, to int64) error {
+	zeros := make([]byte, 1<<20)
+	for from < to {
+		n := int64(len(zeros))
+		if to-from < n {
+			n = to - from
+		}
+		if _, err := f.WriteAt(zeros[:n], from); err != nil {
+			return err
+		}
+		from += n
+	}
+	return nil
+}
+
+// FreeSpace reports the bytes available to us on the filesystem holding
+// path, or on its nearest existing parent.
+func FreeSpace(path string) (int64, error) {
+	for {
+		if _, err := os.Stat(path); err == nil {
+			return freeSpace(path)
+		}
+		parent := filepath.Dir(path)
+		if parent == path {
+			return 0, os.ErrNotExist
+		}
+		path = parent
+	}
+}
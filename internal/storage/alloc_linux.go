@@ -0,0 +1,17 @@
+package storage
+
+import (
+	"os"
+	"syscall"
+)
+
+// fallocate reserves every block of the first length bytes of f, filling
+// holes without touching data. Where the filesystem cannot, only the part
+// beyond size is written, since zeros would overwrite what is there.
+func fallocate(f *os.File, size, length int64) error {
+	err := syscall.Fallocate(int(f.Fd()), 0, 0, length)
+	if err == syscall.EOPNOTSUPP || err == syscall.ENOSYS {
+		return writeZeros(f, size, length)
+	}
+	return err
+}
@@ -0,0 +1,11 @@
+//go:build !linux
+
+package storage
+
+import "os"
+
+// fallocate can only reserve the part of f beyond size here; holes below
+// it stay sparse.
+func fallocate(f *os.File, size, length int64) error {
+	return writeZeros(f, size, length)
+}
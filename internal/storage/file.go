@@ -1,34 +1,375 @@
 package storage
 
 import (
+	"io"
 	"os"
+	"path/filepath"
+	"sync"
+	"torrent-client/internal/metainfo"
 )
 
-func SavePiece(path string, index int, pieceLength int, data []byte) error {
+// partFile is the handle key of the partfile.
+const partFile = -1
 
-	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+// FileStorage keeps a torrent in ordinary files. Files are opened on first
+// use and stay open until Close.
+//
+// Skipped files that do not exist yet are never created: the bits of them
+// that pieces shared with wanted files bring along go to a sparse partfile
+// instead, at their offset in the torrent.
+//
+// With a suffix, files carry it until every piece they touch is complete
+// and are then renamed to their final name.
+type FileStorage struct {
+	// moving is held by Move and for reading by everything but reads,
+	// which carry on from the old place during a move.
+	moving sync.RWMutex
+	// io is held for reading by every read and write and for writing
+	// whenever files change place or name.
+	io sync.RWMutex
+
+	mu       sync.Mutex
+	meta     *metainfo.TorrentMeta
+	root     string
+	files    []fileEntry
+	handles  map[int]*os.File
+	partPath string
+	skipped  []bool
+	parted   []bool
+
+	suffix   string
+	done     []bool
+	complete []bool
+}
+
+func NewFile(dir string, meta *metainfo.TorrentMeta) (*FileStorage, error) {
+	return NewFileWithSuffix(dir, "", meta)
+}
+
+// NewFileWithSuffix is NewFile with unfinished files named with suffix,
+// such as ".part". A file found under its final name alone is taken as
+// finished.
+func NewFileWithSuffix(dir, suffix string, meta *metainfo.TorrentMeta) (*FileStorage, error) {
+	files, err := layout(dir, meta)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	root, err := RootPath(dir, meta)
+	if err != nil {
+		return nil, err
+	}
+	s := &FileStorage{
+		meta:     meta,
+		root:     root,
+		files:    files,
+		handles:  make(map[int]*os.File),
+		partPath: partPathFor(root),
+		skipped:  make([]bool, len(files)),
+		parted:   make([]bool, len(files)),
+		suffix:   suffix,
+		done:     make([]bool, len(files)),
+		complete: make([]bool, len(meta.Pieces)),
+	}
+	for i, fe := range files {
+		// Empty files have no pieces to wait for.
+		if suffix == "" || fe.length == 0 {
+			s.done[i] = true
+			continue
+		}
+		if _, err := os.Stat(fe.path + suffix); os.IsNotExist(err) {
+			_, err := os.Stat(fe.path)
+			s.done[i] = err == nil
+		}
 	}
-	defer f.Close()
+	return s, nil
+}
+
+// partPathFor names the partfile of the torrent saved at root, next to it
+// and hidden.
+func partPathFor(root string) string {
+	return filepath.Join(filepath.Dir(root), "."+filepath.Base(root)+".parts")
+}
 
-	offset := int64(index) * int64(pieceLength)
-	_, err = f.WriteAt(data, offset)
-	return err
+func (s *FileStorage) path(i int) string {
+	if i == partFile {
+		return s.partPath
+	}
+	if !s.done[i] {
+		return s.files[i].path + s.suffix
+	}
+	return s.files[i].path
+}
+
+// pathsLocked lists where the torrent's files currently are.
+func (s *FileStorage) pathsLocked() []string {
+	paths := make([]string, len(s.files))
+	for i := range s.files {
+		paths[i] = s.path(i)
+	}
+	return paths
 }
 
-func ReadPiece(path string, index int, pieceLength int) ([]byte, error) {
-	f, err := os.Open(path)
+// target returns the handle holding file i and the offset of the file in
+// it, which is non-zero for files kept in the partfile.
+func (s *FileStorage) target(i int, create bool) (*os.File, int64, error) {
+	s.mu.Lock()
+	parted := s.parted[i]
+	s.mu.Unlock()
+
+	if parted {
+		f, err := s.open(partFile, create)
+		return f, s.files[i].offset, err
+	}
+	f, err := s.open(i, create)
+	return f, 0, err
+}
+
+// open returns the handle for file i. Reads do not create missing files.
+func (s *FileStorage) open(i int, create bool) (*os.File, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.openLocked(i, create)
+}
+
+func (s *FileStorage) openLocked(i int, create bool) (*os.File, error) {
+	if f, ok := s.handles[i]; ok {
+		return f, nil
+	}
+	path := s.path(i)
+	if !create {
+		if _, err := os.Stat(path); err != nil {
+			return nil, err
+		}
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
 	if err != nil {
 		return nil, err
 	}
-	defer f.Close()
+	s.handles[i] = f
+	return f, nil
+}
+
+func (s *FileStorage) ReadAt(p []byte, off int64) (int, error) {
+	s.io.RLock()
+	defer s.io.RUnlock()
+
+	n := 0
+	err := spans(s.files, off, len(p), func(i int, fileOff int64, lo, hi int) error {
+		f, base, err := s.target(i, false)
+		if err != nil {
+			return err
+		}
+		m, err := f.ReadAt(p[lo:hi], base+fileOff)
+		n += m
+		return err
+	})
+	return n, err
+}
+
+func (s *FileStorage) WriteAt(p []byte, off int64) (int, error) {
+	s.moving.RLock()
+	defer s.moving.RUnlock()
+	s.io.RLock()
+	defer s.io.RUnlock()
+
+	n := 0
+	err := spans(s.files, off, len(p), func(i int, fileOff int64, lo, hi int) error {
+		f, base, err := s.target(i, true)
+		if err != nil {
+			return err
+		}
+		m, err := f.WriteAt(p[lo:hi], base+fileOff)
+		n += m
+		return err
+	})
+	return n, err
+}
+
+// Paths lists the torrent's files followed by the partfile.
+func (s *FileStorage) Paths() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append(s.pathsLocked(), s.partPath)
+}
+
+// SetSkipped marks the files that are not wanted. A file that comes back
+// gets whatever the partfile held for it, and the partfile is removed once
+// no file needs it.
+func (s *FileStorage) SetSkipped(skip []bool) error {
+	s.moving.RLock()
+	defer s.moving.RUnlock()
+	s.io.Lock()
+	defer s.io.Unlock()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i := range s.files {
+		want := i >= len(skip) || !skip[i]
+		s.skipped[i] = !want
+		if !want && !s.parted[i] {
+			if _, ok := s.handles[i]; ok {
+				continue
+			}
+			if _, err := os.Stat(s.path(i)); os.IsNotExist(err) {
+				s.parted[i] = true
+			}
+		}
+		if want && s.parted[i] {
+			if err := s.unpart(i); err != nil {
+				return err
+			}
+			s.parted[i] = false
+			if err := s.finishLocked(i); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, parted := range s.parted {
+		if parted {
+			return nil
+		}
+	}
+	if f, ok := s.handles[partFile]; ok {
+		f.Close()
+		delete(s.handles, partFile)
+	}
+	if err := os.Remove(s.partPath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
 
-	offset := int64(index) * int64(pieceLength)
-	data := make([]byte, pieceLength)
-	_, err = f.ReadAt(data, offset)
+// unpart copies file i out of the partfile into its own file.
+func (s *FileStorage) unpart(i int) error {
+	part, err := s.openLocked(partFile, false)
+	if os.IsNotExist(err) {
+		return nil
+	}
 	if err != nil {
-		return nil, err
+		return err
+	}
+	f, err := s.openLocked(i, true)
+	if err != nil {
+		return err
+	}
+
+	fe := s.files[i]
+	buf := make([]byte, 1<<20)
+	for done := int64(0); done < fe.length; {
+		n, err := part.ReadAt(buf[:min(int64(len(buf)), fe.length-done)], fe.offset+done)
+		if n > 0 {
+			if _, err := f.WriteAt(buf[:n], done); err != nil {
+				return err
+			}
+			done += int64(n)
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// MarkComplete renames the files that piece completes when a suffix is in
+// use.
+func (s *FileStorage) MarkComplete(piece int) error {
+	if s.suffix == "" {
+		return nil
+	}
+	s.moving.RLock()
+	defer s.moving.RUnlock()
+	s.mu.Lock()
+	s.complete[piece] = true
+	var ready []int
+	for i := range s.files {
+		if s.finished(i) && s.touches(i, piece) {
+			ready = append(ready, i)
+		}
+	}
+	s.mu.Unlock()
+	if len(ready) == 0 {
+		return nil
+	}
+
+	// Handles are closed before the rename, so nobody may be using them.
+	s.io.Lock()
+	defer s.io.Unlock()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, i := range ready {
+		if err := s.finishLocked(i); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *FileStorage) touches(i, piece int) bool {
+	begin := int64(piece) * s.meta.PieceLength
+	fe := s.files[i]
+	return fe.offset < begin+s.meta.PieceLength && begin < fe.offset+fe.length
+}
+
+// finished reports whether file i still has its suffix although every
+// piece it touches is complete.
+func (s *FileStorage) finished(i int) bool {
+	fe := s.files[i]
+	if s.done[i] || s.parted[i] {
+		return false
+	}
+	if fe.length == 0 {
+		return true
+	}
+	first := fe.offset / s.meta.PieceLength
+	last := (fe.offset + fe.length - 1) / s.meta.PieceLength
+	for p := first; p <= last; p++ {
+		if !s.complete[p] {
+			return false
+		}
+	}
+	return true
+}
+
+// finishLocked gives file i its final name if it is finished. Rename
+// replaces whatever had that name in one step, so the final name never
+// shows a partial file. s.io must be held for writing.
+func (s *FileStorage) finishLocked(i int) error {
+	if !s.finished(i) {
+		return nil
+	}
+	if f, ok := s.handles[i]; ok {
+		f.Close()
+		delete(s.handles, i)
+	}
+	fe := s.files[i]
+	if err := os.Rename(fe.path+s.suffix, fe.path); err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	s.done[i] = true
+	return nil
+}
+
+func (s *FileStorage) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var firstErr error
+	for i, f := range s.handles {
+		if err := f.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		delete(s.handles, i)
 	}
-	return data, nil
+	return firstErr
 }
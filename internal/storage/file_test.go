@@ -0,0 +1,313 @@
+package storage
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"torrent-client/internal/metainfo"
+)
+
+// threeFiles is a torrent of three files whose boundaries fall inside
+// 16-byte pieces.
+func threeFiles() (*metainfo.TorrentMeta, []byte) {
+	data := []byte("aaaaaaaaaa" + "bbbbbbbbbbbbbbbbbbbb" + "cccccccccccccccccc")
+	meta := &metainfo.TorrentMeta{
+		Name:        "pack",
+		PieceLength: 16,
+		Length:      int64(len(data)),
+		Pieces:      make([][]byte, (len(data)+15)/16),
+		Files: []metainfo.File{
+			{Path: []string{"a"}, Length: 10},
+			{Path: []string{"dir", "b"}, Length: 20},
+			{Path: []string{"c"}, Length: 18},
+		},
+	}
+	return meta, data
+}
+
+func exists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+func TestSkippedFileGoesToPartfile(t *testing.T) {
+	dir := t.TempDir()
+	meta, data := threeFiles()
+	s, err := NewFile(dir, meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	if err := s.SetSkipped([]bool{false, true, false}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.WriteAt(data, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	skipped := filepath.Join(dir, "pack", "dir", "b")
+	part := filepath.Join(dir, ".pack.parts")
+	if exists(skipped) {
+		t.Error("skipped file was created")
+	}
+	if !exists(part) {
+		t.Fatal("no partfile")
+	}
+	got := make([]byte, len(data))
+	if _, err := s.ReadAt(got, 0); err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("read back %q, %v", got, err)
+	}
+
+	// Wanted again: the file is filled from the partfile, which goes away.
+	if err := s.SetSkipped(nil); err != nil {
+		t.Fatal(err)
+	}
+	content, err := os.ReadFile(skipped)
+	if err != nil || string(content) != string(data[10:30]) {
+		t.Errorf("unskipped file holds %q, %v", content, err)
+	}
+	if exists(part) {
+		t.Error("partfile left behind")
+	}
+	if paths := s.Paths(); paths[len(paths)-1] != part {
+		t.Errorf("Paths ends with %s, want the partfile", paths[len(paths)-1])
+	}
+}
+
+func TestSkippedExistingFileIsWrittenInPlace(t *testing.T) {
+	dir := t.TempDir()
+	meta, data := threeFiles()
+	existing := filepath.Join(dir, "pack", "dir", "b")
+	os.MkdirAll(filepath.Dir(existing), 0755)
+	if err := os.WriteFile(existing, make([]byte, 20), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := NewFile(dir, meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if err := s.SetSkipped([]bool{false, true, false}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.WriteAt(data, 0); err != nil {
+		t.Fatal(err)
+	}
+	if exists(filepath.Join(dir, ".pack.parts")) {
+		t.Error("data of an existing file went to the partfile")
+	}
+	content, _ := os.ReadFile(existing)
+	if string(content) != string(data[10:30]) {
+		t.Errorf("existing file holds %q", content)
+	}
+}
+
+func TestAllocateSkipsSkippedFiles(t *testing.T) {
+	dir := t.TempDir()
+	meta, _ := threeFiles()
+	s, err := NewFile(dir, meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	s.SetSkipped([]bool{true, false, false})
+
+	needed, err := s.Needed()
+	if err != nil || needed != 38 {
+		t.Errorf("Needed = %d, %v; want 38", needed, err)
+	}
+	if err := s.Allocate(AllocateSparse); err != nil {
+		t.Fatal(err)
+	}
+	if exists(filepath.Join(dir, "pack", "a")) {
+		t.Error("skipped file was allocated")
+	}
+	info, err := os.Stat(filepath.Join(dir, "pack", "c"))
+	if err != nil || info.Size() != 18 {
+		t.Errorf("wanted file not allocated: %v", err)
+	}
+}
+
+func TestEmptyFilesGetFinalName(t *testing.T) {
+	for _, mode := range []Allocation{AllocateNone, AllocateSparse, AllocateFull} {
+		for _, suffix := range []string{"", ".part"} {
+			dir := t.TempDir()
+			meta := &metainfo.TorrentMeta{
+				Name:        "pack",
+				PieceLength: 16,
+				Length:      20,
+				Pieces:      make([][]byte, 2),
+				Files: []metainfo.File{
+					{Path: []string{"a"}, Length: 10},
+					{Path: []string{"empty"}, Length: 0},
+					{Path: []string{"b"}, Length: 10},
+				},
+			}
+			s, err := NewFileWithSuffix(dir, suffix, meta)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := s.Allocate(mode); err != nil {
+				t.Fatal(err)
+			}
+			empty := filepath.Join(dir, "pack", "empty")
+			if !exists(empty) {
+				t.Errorf("mode %d, suffix %q: empty file not created", mode, suffix)
+			}
+			if suffix != "" && exists(empty+suffix) {
+				t.Errorf("mode %d: empty file carries the suffix", mode)
+			}
+			if paths := s.Paths(); paths[1] != empty {
+				t.Errorf("mode %d, suffix %q: Paths has %s", mode, suffix, paths[1])
+			}
+			s.Close()
+		}
+	}
+}
+
+func TestSuffixDroppedAsFilesComplete(t *testing.T) {
+	dir := t.TempDir()
+	meta, data := threeFiles()
+	s, err := NewFileWithSuffix(dir, ".part", meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if _, err := s.WriteAt(data, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	a := filepath.Join(dir, "pack", "a")
+	b := filepath.Join(dir, "pack", "dir", "b")
+	c := filepath.Join(dir, "pack", "c")
+	// Piece 0 covers all of a and the start of b, piece 1 the rest of b
+	// and the start of c, piece 2 the rest of c.
+	steps := []struct {
+		piece int
+		final []string
+		part  []string
+	}{
+		{0, []string{a}, []string{b, c}},
+		{2, []string{a}, []string{b, c}},
+		{1, []string{a, b, c}, nil},
+	}
+	for _, step := range steps {
+		if err := s.MarkComplete(step.piece); err != nil {
+			t.Fatal(err)
+		}
+		for _, path := range step.final {
+			if !exists(path) || exists(path+".part") {
+				t.Errorf("after piece %d: %s is not under its final name", step.piece, path)
+			}
+		}
+		for _, path := range step.part {
+			if exists(path) || !exists(path+".part") {
+				t.Errorf("after piece %d: %s lost its suffix early", step.piece, path)
+			}
+		}
+	}
+
+	got := make([]byte, len(data))
+	if _, err := s.ReadAt(got, 0); err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("read back %q, %v", got, err)
+	}
+}
+
+func TestSuffixFinalNameTakenAsFinished(t *testing.T) {
+	dir := t.TempDir()
+	meta, data := threeFiles()
+	final := filepath.Join(dir, "pack", "a")
+	os.MkdirAll(filepath.Dir(final), 0755)
+	if err := os.WriteFile(final, data[:10], 0644); err != nil {
+		t.Fatal(err)
+	}
+	// b has both names, as after a crash between writes; the suffixed one
+	// is still the one in use.
+	b := filepath.Join(dir, "pack", "dir", "b")
+	os.MkdirAll(filepath.Dir(b), 0755)
+	os.WriteFile(b, []byte("stale"), 0644)
+	os.WriteFile(b+".part", make([]byte, 20), 0644)
+
+	s, err := NewFileWithSuffix(dir, ".part", meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	paths := s.Paths()
+	if paths[0] != final || paths[1] != b+".part" || paths[2] != filepath.Join(dir, "pack", "c.part") {
+		t.Errorf("Paths = %v", paths)
+	}
+	got := make([]byte, 10)
+	if _, err := s.ReadAt(got, 0); err != nil || !bytes.Equal(got, data[:10]) {
+		t.Errorf("read %q, %v from the finished file", got, err)
+	}
+
+	// Completing b replaces the stale file with the downloaded one.
+	if _, err := s.WriteAt(data[10:30], 10); err != nil {
+		t.Fatal(err)
+	}
+	s.MarkComplete(0)
+	s.MarkComplete(1)
+	content, err := os.ReadFile(b)
+	if err != nil || !bytes.Equal(content, data[10:30]) {
+		t.Errorf("b holds %q, %v", content, err)
+	}
+	if exists(b + ".part") {
+		t.Error("b kept its suffixed copy")
+	}
+}
+
+func TestFullAllocationFillsSparseFiles(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("only fallocate can fill holes below a file's size")
+	}
+	dir := t.TempDir()
+	const length = 4 << 20
+	meta := &metainfo.TorrentMeta{
+		Name:        "big.bin",
+		PieceLength: 1 << 20,
+		Length:      length,
+		Pieces:      make([][]byte, 4),
+	}
+	s, err := NewFile(dir, meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	path := filepath.Join(dir, "big.bin")
+
+	if err := s.Allocate(AllocateSparse); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if allocatedSize(info) >= length {
+		t.Skip("the filesystem does not keep files sparse")
+	}
+	if _, err := s.WriteAt([]byte("piece data"), 0); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Allocate(AllocateFull); err != nil {
+		t.Fatal(err)
+	}
+	info, _ = os.Stat(path)
+	if allocatedSize(info) < length {
+		t.Errorf("%d bytes reserved after full allocation, want %d", allocatedSize(info), length)
+	}
+	if needed, err := s.Needed(); err != nil || needed != 0 {
+		t.Errorf("Needed = %d, %v after full allocation", needed, err)
+	}
+	got := make([]byte, 10)
+	if _, err := s.ReadAt(got, 0); err != nil || string(got) != "piece data" {
+		t.Errorf("data before the allocation became %q, %v", got, err)
+	}
+}
@@ -0,0 +1,48 @@
+package storage
+
+import (
+	"io"
+	"sync"
+	"torrent-client/internal/metainfo"
+)
+
+// MemoryStorage keeps the whole torrent in RAM, which suits small torrents
+// and tests.
+type MemoryStorage struct {
+	mu   sync.RWMutex
+	data []byte
+}
+
+func NewMemory(meta *metainfo.TorrentMeta) *MemoryStorage {
+	return &MemoryStorage{data: make([]byte, meta.Length)}
+}
+
+func (s *MemoryStorage) ReadAt(p []byte, off int64) (int, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if off < 0 || off >= int64(len(s.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, s.data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (s *MemoryStorage) WriteAt(p []byte, off int64) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if off < 0 || off+int64(len(p)) > int64(len(s.data)) {
+		return 0, io.ErrShortWrite
+	}
+	return copy(s.data[off:], p), nil
+}
+
+func (s *MemoryStorage) MarkComplete(piece int) error {
+	return nil
+}
+
+func (s *MemoryStorage) Close() error {
+	return nil
+}
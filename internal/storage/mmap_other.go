@@ -0,0 +1,13 @@
+//go:build !(linux || darwin || freebsd || netbsd || openbsd || dragonfly)
+
+package storage
+
+import (
+	"errors"
+	"torrent-client/internal/metainfo"
+)
+
+// NewMmap is unavailable on this platform; use NewFile instead.
+func NewMmap(dir string, meta *metainfo.TorrentMeta) (Storage, error) {
+	return nil, errors.New("mmap storage is not supported on this platform")
+}
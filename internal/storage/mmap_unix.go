@@ -0,0 +1,114 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd || dragonfly
+
+package storage
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"torrent-client/internal/metainfo"
+)
+
+// MmapStorage maps every file of the torrent into memory, leaving caching
+// and write-back to the kernel. Files are created at full size up front.
+type MmapStorage struct {
+	mu     sync.RWMutex
+	files  []fileEntry
+	maps   [][]byte
+	closed bool
+}
+
+func NewMmap(dir string, meta *metainfo.TorrentMeta) (*MmapStorage, error) {
+	files, err := layout(dir, meta)
+	if err != nil {
+		return nil, err
+	}
+	s := &MmapStorage{files: files}
+	for _, fe := range s.files {
+		m, err := mapFile(fe)
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+		s.maps = append(s.maps, m)
+	}
+	return s, nil
+}
+
+func mapFile(fe fileEntry) ([]byte, error) {
+	if err := os.MkdirAll(filepath.Dir(fe.path), 0755); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(fe.path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	// The mapping stays valid after the descriptor is closed.
+	defer f.Close()
+
+	if fe.length == 0 {
+		return nil, nil
+	}
+	if err := f.Truncate(fe.length); err != nil {
+		return nil, err
+	}
+	return syscall.Mmap(int(f.Fd()), 0, int(fe.length), syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
+}
+
+func (s *MmapStorage) ReadAt(p []byte, off int64) (int, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.closed {
+		return 0, os.ErrClosed
+	}
+	n := 0
+	err := spans(s.files, off, len(p), func(i int, fileOff int64, lo, hi int) error {
+		n += copy(p[lo:hi], s.maps[i][fileOff:])
+		return nil
+	})
+	return n, err
+}
+
+func (s *MmapStorage) WriteAt(p []byte, off int64) (int, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.closed {
+		return 0, os.ErrClosed
+	}
+	n := 0
+	err := spans(s.files, off, len(p), func(i int, fileOff int64, lo, hi int) error {
+		n += copy(s.maps[i][fileOff:], p[lo:hi])
+		return nil
+	})
+	return n, err
+}
+
+func (s *MmapStorage) Paths() []string {
+	return filePaths(s.files)
+}
+
+func (s *MmapStorage) MarkComplete(piece int) error {
+	return nil
+}
+
+func (s *MmapStorage) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+
+	var firstErr error
+	for i, m := range s.maps {
+		if m == nil {
+			continue
+		}
+		if err := syscall.Munmap(m); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		s.maps[i] = nil
+	}
+	return firstErr
+}
@@ -0,0 +1,36 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd || dragonfly
+
+package storage
+
+import (
+	"errors"
+	"os"
+	"testing"
+
+	"torrent-client/internal/metainfo"
+)
+
+func TestMmapAfterClose(t *testing.T) {
+	meta := &metainfo.TorrentMeta{Name: "data", PieceLength: 16, Length: 32}
+	s, err := NewMmap(t.TempDir(), meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.WriteAt([]byte("hello"), 3); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, 5)
+	if _, err := s.ReadAt(buf, 3); !errors.Is(err, os.ErrClosed) {
+		t.Errorf("ReadAt after Close: got %v, want os.ErrClosed", err)
+	}
+	if _, err := s.WriteAt(buf, 3); !errors.Is(err, os.ErrClosed) {
+		t.Errorf("WriteAt after Close: got %v, want os.ErrClosed", err)
+	}
+	if err := s.Close(); err != nil {
+		t.Errorf("second Close: %v", err)
+	}
+}
@@ -0,0 +1,205 @@
+package storage
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// Mover is implemented by backends whose data can be relocated to another
+// directory while the torrent is in use. Reads are served from the old
+// location until the move is over; writes wait for it.
+type Mover interface {
+	Move(dir string) error
+}
+
+// movedFile remembers how one file got to its new place, so a failed move
+// can be undone.
+type movedFile struct {
+	from, to string
+	copied   bool
+}
+
+// relocate is moveFile; tests replace it to hold a move halfway.
+var relocate = moveFile
+
+// Move puts the torrent below dir. Files are renamed where possible and
+// copied when dir is on another filesystem; the originals of copies are
+// only removed once every file has arrived, so a failure leaves the torrent
+// where it was.
+//
+// The files are opened before anything moves and reads go through those
+// handles meanwhile, which stay valid across a rename. Only the final swap
+// to the new paths waits for reads in progress.
+func (s *FileStorage) Move(dir string) error {
+	s.moving.Lock()
+	defer s.moving.Unlock()
+
+	files, err := layout(dir, s.meta)
+	if err != nil {
+		return err
+	}
+	root, err := RootPath(dir, s.meta)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	if filepath.Clean(root) == filepath.Clean(s.root) {
+		s.mu.Unlock()
+		return nil
+	}
+	from := append(s.pathsLocked(), s.partPath)
+	oldRoot := s.root
+	err = s.pinLocked()
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	var to []string
+	for i, fe := range files {
+		if !s.done[i] {
+			fe.path += s.suffix
+		}
+		to = append(to, fe.path)
+	}
+	to = append(to, partPathFor(root))
+	var moved []movedFile
+	fail := func(err error) error {
+		undoMove(moved)
+		if len(s.meta.Files) > 0 {
+			removeEmptyDirs(root)
+		}
+		return err
+	}
+	for i := range from {
+		if _, err := os.Stat(from[i]); os.IsNotExist(err) {
+			continue
+		}
+		if _, err := os.Lstat(to[i]); err == nil {
+			return fail(fmt.Errorf("%s already exists", to[i]))
+		}
+		copied, err := relocate(from[i], to[i])
+		if err != nil {
+			return fail(err)
+		}
+		moved = append(moved, movedFile{from: from[i], to: to[i], copied: copied})
+	}
+
+	s.io.Lock()
+	defer s.io.Unlock()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, f := range s.handles {
+		f.Close()
+		delete(s.handles, i)
+	}
+	for _, m := range moved {
+		if m.copied {
+			os.Remove(m.from)
+		}
+	}
+	if len(s.meta.Files) > 0 {
+		removeEmptyDirs(oldRoot)
+	}
+
+	s.root = root
+	s.files = files
+	s.partPath = partPathFor(root)
+	return nil
+}
+
+// pinLocked opens every file that exists, the partfile included.
+func (s *FileStorage) pinLocked() error {
+	for i := partFile; i < len(s.files); i++ {
+		if _, err := s.openLocked(i, false); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// moveFile renames from to to, copying instead when rename fails, as it
+// does across filesystems.
+func moveFile(from, to string) (copied bool, err error) {
+	if err := os.MkdirAll(filepath.Dir(to), 0755); err != nil {
+		return false, err
+	}
+	if os.Rename(from, to) == nil {
+		return false, nil
+	}
+	if err := copyFile(from, to); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// copyFile copies from to to, keeping the modification time so resume data
+// still matches. The copy is made under a hidden name and renamed at the
+// end, so to never holds half a file.
+func copyFile(from, to string) error {
+	src, err := os.Open(from)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	info, err := src.Stat()
+	if err != nil {
+		return err
+	}
+
+	tmp := filepath.Join(filepath.Dir(to), "."+filepath.Base(to)+".moving")
+	dst, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_EXCL, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(dst, src)
+	if err == nil {
+		err = dst.Sync()
+	}
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chtimes(tmp, info.ModTime(), info.ModTime())
+	}
+	if err == nil {
+		err = os.Rename(tmp, to)
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}
+
+// undoMove puts already moved files back, newest first.
+func undoMove(moved []movedFile) {
+	for i := len(moved) - 1; i >= 0; i-- {
+		m := moved[i]
+		if m.copied {
+			os.Remove(m.to)
+			continue
+		}
+		if err := os.Rename(m.to, m.from); err != nil {
+			fmt.Printf("Could not move %s back to %s: %v\n", m.to, m.from, err)
+		}
+	}
+}
+
+// removeEmptyDirs deletes dir and the directories below it that are left
+// empty, ignoring any that still hold something.
+func removeEmptyDirs(dir string) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	for _, e := range entries {
+		if e.IsDir() {
+			removeEmptyDirs(filepath.Join(dir, e.Name()))
+		}
+	}
+	os.Remove(dir)
+}
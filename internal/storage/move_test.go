@@ -0,0 +1,136 @@
+package storage
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestMoveCarriesPartfile(t *testing.T) {
+	dir, dest := t.TempDir(), t.TempDir()
+	meta, data := threeFiles()
+	s, err := NewFile(dir, meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	s.SetSkipped([]bool{false, true, false})
+	if _, err := s.WriteAt(data, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Move(dest); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{"pack/a", "pack/c", ".pack.parts"} {
+		if !exists(filepath.Join(dest, path)) {
+			t.Errorf("%s did not arrive", path)
+		}
+	}
+	if exists(filepath.Join(dir, "pack")) || exists(filepath.Join(dir, ".pack.parts")) {
+		t.Error("the old location was left behind")
+	}
+	got := make([]byte, len(data))
+	if _, err := s.ReadAt(got, 0); err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("read back %q, %v", got, err)
+	}
+}
+
+func TestMoveRollsBack(t *testing.T) {
+	dir, dest := t.TempDir(), t.TempDir()
+	meta, data := threeFiles()
+	s, err := NewFile(dir, meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if _, err := s.WriteAt(data, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	// The last file is in the way, so the first two have to go back.
+	blocker := filepath.Join(dest, "pack", "c")
+	os.MkdirAll(filepath.Dir(blocker), 0755)
+	if err := os.WriteFile(blocker, []byte("mine"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Move(dest); err == nil {
+		t.Fatal("Move replaced a file that was already there")
+	}
+	for _, path := range []string{"pack/a", "pack/dir/b", "pack/c"} {
+		if !exists(filepath.Join(dir, path)) {
+			t.Errorf("%s was not put back", path)
+		}
+	}
+	if exists(filepath.Join(dest, "pack", "a")) || exists(filepath.Join(dest, "pack", "dir")) {
+		t.Error("moved files were left at the destination")
+	}
+	if content, _ := os.ReadFile(blocker); string(content) != "mine" {
+		t.Errorf("the file in the way now holds %q", content)
+	}
+	got := make([]byte, len(data))
+	if _, err := s.ReadAt(got, 0); err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("read back %q, %v", got, err)
+	}
+}
+
+func TestReadsContinueDuringMove(t *testing.T) {
+	dir, dest := t.TempDir(), t.TempDir()
+	meta, data := threeFiles()
+	s, err := NewFile(dir, meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if _, err := s.WriteAt(data, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	// Hold the move once the second file has been moved.
+	halfway, resume := make(chan struct{}), make(chan struct{})
+	calls := 0
+	relocate = func(from, to string) (bool, error) {
+		calls++
+		copied, err := moveFile(from, to)
+		if calls == 2 {
+			close(halfway)
+			<-resume
+		}
+		return copied, err
+	}
+	defer func() { relocate = moveFile }()
+
+	moved := make(chan error, 1)
+	go func() { moved <- s.Move(dest) }()
+	<-halfway
+
+	got := make([]byte, len(data))
+	if _, err := s.ReadAt(got, 0); err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("read during the move got %q, %v", got, err)
+	}
+	wrote := make(chan error, 1)
+	go func() {
+		_, err := s.WriteAt([]byte("x"), 0)
+		wrote <- err
+	}()
+	select {
+	case <-wrote:
+		t.Fatal("a write went through during the move")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(resume)
+	if err := <-moved; err != nil {
+		t.Fatal(err)
+	}
+	if err := <-wrote; err != nil {
+		t.Fatal(err)
+	}
+	content, err := os.ReadFile(filepath.Join(dest, "pack", "a"))
+	if err != nil || content[0] != 'x' {
+		t.Errorf("the write did not land in the new place: %q, %v", content, err)
+	}
+}
@@ -0,0 +1,163 @@
+package storage
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"torrent-client/internal/metainfo"
+	"unicode/utf8"
+)
+
+// maxComponentLength is the common filesystem limit on one path element,
+// in bytes.
+const maxComponentLength = 255
+
+var reservedNames = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true,
+	"COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true,
+	"LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+// SanitizeComponent makes one element of a torrent's name or file path safe
+// to create below the save directory. Anything that could climb out of it
+// (empty, ".", "..", separators, absolute paths) is rejected; characters
+// that some filesystems refuse are replaced and long names are shortened,
+// keeping the extension.
+func SanitizeComponent(name string) (string, error) {
+	if name == "" || name == "." || name == ".." {
+		return "", fmt.Errorf("invalid path component %q", name)
+	}
+	if strings.ContainsAny(name, `/\`) || filepath.IsAbs(name) || filepath.VolumeName(name) != "" {
+		return "", fmt.Errorf("path component %q contains a separator", name)
+	}
+
+	var b strings.Builder
+	for _, r := range name {
+		if r < 0x20 || r == 0x7f || strings.ContainsRune(`<>:"|?*`, r) {
+			b.WriteByte('_')
+			continue
+		}
+		b.WriteRune(r)
+	}
+	clean := strings.TrimRight(b.String(), ". ")
+	if clean == "" {
+		return "", fmt.Errorf("invalid path component %q", name)
+	}
+
+	base := clean
+	if i := strings.IndexByte(base, '.'); i >= 0 {
+		base = base[:i]
+	}
+	if reservedNames[strings.ToUpper(base)] {
+		clean = "_" + clean
+	}
+
+	if len(clean) > maxComponentLength {
+		ext := filepath.Ext(clean)
+		if len(ext) > maxComponentLength/4 {
+			ext = ""
+		}
+		stem := clean[:maxComponentLength-len(ext)]
+		// Don't cut a multi-byte character in half.
+		for !utf8.ValidString(stem) {
+			stem = stem[:len(stem)-1]
+		}
+		clean = stem + ext
+	}
+	return clean, nil
+}
+
+// RootPath is where meta lives below dir: the file itself for a single-file
+// torrent, its top directory otherwise.
+func RootPath(dir string, meta *metainfo.TorrentMeta) (string, error) {
+	name, err := SanitizeComponent(meta.Name)
+	if err != nil {
+		return "", fmt.Errorf("torrent name: %w", err)
+	}
+	return filepath.Join(dir, name), nil
+}
+
+// layout lists the files of meta below dir, with every path element
+// sanitized. Paths that sanitizing made equal, or that would collide with
+// a directory of the same name, are numbered to keep them apart; names
+// differing only in case count as equal, since many filesystems ignore it.
+func layout(dir string, meta *metainfo.TorrentMeta) ([]fileEntry, error) {
+	root, err := RootPath(dir, meta)
+	if err != nil {
+		return nil, err
+	}
+	if len(meta.Files) == 0 {
+		return []fileEntry{{path: root, length: meta.Length}}, nil
+	}
+
+	taken := make(map[string]bool)
+	// dirs maps a directory as the torrent names it to where it went, so
+	// its files stay together.
+	dirs := make(map[string]string)
+	entries := make([]fileEntry, 0, len(meta.Files))
+	var offset int64
+	for _, f := range meta.Files {
+		if len(f.Path) == 0 {
+			return nil, fmt.Errorf("file with empty path")
+		}
+		path, key := root, ""
+		for i, p := range f.Path {
+			key += "/" + p
+			last := i == len(f.Path)-1
+			if d, ok := dirs[key]; ok && !last {
+				path = d
+				continue
+			}
+			clean, err := SanitizeComponent(p)
+			if err != nil {
+				return nil, fmt.Errorf("file %q: %w", strings.Join(f.Path, "/"), err)
+			}
+			path = uniquePath(filepath.Join(path, clean), taken)
+			taken[strings.ToLower(path)] = true
+			if !last {
+				dirs[key] = path
+			}
+		}
+		entries = append(entries, fileEntry{path: path, offset: offset, length: f.Length})
+		offset += f.Length
+	}
+	return entries, nil
+}
+
+// uniquePath returns path, or if it is taken the first free "name (n).ext"
+// next to it.
+func uniquePath(path string, taken map[string]bool) string {
+	if !taken[strings.ToLower(path)] {
+		return path
+	}
+	dir, name := filepath.Split(path)
+	ext := filepath.Ext(name)
+	if len(ext) > maxComponentLength/4 {
+		ext = ""
+	}
+	stem := strings.TrimSuffix(name, ext)
+	for n := 1; ; n++ {
+		suffix := fmt.Sprintf(" (%d)%s", n, ext)
+		s := stem
+		if len(s)+len(suffix) > maxComponentLength {
+			s = s[:maxComponentLength-len(suffix)]
+			for !utf8.ValidString(s) {
+				s = s[:len(s)-1]
+			}
+		}
+		candidate := filepath.Join(dir, s+suffix)
+		if !taken[strings.ToLower(candidate)] {
+			return candidate
+		}
+	}
+}
+
+func filePaths(files []fileEntry) []string {
+	paths := make([]string, len(files))
+	for i, f := range files {
+		paths[i] = f.path
+	}
+	return paths
+}
@@ -0,0 +1,139 @@
+package storage
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"torrent-client/internal/metainfo"
+)
+
+func TestSanitizeComponent(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"movie.mkv", "movie.mkv"},
+		{"a:b?c*d", "a_b_c_d"},
+		{"tab\there", "tab_here"},
+		{"trailing. . ", "trailing"},
+		{"CON", "_CON"},
+		{"con.txt", "_con.txt"},
+		{"CONSOLE", "CONSOLE"},
+	}
+	for _, tt := range tests {
+		got, err := SanitizeComponent(tt.in)
+		if err != nil || got != tt.want {
+			t.Errorf("SanitizeComponent(%q) = %q, %v; want %q", tt.in, got, err, tt.want)
+		}
+	}
+
+	for _, bad := range []string{"", ".", "..", "a/b", `a\b`, "/etc", "...", " "} {
+		if got, err := SanitizeComponent(bad); err == nil {
+			t.Errorf("SanitizeComponent(%q) = %q, want an error", bad, got)
+		}
+	}
+}
+
+func TestSanitizeComponentShortensLongNames(t *testing.T) {
+	long := strings.Repeat("é", 200) + ".mkv"
+	got, err := SanitizeComponent(long)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) > maxComponentLength {
+		t.Errorf("kept %d bytes, limit is %d", len(got), maxComponentLength)
+	}
+	if !strings.HasSuffix(got, ".mkv") {
+		t.Errorf("lost the extension: %q", got)
+	}
+	if !utf8.ValidString(got) {
+		t.Error("cut a character in half")
+	}
+}
+
+func TestLayoutStaysBelowDir(t *testing.T) {
+	dir := t.TempDir()
+	meta := &metainfo.TorrentMeta{
+		Name: "pack",
+		Files: []metainfo.File{
+			{Path: []string{"sub", "a.bin"}, Length: 3},
+			{Path: []string{"b?.bin"}, Length: 4},
+		},
+	}
+	files, err := layout(dir, meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		filepath.Join(dir, "pack", "sub", "a.bin"),
+		filepath.Join(dir, "pack", "b_.bin"),
+	}
+	for i, fe := range files {
+		if fe.path != want[i] {
+			t.Errorf("file %d at %s, want %s", i, fe.path, want[i])
+		}
+	}
+	if files[1].offset != 3 {
+		t.Errorf("second file at offset %d, want 3", files[1].offset)
+	}
+
+	for _, path := range [][]string{{"..", "escape"}, {"sub", "..", "..", "x"}, {}} {
+		meta.Files = []metainfo.File{{Path: path, Length: 1}}
+		if _, err := layout(dir, meta); err == nil {
+			t.Errorf("layout accepted %q", path)
+		}
+	}
+	meta.Name = ".."
+	if _, err := RootPath(dir, meta); err == nil {
+		t.Error("RootPath accepted the name \"..\"")
+	}
+}
+
+func TestLayoutKeepsPathsApart(t *testing.T) {
+	dir := t.TempDir()
+	meta := &metainfo.TorrentMeta{
+		Name: "pack",
+		Files: []metainfo.File{
+			{Path: []string{"a?.txt"}, Length: 1},
+			{Path: []string{"a*.txt"}, Length: 1},
+			{Path: []string{"A_.TXT"}, Length: 1},
+			{Path: []string{"sub:", "x"}, Length: 1},
+			{Path: []string{"sub?", "x"}, Length: 1},
+			{Path: []string{"sub:", "y"}, Length: 1},
+			{Path: []string{"sub_"}, Length: 1},
+			{Path: []string{strings.Repeat("n", 254) + "?"}, Length: 1},
+			{Path: []string{strings.Repeat("n", 254) + "*"}, Length: 1},
+		},
+	}
+	files, err := layout(dir, meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	root := filepath.Join(dir, "pack")
+	want := []string{
+		filepath.Join(root, "a_.txt"),
+		filepath.Join(root, "a_ (1).txt"),
+		filepath.Join(root, "A_ (2).TXT"),
+		filepath.Join(root, "sub_", "x"),
+		filepath.Join(root, "sub_ (1)", "x"),
+		filepath.Join(root, "sub_", "y"),
+		filepath.Join(root, "sub_ (2)"),
+		filepath.Join(root, strings.Repeat("n", 254)+"_"),
+		filepath.Join(root, strings.Repeat("n", 251)+" (1)"),
+	}
+	for i, fe := range files {
+		if fe.path != want[i] {
+			t.Errorf("file %d at %s, want %s", i, fe.path, want[i])
+		}
+	}
+
+	// The same torrent always lays out the same way, or resume data and
+	// moves would lose track of files.
+	again, _ := layout(dir, meta)
+	for i := range files {
+		if again[i].path != files[i].path {
+			t.Fatalf("file %d moved to %s on a second layout", i, again[i].path)
+		}
+	}
+}
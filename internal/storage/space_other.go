@@ -0,0 +1,16 @@
+//go:build !(linux || darwin || freebsd)
+
+package storage
+
+import (
+	"errors"
+	"os"
+)
+
+func freeSpace(path string) (int64, error) {
+	return 0, errors.New("free space is unknown on this platform")
+}
+
+func allocatedSize(info os.FileInfo) int64 {
+	return info.Size()
+}
@@ -0,0 +1,91 @@
+package storage
+
+import (
+	"io"
+	"torrent-client/internal/metainfo"
+)
+
+// Storage holds the data of one torrent. Offsets are into the torrent as a
+// whole, so multi-file torrents cross file boundaries transparently.
+// Implementations must be safe for concurrent use.
+type Storage interface {
+	ReadAt(p []byte, off int64) (int, error)
+	WriteAt(p []byte, off int64) (int, error)
+	// MarkComplete is called once a piece has been written and verified.
+	MarkComplete(piece int) error
+	Close() error
+}
+
+// FileBacked is implemented by backends that keep the torrent in files on
+// disk, so callers can tell whether those changed behind their back.
+type FileBacked interface {
+	Paths() []string
+}
+
+// Skipper is implemented by backends that can avoid creating files the
+// user does not want. skip is indexed like the torrent's files.
+type Skipper interface {
+	SetSkipped(skip []bool) error
+}
+
+// Opener creates the Storage for a torrent. Library users can supply their
+// own to keep data elsewhere, such as an object store.
+type Opener func(meta *metainfo.TorrentMeta) (Storage, error)
+
+func FileOpener(dir string) Opener {
+	return func(meta *metainfo.TorrentMeta) (Storage, error) {
+		return NewFile(dir, meta)
+	}
+}
+
+// FileOpenerWithSuffix names files that are not complete yet with suffix.
+func FileOpenerWithSuffix(dir, suffix string) Opener {
+	return func(meta *metainfo.TorrentMeta) (Storage, error) {
+		return NewFileWithSuffix(dir, suffix, meta)
+	}
+}
+
+func MemoryOpener() Opener {
+	return func(meta *metainfo.TorrentMeta) (Storage, error) {
+		return NewMemory(meta), nil
+	}
+}
+
+func MmapOpener(dir string) Opener {
+	return func(meta *metainfo.TorrentMeta) (Storage, error) {
+		return NewMmap(dir, meta)
+	}
+}
+
+// fileEntry places one file of the torrent on disk and in the torrent's
+// byte stream.
+type fileEntry struct {
+	path   string
+	offset int64
+	length int64
+}
+
+// spans calls fn for each file that the n bytes at off touch, with the
+// offset into that file and the matching range of the caller's buffer.
+// Reads past the last file end with io.EOF.
+func spans(files []fileEntry, off int64, n int, fn func(i int, fileOff int64, lo, hi int) error) error {
+	done := 0
+	for i, f := range files {
+		if done == n {
+			break
+		}
+		pos := off + int64(done)
+		if pos >= f.offset+f.length || f.length == 0 {
+			continue
+		}
+		chunk := int(min(int64(n-done), f.offset+f.length-pos))
+		if err := fn(i, pos-f.offset, done, done+chunk); err != nil {
+			return err
+		}
+		done += chunk
+	}
+	if done < n {
+		return io.EOF
+	}
+	return nil
+}
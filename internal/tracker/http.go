@@ -8,12 +8,18 @@ import (
 	"net"
 	"net/http"
 	"net/url"
+	"strings"
 	"time"
 
 	"torrent-client/internal/bencode"
 	"torrent-client/internal/metainfo"
+	"torrent-client/internal/proxy"
 )
 
+// DefaultPort is announced by GetPeers, which does not know our listen
+// port.
+const DefaultPort = 6881
+
 type Peer struct {
 	IP   net.IP
 	Port uint16
@@ -42,7 +48,7 @@ func escapeBytes(b []byte) string {
 	return out
 }
 
-func buildAnnounceURL(meta *metainfo.TorrentMeta) (string, error) {
+func buildAnnounceURL(meta *metainfo.TorrentMeta, port uint16) (string, error) {
 	peerID, err := GeneratePeerID()
 	if err != nil {
 		return "", err
@@ -55,7 +61,7 @@ func buildAnnounceURL(meta *metainfo.TorrentMeta) (string, error) {
 
 	q := u.Query()
 
-	q.Set("port", "6881")
+	q.Set("port", fmt.Sprint(port))
 	q.Set("uploaded", "0")
 	q.Set("downloaded", "0")
 	q.Set("left", fmt.Sprintf("%d", meta.Length))
@@ -76,13 +82,27 @@ func buildAnnounceURL(meta *metainfo.TorrentMeta) (string, error) {
 }
 
 func GetPeers(meta *metainfo.TorrentMeta) ([]Peer, error) {
-	url, err := buildAnnounceURL(meta)
-	if err != nil {
-		return nil, err
+	return GetPeersVia(meta, proxy.Config{}, DefaultPort)
+}
+
+// GetPeersVia announces port as the one peers reach us on, through px.
+// HTTP trackers work with either proxy type; UDP trackers need SOCKS5 and
+// otherwise go direct, unless px.Only forbids that.
+func GetPeersVia(meta *metainfo.TorrentMeta, px proxy.Config, port uint16) ([]Peer, error) {
+	if strings.HasPrefix(meta.Announce, "udp://") {
+		if px.Type == proxy.HTTP && !px.Only {
+			// Direct, but still from the bound interface.
+			px = proxy.Config{Bind: px.Bind}
+		}
+		return announceUDP(meta, px, port)
 	}
+	return announceHTTP(meta, px.HTTPClient(15*time.Second), port)
+}
 
-	client := &http.Client{
-		Timeout: 15 * time.Second,
+func announceHTTP(meta *metainfo.TorrentMeta, client *http.Client, port uint16) ([]Peer, error) {
+	url, err := buildAnnounceURL(meta, port)
+	if err != nil {
+		return nil, err
 	}
 
 	req, _ := http.NewRequest("GET", url, nil)
@@ -0,0 +1,98 @@
+package tracker
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"net/url"
+	"testing"
+	"time"
+
+	"torrent-client/internal/metainfo"
+	"torrent-client/internal/netbind"
+	"torrent-client/internal/proxy"
+)
+
+func TestAnnounceURLCarriesPort(t *testing.T) {
+	meta := &metainfo.TorrentMeta{Announce: "http://tracker.example/announce", Length: 10}
+	raw, err := buildAnnounceURL(meta, 51413)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := u.Query().Get("port"); got != "51413" {
+		t.Errorf("port = %q, want 51413", got)
+	}
+}
+
+func TestUDPAnnounceCarriesPort(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+
+	ports := make(chan uint16, 1)
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			action := binary.BigEndian.Uint32(buf[8:12])
+			resp := binary.BigEndian.AppendUint32(nil, action)
+			resp = append(resp, buf[12:16]...)
+			switch action {
+			case actionConnect:
+				resp = binary.BigEndian.AppendUint64(resp, 42)
+			case actionAnnounce:
+				if n >= 98 {
+					ports <- binary.BigEndian.Uint16(buf[96:98])
+				}
+				resp = append(resp, make([]byte, 12)...)
+			}
+			pc.WriteTo(resp, addr)
+		}
+	}()
+
+	meta := &metainfo.TorrentMeta{Announce: "udp://" + pc.LocalAddr().String()}
+	if _, err := GetPeersVia(meta, proxy.Config{}, 51413); err != nil {
+		t.Fatal(err)
+	}
+	if got := <-ports; got != 51413 {
+		t.Errorf("announced port %d, want 51413", got)
+	}
+}
+
+func TestUDPBypassKeepsBinding(t *testing.T) {
+	meta := &metainfo.TorrentMeta{Announce: "udp://127.0.0.1:1"}
+	px := proxy.Config{Type: proxy.HTTP, Addr: "127.0.0.1:1"}
+	px.Bind.Interface = "no-such-interface"
+	_, err := GetPeersVia(meta, px, DefaultPort)
+	if !errors.Is(err, netbind.ErrUnavailable) {
+		t.Fatalf("got %v, want the announce to fail on the missing interface", err)
+	}
+}
+
+func TestUDPProxyOnlyRefusesDirect(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+
+	meta := &metainfo.TorrentMeta{Announce: "udp://" + pc.LocalAddr().String()}
+	px := proxy.Config{Type: proxy.HTTP, Addr: "127.0.0.1:1", Only: true}
+	if _, err := GetPeersVia(meta, px, DefaultPort); !errors.Is(err, proxy.ErrNoUDP) {
+		t.Fatalf("got %v, want ErrNoUDP", err)
+	}
+
+	pc.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if _, _, err := pc.ReadFrom(make([]byte, 1500)); err == nil {
+		t.Fatal("the tracker was contacted directly")
+	}
+}
@@ -0,0 +1,134 @@
+package tracker
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"time"
+
+	"torrent-client/internal/metainfo"
+	"torrent-client/internal/proxy"
+)
+
+// BEP 15 UDP tracker protocol.
+const (
+	udpProtocolID = 0x41727101980
+
+	actionConnect  = 0
+	actionAnnounce = 1
+	actionError    = 3
+
+	udpRetries = 3
+	udpTimeout = 5 * time.Second
+)
+
+func announceUDP(meta *metainfo.TorrentMeta, px proxy.Config, port uint16) ([]Peer, error) {
+	u, err := url.Parse(meta.Announce)
+	if err != nil {
+		return nil, err
+	}
+	// Resolve through the proxy where possible so the lookup does not
+	// leak either; SOCKS5 accepts host names in UDP headers.
+	var addr net.Addr = hostAddr(u.Host)
+	if !px.Enabled() {
+		if addr, err = net.ResolveUDPAddr("udp", u.Host); err != nil {
+			return nil, err
+		}
+	}
+
+	pc, err := px.ListenPacket()
+	if err != nil {
+		return nil, err
+	}
+	defer pc.Close()
+
+	req := make([]byte, 16)
+	binary.BigEndian.PutUint64(req[0:8], udpProtocolID)
+	binary.BigEndian.PutUint32(req[8:12], actionConnect)
+	resp, err := udpRoundTrip(pc, addr, req, 16)
+	if err != nil {
+		return nil, fmt.Errorf("udp tracker connect: %w", err)
+	}
+	connID := binary.BigEndian.Uint64(resp[8:16])
+
+	peerID, err := GeneratePeerID()
+	if err != nil {
+		return nil, err
+	}
+	req = make([]byte, 98)
+	binary.BigEndian.PutUint64(req[0:8], connID)
+	binary.BigEndian.PutUint32(req[8:12], actionAnnounce)
+	copy(req[16:36], meta.InfoHash[:])
+	copy(req[36:56], peerID[:])
+	binary.BigEndian.PutUint64(req[56:64], 0)                   // downloaded
+	binary.BigEndian.PutUint64(req[64:72], uint64(meta.Length)) // left
+	binary.BigEndian.PutUint64(req[72:80], 0)                   // uploaded
+	binary.BigEndian.PutUint32(req[80:84], 0)                   // event
+	binary.BigEndian.PutUint32(req[84:88], 0)                   // IP: sender's
+	rand.Read(req[88:92])                                       // key
+	binary.BigEndian.PutUint32(req[92:96], ^uint32(0))          // num_want: default
+	binary.BigEndian.PutUint16(req[96:98], port)
+
+	resp, err = udpRoundTrip(pc, addr, req, 20)
+	if err != nil {
+		return nil, fmt.Errorf("udp tracker announce: %w", err)
+	}
+
+	var peers []Peer
+	for i := 20; i+6 <= len(resp); i += 6 {
+		peers = append(peers, Peer{
+			IP:   net.IP(append([]byte(nil), resp[i:i+4]...)),
+			Port: binary.BigEndian.Uint16(resp[i+4 : i+6]),
+		})
+	}
+	return peers, nil
+}
+
+// udpRoundTrip fills in a fresh transaction ID, sends req and waits for the
+// matching response of at least minLen bytes, retrying on timeouts.
+func udpRoundTrip(pc net.PacketConn, addr net.Addr, req []byte, minLen int) ([]byte, error) {
+	action := binary.BigEndian.Uint32(req[8:12])
+	rand.Read(req[12:16])
+	txID := req[12:16]
+
+	buf := make([]byte, 64*1024)
+	for attempt := 0; attempt < udpRetries; attempt++ {
+		if _, err := pc.WriteTo(req, addr); err != nil {
+			return nil, err
+		}
+		pc.SetReadDeadline(time.Now().Add(udpTimeout << attempt))
+
+		for {
+			n, _, err := pc.ReadFrom(buf)
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+			if n < 8 || !bytes.Equal(buf[4:8], txID) {
+				continue
+			}
+			switch binary.BigEndian.Uint32(buf[0:4]) {
+			case actionError:
+				return nil, fmt.Errorf("tracker error: %s", buf[8:n])
+			case action:
+				if n < minLen {
+					return nil, errors.New("short response")
+				}
+				return append([]byte(nil), buf[:n]...), nil
+			}
+		}
+	}
+	return nil, errors.New("tracker did not respond")
+}
+
+// hostAddr is an unresolved host:port, passed as-is to a SOCKS5 relay.
+type hostAddr string
+
+func (h hostAddr) Network() string { return "udp" }
+func (h hostAddr) String() string  { return string(h) }
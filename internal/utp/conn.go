@@ -0,0 +1,597 @@
+package utp
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	mss             = 1200
+	initCwnd        = 3 * mss
+	maxCwnd         = 1 << 20
+	recvWindow      = 1 << 20
+	targetDelay     = 100000 // microseconds
+	maxCwndIncrease = 3000   // bytes per RTT
+	maxReorder      = 1024
+	maxSackBits     = 256
+	initRTO         = time.Second
+	minRTO          = 500 * time.Millisecond
+	maxRTO          = 16 * time.Second
+	maxRetransmits  = 6
+	synRetries      = 3
+	closeTimeout    = 5 * time.Second
+)
+
+var (
+	ErrReset   = errors.New("utp: connection reset by peer")
+	ErrTimeout = errors.New("utp: connection timed out")
+)
+
+type outPacket struct {
+	typ           byte
+	seq           uint16
+	payload       []byte
+	sentAt        time.Time
+	transmissions int
+}
+
+type inPacket struct {
+	typ     byte
+	payload []byte
+}
+
+// Conn is a single uTP stream. Congestion control follows LEDBAT: the
+// window grows while the one-way delay the peer measures stays under the
+// target and shrinks as it exceeds it, so bulk transfers yield to other
+// traffic on the link.
+type Conn struct {
+	sock       *Socket
+	raddr      net.Addr
+	recvID     uint16
+	sendID     uint16
+	ownsSocket bool
+
+	mu          sync.Mutex
+	cond        *sync.Cond
+	established chan struct{}
+	estOnce     sync.Once
+	connected   bool
+	closing     bool
+	closedAt    time.Time
+	err         error
+
+	// sending side
+	seq       uint16
+	outbuf    []*outPacket
+	inflight  int
+	cwnd      float64
+	peerWnd   int
+	rtt       time.Duration
+	rttVar    time.Duration
+	rto       time.Duration
+	lastAckNr uint16
+	dupAcks   int
+	lastCut   time.Time
+	replyDiff uint32
+	baseDelay [2]uint32
+	baseStart time.Time
+
+	// receiving side
+	ack     uint16
+	reorder map[uint16]inPacket
+	readBuf []byte
+	eof     bool
+
+	readDeadline  time.Time
+	writeDeadline time.Time
+}
+
+func newConn(s *Socket, raddr net.Addr, recvID, sendID uint16) *Conn {
+	c := &Conn{
+		sock:        s,
+		raddr:       raddr,
+		recvID:      recvID,
+		sendID:      sendID,
+		established: make(chan struct{}),
+		cwnd:        initCwnd,
+		peerWnd:     recvWindow,
+		rto:         initRTO,
+		reorder:     make(map[uint16]inPacket),
+		baseStart:   time.Now(),
+	}
+	c.cond = sync.NewCond(&c.mu)
+	return c
+}
+
+func (c *Conn) connect() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.seq = 1
+	syn := &outPacket{typ: stSyn, seq: c.seq}
+	c.seq++
+	c.outbuf = append(c.outbuf, syn)
+	c.transmitLocked(syn, time.Now())
+}
+
+func (c *Conn) accepted(syn header) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var b [2]byte
+	rand.Read(b[:])
+	c.seq = binary.BigEndian.Uint16(b[:])
+	c.ack = syn.seq
+	c.replyDiff = nowMicros() - syn.timestamp
+	c.peerWnd = int(syn.wnd)
+	c.connected = true
+	c.estOnce.Do(func() { close(c.established) })
+	c.sendStateLocked()
+}
+
+func (c *Conn) receive(h header, payload []byte) {
+	c.mu.Lock()
+	if c.err != nil {
+		c.mu.Unlock()
+		return
+	}
+
+	now := time.Now()
+	c.replyDiff = nowMicros() - h.timestamp
+	c.peerWnd = int(h.wnd)
+
+	switch {
+	case h.typ == stReset:
+		c.failLocked(ErrReset)
+		c.mu.Unlock()
+		c.sock.remove(c)
+		return
+	case h.typ == stSyn:
+		// Our STATE reply got lost; the peer is retrying.
+		c.sendStateLocked()
+		c.mu.Unlock()
+		return
+	case !c.connected:
+		if h.typ != stState {
+			c.mu.Unlock()
+			return
+		}
+		c.connected = true
+		c.ack = h.seq - 1
+		c.estOnce.Do(func() { close(c.established) })
+	}
+
+	c.handleAckLocked(h, now)
+	if h.typ == stData || h.typ == stFin {
+		c.receiveDataLocked(h, payload)
+	}
+	c.cond.Broadcast()
+	c.mu.Unlock()
+}
+
+func (c *Conn) receiveDataLocked(h header, payload []byte) {
+	if !seqLess(c.ack, h.seq) {
+		c.sendStateLocked()
+		return
+	}
+	if uint16(h.seq-c.ack) > maxReorder {
+		return
+	}
+
+	c.reorder[h.seq] = inPacket{typ: h.typ, payload: payload}
+	for {
+		p, ok := c.reorder[c.ack+1]
+		if !ok {
+			break
+		}
+		delete(c.reorder, c.ack+1)
+		c.ack++
+		if p.typ == stFin {
+			c.eof = true
+		} else if !c.eof {
+			c.readBuf = append(c.readBuf, p.payload...)
+		}
+	}
+	c.sendStateLocked()
+}
+
+func (c *Conn) handleAckLocked(h header, now time.Time) {
+	acked := 0
+	for len(c.outbuf) > 0 && !seqLess(h.ack, c.outbuf[0].seq) {
+		p := c.outbuf[0]
+		c.outbuf = c.outbuf[1:]
+		acked += c.ackPacketLocked(p, now)
+	}
+
+	if len(h.sack) > 0 {
+		acked += c.handleSackLocked(h, now)
+	}
+
+	if acked == 0 && h.typ == stState && h.ack == c.lastAckNr && len(c.outbuf) > 0 {
+		c.dupAcks++
+		if c.dupAcks == 3 && c.outbuf[0].seq == h.ack+1 {
+			c.onLossLocked(now)
+			c.transmitLocked(c.outbuf[0], now)
+		}
+	} else if acked > 0 {
+		c.dupAcks = 0
+	}
+	c.lastAckNr = h.ack
+
+	if acked > 0 {
+		c.updateWindowLocked(h.timestampDiff, acked, now)
+		// Progress ends any timeout backoff.
+		c.resetRTOLocked()
+	}
+}
+
+// handleSackLocked drops selectively acked packets from the send buffer and
+// retransmits those with at least three later packets acked, which TCP's
+// fast retransmit would also consider lost.
+func (c *Conn) handleSackLocked(h header, now time.Time) int {
+	bits := len(h.sack) * 8
+	cum := make([]int, bits+1)
+	for i := 0; i < bits; i++ {
+		cum[i+1] = cum[i]
+		if h.sack[i/8]&(1<<(i%8)) != 0 {
+			cum[i+1]++
+		}
+	}
+
+	acked := 0
+	kept := c.outbuf[:0]
+	for _, p := range c.outbuf {
+		off := int(int16(p.seq - h.ack - 2))
+		if off >= 0 && off < bits && cum[off+1] > cum[off] {
+			acked += c.ackPacketLocked(p, now)
+			continue
+		}
+		kept = append(kept, p)
+	}
+	c.outbuf = kept
+
+	lost := false
+	for _, p := range c.outbuf {
+		off := int(int16(p.seq - h.ack - 2))
+		if off >= bits {
+			break
+		}
+		if off < -1 {
+			continue
+		}
+		if cum[bits]-cum[off+1] >= 3 && now.Sub(p.sentAt) > c.rtt {
+			lost = true
+			c.transmitLocked(p, now)
+		}
+	}
+	if lost {
+		c.onLossLocked(now)
+	}
+	return acked
+}
+
+func (c *Conn) ackPacketLocked(p *outPacket, now time.Time) int {
+	c.inflight -= len(p.payload)
+	if p.transmissions == 1 {
+		c.rttSampleLocked(now.Sub(p.sentAt))
+	}
+	return len(p.payload)
+}
+
+func (c *Conn) rttSampleLocked(d time.Duration) {
+	if c.rtt == 0 {
+		c.rtt = d
+		c.rttVar = d / 2
+	} else {
+		delta := c.rtt - d
+		if delta < 0 {
+			delta = -delta
+		}
+		c.rttVar += (delta - c.rttVar) / 4
+		c.rtt += (d - c.rtt) / 8
+	}
+	c.resetRTOLocked()
+}
+
+func (c *Conn) resetRTOLocked() {
+	if c.rtt == 0 {
+		return
+	}
+	c.rto = c.rtt + 4*c.rttVar
+	if c.rto < minRTO {
+		c.rto = minRTO
+	}
+}
+
+// updateWindowLocked applies the LEDBAT controller. delay is the peer's
+// measurement of how long our packets take to reach it; its minimum over
+// the last two minutes serves as the uncongested base.
+func (c *Conn) updateWindowLocked(delay uint32, acked int, now time.Time) {
+	if delay != 0 {
+		if now.Sub(c.baseStart) > time.Minute {
+			c.baseDelay[1] = c.baseDelay[0]
+			c.baseDelay[0] = 0
+			c.baseStart = now
+		}
+		if c.baseDelay[0] == 0 || delay < c.baseDelay[0] {
+			c.baseDelay[0] = delay
+		}
+		base := c.baseDelay[0]
+		if c.baseDelay[1] != 0 && c.baseDelay[1] < base {
+			base = c.baseDelay[1]
+		}
+
+		queuing := float64(delay - base)
+		offTarget := (targetDelay - queuing) / targetDelay
+		c.cwnd += maxCwndIncrease * offTarget * float64(acked) / c.cwnd
+	} else {
+		c.cwnd += float64(mss) * float64(acked) / c.cwnd
+	}
+
+	if c.cwnd < mss {
+		c.cwnd = mss
+	}
+	if c.cwnd > maxCwnd {
+		c.cwnd = maxCwnd
+	}
+}
+
+// onLossLocked halves the window, at most once per round trip.
+func (c *Conn) onLossLocked(now time.Time) {
+	if now.Sub(c.lastCut) < c.rtt {
+		return
+	}
+	c.cwnd /= 2
+	if c.cwnd < mss {
+		c.cwnd = mss
+	}
+	c.lastCut = now
+}
+
+func (c *Conn) tick(now time.Time) {
+	c.mu.Lock()
+	if c.err != nil {
+		c.mu.Unlock()
+		return
+	}
+	// Waiters re-check their deadlines on every tick.
+	c.cond.Broadcast()
+
+	if c.closing && (len(c.outbuf) == 0 || now.Sub(c.closedAt) > closeTimeout) {
+		c.failLocked(net.ErrClosed)
+		c.mu.Unlock()
+		c.sock.remove(c)
+		return
+	}
+
+	if len(c.outbuf) > 0 {
+		p := c.outbuf[0]
+		if now.Sub(p.sentAt) > c.rto {
+			limit := maxRetransmits
+			if !c.connected {
+				limit = synRetries
+			}
+			if p.transmissions > limit {
+				c.failLocked(ErrTimeout)
+				c.mu.Unlock()
+				c.sock.remove(c)
+				return
+			}
+
+			c.cwnd = mss
+			c.rto *= 2
+			if c.rto > maxRTO {
+				c.rto = maxRTO
+			}
+			c.transmitLocked(p, now)
+		}
+	}
+	c.mu.Unlock()
+}
+
+func (c *Conn) transmitLocked(p *outPacket, now time.Time) {
+	p.sentAt = now
+	p.transmissions++
+	c.sendLocked(p.typ, p.seq, p.payload)
+}
+
+func (c *Conn) sendStateLocked() {
+	c.sendLocked(stState, c.seq, nil)
+}
+
+func (c *Conn) sendLocked(typ byte, seq uint16, payload []byte) {
+	wnd := recvWindow - len(c.readBuf)
+	if wnd < 0 {
+		wnd = 0
+	}
+	h := header{
+		typ:           typ,
+		connID:        c.sendID,
+		timestamp:     nowMicros(),
+		timestampDiff: c.replyDiff,
+		wnd:           uint32(wnd),
+		seq:           seq,
+		ack:           c.ack,
+		sack:          c.sackLocked(),
+	}
+	if typ == stSyn {
+		h.connID = c.recvID
+	}
+	c.sock.pc.WriteTo(h.marshal(payload), c.raddr)
+}
+
+// sackLocked builds the selective ack bitmask for out-of-order packets we
+// are holding. Bit i stands for sequence number ack+2+i.
+func (c *Conn) sackLocked() []byte {
+	if len(c.reorder) == 0 {
+		return nil
+	}
+	var mask []byte
+	for seq := range c.reorder {
+		off := int(uint16(seq - c.ack - 2))
+		if off >= maxSackBits {
+			continue
+		}
+		for len(mask) <= off/8 {
+			mask = append(mask, 0, 0, 0, 0)
+		}
+		mask[off/8] |= 1 << (off % 8)
+	}
+	return mask
+}
+
+func (c *Conn) Read(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for len(c.readBuf) == 0 {
+		switch {
+		case c.eof:
+			return 0, io.EOF
+		case c.err != nil:
+			return 0, c.err
+		case c.closing:
+			return 0, net.ErrClosed
+		case !c.readDeadline.IsZero() && time.Now().After(c.readDeadline):
+			return 0, os.ErrDeadlineExceeded
+		}
+		c.cond.Wait()
+	}
+
+	wasFull := len(c.readBuf) > recvWindow/2
+	n := copy(p, c.readBuf)
+	c.readBuf = c.readBuf[n:]
+	if len(c.readBuf) == 0 {
+		c.readBuf = nil
+	}
+	// Let a sender stalled on our window know it opened again.
+	if wasFull && len(c.readBuf) <= recvWindow/2 {
+		c.sendStateLocked()
+	}
+	return n, nil
+}
+
+func (c *Conn) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	total := 0
+	for len(p) > 0 {
+		switch {
+		case c.err != nil:
+			return total, c.err
+		case c.closing:
+			return total, net.ErrClosed
+		case !c.writeDeadline.IsZero() && time.Now().After(c.writeDeadline):
+			return total, os.ErrDeadlineExceeded
+		}
+
+		window := int(c.cwnd)
+		if c.peerWnd < window {
+			window = c.peerWnd
+		}
+		// With nothing in flight one packet always goes out, which also
+		// probes a peer that advertised a zero window.
+		if c.inflight > 0 && c.inflight+mss > window {
+			c.cond.Wait()
+			continue
+		}
+
+		n := len(p)
+		if n > mss {
+			n = mss
+		}
+		pkt := &outPacket{typ: stData, seq: c.seq, payload: append([]byte(nil), p[:n]...)}
+		c.seq++
+		c.outbuf = append(c.outbuf, pkt)
+		c.inflight += n
+		c.transmitLocked(pkt, time.Now())
+
+		p = p[n:]
+		total += n
+	}
+	return total, nil
+}
+
+// Close sends a FIN once queued data is out; the connection lingers until
+// the FIN is acked or closeTimeout passes.
+func (c *Conn) Close() error {
+	c.mu.Lock()
+	if c.closing || c.err != nil {
+		c.mu.Unlock()
+		return nil
+	}
+	c.closing = true
+	c.closedAt = time.Now()
+	if !c.connected {
+		c.failLocked(net.ErrClosed)
+		c.mu.Unlock()
+		c.sock.remove(c)
+		return nil
+	}
+
+	fin := &outPacket{typ: stFin, seq: c.seq}
+	c.seq++
+	c.outbuf = append(c.outbuf, fin)
+	c.transmitLocked(fin, time.Now())
+	c.cond.Broadcast()
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *Conn) fail(err error) {
+	c.mu.Lock()
+	c.failLocked(err)
+	c.mu.Unlock()
+	c.sock.remove(c)
+}
+
+func (c *Conn) failLocked(err error) {
+	if c.err == nil {
+		c.err = err
+	}
+	c.estOnce.Do(func() { close(c.established) })
+	c.cond.Broadcast()
+}
+
+func (c *Conn) error() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
+
+func (c *Conn) LocalAddr() net.Addr {
+	return c.sock.Addr()
+}
+
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.raddr
+}
+
+func (c *Conn) SetDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.readDeadline = t
+	c.writeDeadline = t
+	return nil
+}
+
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.readDeadline = t
+	return nil
+}
+
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.writeDeadline = t
+	return nil
+}
@@ -0,0 +1,99 @@
+package utp
+
+import (
+	"encoding/binary"
+	"errors"
+	"time"
+)
+
+const (
+	stData  = 0
+	stFin   = 1
+	stState = 2
+	stReset = 3
+	stSyn   = 4
+
+	version    = 1
+	headerSize = 20
+	extSack    = 1
+)
+
+var errBadPacket = errors.New("utp: malformed packet")
+
+type header struct {
+	typ           byte
+	connID        uint16
+	timestamp     uint32
+	timestampDiff uint32
+	wnd           uint32
+	seq           uint16
+	ack           uint16
+	sack          []byte
+}
+
+func (h *header) marshal(payload []byte) []byte {
+	size := headerSize + len(payload)
+	if len(h.sack) > 0 {
+		size += 2 + len(h.sack)
+	}
+	b := make([]byte, headerSize, size)
+
+	b[0] = h.typ<<4 | version
+	if len(h.sack) > 0 {
+		b[1] = extSack
+	}
+	binary.BigEndian.PutUint16(b[2:4], h.connID)
+	binary.BigEndian.PutUint32(b[4:8], h.timestamp)
+	binary.BigEndian.PutUint32(b[8:12], h.timestampDiff)
+	binary.BigEndian.PutUint32(b[12:16], h.wnd)
+	binary.BigEndian.PutUint16(b[16:18], h.seq)
+	binary.BigEndian.PutUint16(b[18:20], h.ack)
+
+	if len(h.sack) > 0 {
+		b = append(b, 0, byte(len(h.sack)))
+		b = append(b, h.sack...)
+	}
+	return append(b, payload...)
+}
+
+func parsePacket(b []byte) (header, []byte, error) {
+	var h header
+	if len(b) < headerSize || b[0]&0x0f != version {
+		return h, nil, errBadPacket
+	}
+	h.typ = b[0] >> 4
+	if h.typ > stSyn {
+		return h, nil, errBadPacket
+	}
+	h.connID = binary.BigEndian.Uint16(b[2:4])
+	h.timestamp = binary.BigEndian.Uint32(b[4:8])
+	h.timestampDiff = binary.BigEndian.Uint32(b[8:12])
+	h.wnd = binary.BigEndian.Uint32(b[12:16])
+	h.seq = binary.BigEndian.Uint16(b[16:18])
+	h.ack = binary.BigEndian.Uint16(b[18:20])
+
+	// Walk the extension chain; only selective acks are understood.
+	ext := b[1]
+	rest := b[headerSize:]
+	for ext != 0 {
+		if len(rest) < 2 || len(rest) < 2+int(rest[1]) {
+			return h, nil, errBadPacket
+		}
+		next, length := rest[0], int(rest[1])
+		if ext == extSack {
+			h.sack = rest[2 : 2+length]
+		}
+		ext = next
+		rest = rest[2+length:]
+	}
+	return h, rest, nil
+}
+
+func nowMicros() uint32 {
+	return uint32(time.Now().UnixMicro())
+}
+
+// seqLess compares 16-bit sequence numbers across wraparound.
+func seqLess(a, b uint16) bool {
+	return int16(a-b) < 0
+}
@@ -0,0 +1,238 @@
+package utp
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+var ErrClosed = errors.New("utp: socket closed")
+
+type connKey struct {
+	addr string
+	id   uint16
+}
+
+// Socket multiplexes uTP connections over a single UDP socket. It can dial
+// out and, when accepting, hands incoming connections to Accept, so it
+// doubles as a net.Listener.
+type Socket struct {
+	pc        net.PacketConn
+	accepting bool
+
+	mu    sync.Mutex
+	conns map[connKey]*Conn
+
+	acceptCh  chan *Conn
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func Listen(network, addr string) (*Socket, error) {
+	pc, err := net.ListenPacket(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	return NewSocket(pc, true), nil
+}
+
+// NewSocket runs uTP over pc. Incoming connections are only accepted when
+// accept is set; otherwise unknown peers get a reset.
+func NewSocket(pc net.PacketConn, accept bool) *Socket {
+	s := &Socket{
+		pc:        pc,
+		accepting: accept,
+		conns:     make(map[connKey]*Conn),
+		acceptCh:  make(chan *Conn, 32),
+		closed:    make(chan struct{}),
+	}
+	go s.readLoop()
+	go s.tickLoop()
+	return s
+}
+
+func (s *Socket) Addr() net.Addr {
+	return s.pc.LocalAddr()
+}
+
+func (s *Socket) Accept() (net.Conn, error) {
+	select {
+	case c := <-s.acceptCh:
+		return c, nil
+	case <-s.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (s *Socket) Close() error {
+	s.closeOnce.Do(func() {
+		close(s.closed)
+		s.pc.Close()
+
+		s.mu.Lock()
+		conns := s.conns
+		s.conns = make(map[connKey]*Conn)
+		s.mu.Unlock()
+
+		for _, c := range conns {
+			c.fail(ErrClosed)
+		}
+	})
+	return nil
+}
+
+// Dial opens a uTP connection on a private socket that is closed together
+// with the connection.
+func Dial(addr string, timeout time.Duration) (net.Conn, error) {
+	pc, err := net.ListenPacket("udp", ":0")
+	if err != nil {
+		return nil, err
+	}
+	s := NewSocket(pc, false)
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	c, err := s.dial(ctx, addr, true)
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+func (s *Socket) DialContext(ctx context.Context, addr string) (net.Conn, error) {
+	return s.dial(ctx, addr, false)
+}
+
+func (s *Socket) dial(ctx context.Context, addr string, ownsSocket bool) (*Conn, error) {
+	raddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	var recvID uint16
+	for {
+		var b [2]byte
+		rand.Read(b[:])
+		recvID = binary.BigEndian.Uint16(b[:])
+		if _, taken := s.conns[connKey{raddr.String(), recvID}]; !taken {
+			break
+		}
+	}
+	c := newConn(s, raddr, recvID, recvID+1)
+	c.ownsSocket = ownsSocket
+	s.conns[connKey{raddr.String(), recvID}] = c
+	s.mu.Unlock()
+
+	c.connect()
+
+	select {
+	case <-c.established:
+	case <-ctx.Done():
+		c.fail(ctx.Err())
+		return nil, ctx.Err()
+	}
+	if err := c.error(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (s *Socket) readLoop() {
+	buf := make([]byte, 64*1024)
+	for {
+		n, addr, err := s.pc.ReadFrom(buf)
+		if err != nil {
+			select {
+			case <-s.closed:
+				return
+			default:
+			}
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				continue
+			}
+			s.Close()
+			return
+		}
+
+		h, payload, err := parsePacket(buf[:n])
+		if err != nil {
+			continue
+		}
+		s.dispatch(addr, h, append([]byte(nil), payload...))
+	}
+}
+
+func (s *Socket) dispatch(addr net.Addr, h header, payload []byte) {
+	key := connKey{addr.String(), h.connID}
+	if h.typ == stSyn {
+		key.id = h.connID + 1
+	}
+
+	s.mu.Lock()
+	c, ok := s.conns[key]
+	if !ok && h.typ == stSyn && s.accepting {
+		c = newConn(s, addr, h.connID+1, h.connID)
+		s.conns[key] = c
+		s.mu.Unlock()
+
+		c.accepted(h)
+		select {
+		case s.acceptCh <- c:
+		default:
+			c.fail(errors.New("utp: accept backlog full"))
+		}
+		return
+	}
+	s.mu.Unlock()
+
+	if !ok {
+		if h.typ != stReset {
+			reset := header{typ: stReset, connID: h.connID, ack: h.seq, timestamp: nowMicros()}
+			s.pc.WriteTo(reset.marshal(nil), addr)
+		}
+		return
+	}
+	c.receive(h, payload)
+}
+
+func (s *Socket) tickLoop() {
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.closed:
+			return
+		case now := <-ticker.C:
+			s.mu.Lock()
+			conns := make([]*Conn, 0, len(s.conns))
+			for _, c := range s.conns {
+				conns = append(conns, c)
+			}
+			s.mu.Unlock()
+
+			for _, c := range conns {
+				c.tick(now)
+			}
+		}
+	}
+}
+
+func (s *Socket) remove(c *Conn) {
+	s.mu.Lock()
+	key := connKey{c.raddr.String(), c.recvID}
+	registered := s.conns[key] == c
+	if registered {
+		delete(s.conns, key)
+	}
+	s.mu.Unlock()
+
+	if registered && c.ownsSocket {
+		s.Close()
+	}
+}
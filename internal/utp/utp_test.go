@@ -0,0 +1,240 @@
+package utp
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"math/rand"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// lossyConn wraps a PacketConn and drops or reorders what is written to it.
+// drop sees every outgoing packet; with reorder set, every fifth packet is
+// held back and sent after the one that follows it.
+type lossyConn struct {
+	net.PacketConn
+
+	mu      sync.Mutex
+	drop    func(h header) bool
+	reorder bool
+	count   int
+	held    []byte
+	heldTo  net.Addr
+	sent    []header
+}
+
+func (c *lossyConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	h, _, err := parsePacket(b)
+	if err != nil {
+		return 0, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.sent = append(c.sent, h)
+	if c.drop != nil && c.drop(h) {
+		return len(b), nil
+	}
+	c.count++
+	if c.reorder && c.held == nil && c.count%5 == 0 {
+		c.held = append([]byte(nil), b...)
+		c.heldTo = addr
+		return len(b), nil
+	}
+	n, err := c.PacketConn.WriteTo(b, addr)
+	if c.held != nil {
+		c.PacketConn.WriteTo(c.held, c.heldTo)
+		c.held = nil
+	}
+	return n, err
+}
+
+func (c *lossyConn) sentOfType(typ byte) []header {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var out []header
+	for _, h := range c.sent {
+		if h.typ == typ {
+			out = append(out, h)
+		}
+	}
+	return out
+}
+
+func listenLossy(t *testing.T) *lossyConn {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &lossyConn{PacketConn: pc}
+}
+
+// pair connects a dialing and an accepting socket over the given wrappers.
+func pair(t *testing.T, client, server *lossyConn) (*Conn, *Conn) {
+	t.Helper()
+	cs := NewSocket(client, false)
+	ss := NewSocket(server, true)
+	t.Cleanup(func() {
+		cs.Close()
+		ss.Close()
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	dialed, err := cs.DialContext(ctx, server.LocalAddr().String())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	accepted, err := ss.Accept()
+	if err != nil {
+		t.Fatalf("accept: %v", err)
+	}
+	return dialed.(*Conn), accepted.(*Conn)
+}
+
+func randomData(n int) []byte {
+	data := make([]byte, n)
+	rand.New(rand.NewSource(1)).Read(data)
+	return data
+}
+
+func TestTransferWithLossAndReordering(t *testing.T) {
+	client, server := listenLossy(t), listenLossy(t)
+	rng := rand.New(rand.NewSource(7))
+	var rngMu sync.Mutex
+	lossy := func(h header) bool {
+		if h.typ == stSyn {
+			return false
+		}
+		rngMu.Lock()
+		defer rngMu.Unlock()
+		return rng.Intn(100) < 5
+	}
+	client.drop, client.reorder = lossy, true
+	server.drop, server.reorder = lossy, true
+
+	w, r := pair(t, client, server)
+	data := randomData(512 * 1024)
+
+	go func() {
+		w.Write(data)
+		w.Close()
+	}()
+
+	r.SetReadDeadline(time.Now().Add(30 * time.Second))
+	got, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("read: %v after %d bytes", err, len(got))
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatalf("received %d bytes that differ from the %d sent", len(got), len(data))
+	}
+}
+
+func TestCloseSendsFin(t *testing.T) {
+	client, server := listenLossy(t), listenLossy(t)
+	w, r := pair(t, client, server)
+
+	if _, err := w.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write([]byte("more")); err != net.ErrClosed {
+		t.Errorf("write after close: got %v, want net.ErrClosed", err)
+	}
+
+	r.SetReadDeadline(time.Now().Add(5 * time.Second))
+	got, err := io.ReadAll(r)
+	if err != nil || string(got) != "hello" {
+		t.Fatalf("read %q, %v", got, err)
+	}
+	if len(client.sentOfType(stFin)) == 0 {
+		t.Error("no FIN was sent")
+	}
+
+	// The closing side goes away once its FIN is acked.
+	deadline := time.Now().Add(2 * time.Second)
+	for w.error() == nil && time.Now().Before(deadline) {
+		time.Sleep(20 * time.Millisecond)
+	}
+	if w.error() != net.ErrClosed {
+		t.Errorf("closed conn reports %v", w.error())
+	}
+	w.sock.mu.Lock()
+	left := len(w.sock.conns)
+	w.sock.mu.Unlock()
+	if left != 0 {
+		t.Errorf("%d connections still registered after close", left)
+	}
+}
+
+func TestSynIsRetried(t *testing.T) {
+	client, server := listenLossy(t), listenLossy(t)
+	dropped := false
+	client.drop = func(h header) bool {
+		if h.typ == stSyn && !dropped {
+			dropped = true
+			return true
+		}
+		return false
+	}
+
+	w, r := pair(t, client, server)
+	if n := len(client.sentOfType(stSyn)); n < 2 {
+		t.Fatalf("sent %d SYNs, want a retry", n)
+	}
+
+	w.Write([]byte("ok"))
+	buf := make([]byte, 2)
+	r.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(r, buf); err != nil || string(buf) != "ok" {
+		t.Fatalf("read %q, %v", buf, err)
+	}
+}
+
+func TestSackTriggersRetransmit(t *testing.T) {
+	rec := listenLossy(t)
+	defer rec.Close()
+	sock := &Socket{pc: rec, conns: make(map[connKey]*Conn)}
+	c := newConn(sock, rec.LocalAddr(), 1, 2)
+	c.connected = true
+	c.rtt = 10 * time.Millisecond
+
+	sent := time.Now().Add(-time.Second)
+	for seq := uint16(10); seq <= 15; seq++ {
+		c.outbuf = append(c.outbuf, &outPacket{typ: stData, seq: seq, payload: make([]byte, 100), sentAt: sent, transmissions: 1})
+		c.inflight += 100
+	}
+
+	// The peer has everything up to 9 plus 12, 13 and 14. Bit i of the mask
+	// stands for ack+2+i.
+	h := header{typ: stState, ack: 9, sack: []byte{0x0e, 0, 0, 0}}
+	c.mu.Lock()
+	c.handleAckLocked(h, time.Now())
+	c.mu.Unlock()
+
+	var left []uint16
+	for _, p := range c.outbuf {
+		left = append(left, p.seq)
+	}
+	if len(left) != 3 || left[0] != 10 || left[1] != 11 || left[2] != 15 {
+		t.Fatalf("send buffer holds %v, want [10 11 15]", left)
+	}
+	if c.inflight != 300 {
+		t.Errorf("inflight = %d, want 300", c.inflight)
+	}
+
+	resent := map[uint16]bool{}
+	for _, h := range rec.sentOfType(stData) {
+		resent[h.seq] = true
+	}
+	if !resent[10] || !resent[11] || resent[15] {
+		t.Errorf("retransmitted %v, want 10 and 11 only", resent)
+	}
+}
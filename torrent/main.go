@@ -24,10 +24,21 @@ func main() {
 	}
 
 	manager := p2p.NewManager(myID)
+	if err := manager.Listen(manager.Config.ListenAddr); err != nil {
+		log.Printf("Could not listen for incoming peers: %v", err)
+	}
+	if manager.Config.IPFilterPath != "" {
+		if err := manager.LoadIPFilter(manager.Config.IPFilterPath); err != nil {
+			log.Printf("Could not load IP filter: %v", err)
+		}
+	}
 
 	server := api.NewServer(manager)
 	go server.Start()
 	gui.StartUI(manager)
+	if err := manager.Close(); err != nil {
+		log.Printf("Shutdown: %v", err)
+	}
 
 }
 